@@ -1,7 +1,17 @@
 'use client';
 
 import React, { useState, useEffect, useRef } from 'react';
-import { getLogs } from '../../../services/api';
+import { getLogs, tailLogsUrl } from '../../../services/api';
+
+// Lines kept on screen; older ones scroll away
+const MAX_LINES = 500;
+
+// Appends lines, skipping ones already shown: the seed from /logs and the
+// stream can both carry an event written while the page loaded
+const appendLines = (shown, lines) => {
+    const seen = new Set(shown.map((log) => log.id));
+    return [...shown, ...lines.filter((log) => !seen.has(log.id))].slice(-MAX_LINES);
+};
 
 export default function LiveFeed() {
     const [logs, setLogs] = useState([]);
@@ -9,21 +19,35 @@ export default function LiveFeed() {
     const scrollRef = useRef(null);
 
     useEffect(() => {
+        // Seed with the last hour, then follow the stream; EventSource reconnects
+        // on its own and resumes from the last event it saw
         const fetchLogs = async () => {
             try {
                 const toTime = new Date();
                 const fromTime = new Date(toTime.getTime() - 3600000); // Last 1 hour
                 const data = await getLogs(fromTime.toISOString(), toTime.toISOString(), 100);
                 const logList = Array.isArray(data) ? data : (data.logs || []);
-                setLogs(logList);
+                setLogs((streamed) => appendLines(logList.reverse(), streamed));
             } catch (error) {
                 console.error('Error fetching live logs:', error);
             }
         };
 
         fetchLogs();
-        const interval = setInterval(fetchLogs, 1500);
-        return () => clearInterval(interval);
+        const source = new EventSource(tailLogsUrl());
+        source.addEventListener('log', (e) => {
+            const log = JSON.parse(e.data);
+            setLogs((prev) => appendLines(prev, [log]));
+        });
+        source.addEventListener('dropped', (e) => {
+            console.warn('Live feed fell behind:', JSON.parse(e.data).message);
+        });
+        // The server restarted or we were away too long: start over from /logs
+        source.addEventListener('reset', () => {
+            setLogs([]);
+            fetchLogs();
+        });
+        return () => source.close();
     }, []);
 
     useEffect(() => {
@@ -110,8 +134,8 @@ export default function LiveFeed() {
                     }}
                 >
                     {logs.length > 0 ? (
-                        logs.map((log, index) => (
-                            <div key={index} className="log-line" style={{ marginBottom: '6px', display: 'flex', gap: '12px', borderBottom: '1px solid rgba(255,255,255,0.02)', paddingBottom: '4px' }}>
+                        logs.map((log) => (
+                            <div key={log.id} className="log-line" style={{ marginBottom: '6px', display: 'flex', gap: '12px', borderBottom: '1px solid rgba(255,255,255,0.02)', paddingBottom: '4px' }}>
                                 <span style={{ color: '#64748b' }}>[{new Date(log.timestamp).toLocaleTimeString()}]</span>
                                 <span style={{ minWidth: '80px', ...getLevelStyle(log.level) }}>{log.level.padEnd(7)}</span>
                                 <span style={{ color: '#38bdf8' }}>{log.service.padEnd(15)}</span>
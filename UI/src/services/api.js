@@ -41,6 +41,12 @@ export const getLogs = (fromTime, toTime, limit = 50) => {
   return apiCall(`/logs${query ? `?${query}` : ''}`);
 };
 
+// Live tail (LiveFeed uses this): Server-Sent Events of newly written logs
+export const tailLogsUrl = (params = {}) => {
+  const query = new URLSearchParams(params).toString();
+  return `${API_BASE_URL}/logs/tail${query ? `?${query}` : ''}`;
+};
+
 // Metrics
 export const getMetrics = async () => {
   const data = await apiCall('/metrics');
@@ -2,20 +2,126 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/serilevanjalines/LogFlow/internal/multiline"
 )
 
+// Delivery attempts per log before it is given up on
+const maxSendAttempts = 5
+
 type LogEvent struct {
+	// Stays the same across retries so the server can drop duplicate deliveries
+	EventID   string `json:"event_id"`
 	Timestamp string `json:"timestamp"`
 	Service   string
 	Level     string
 	Message   string
 	Route     string
+	TraceID   string                 `json:"trace_id,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTraceID returns a W3C trace id (32 lowercase hex characters)
+func newTraceID() string {
+	return newEventID()
+}
+
+// lineShipper joins multiline output (stack traces, panics) per service before
+// sending, so a trace leaves the agent as one log instead of dozens
+type lineShipper struct {
+	url   string
+	rules []*multiline.Rule
+	asm   map[string]*multiline.Assembler
+	first map[string]LogEvent // fields of the line that opened each service's event
+	count map[string]int
+}
+
+func newLineShipper(url string) *lineShipper {
+	presets := os.Getenv("AGENT_MULTILINE")
+	if presets == "" {
+		presets = "java,python,go,node"
+	}
+	rules, err := multiline.Presets(presets)
+	if err != nil {
+		fmt.Printf("⚠️ %v, multiline assembly disabled\n", err)
+	}
+	return &lineShipper{
+		url:   url,
+		rules: rules,
+		asm:   map[string]*multiline.Assembler{},
+		first: map[string]LogEvent{},
+		count: map[string]int{},
+	}
+}
+
+// emit sends the event the line completes, if any, and holds the line back
+func (s *lineShipper) emit(log LogEvent) {
+	if len(s.rules) == 0 {
+		sendLog(s.url, log)
+		return
+	}
+	asm, ok := s.asm[log.Service]
+	if !ok {
+		asm = multiline.New(s.rules, 0)
+		s.asm[log.Service] = asm
+	}
+	if evt, done := asm.Add(log.Message); done {
+		s.send(log.Service, evt)
+	}
+	if s.count[log.Service] == 0 {
+		s.first[log.Service] = log
+	}
+	s.count[log.Service]++
+}
+
+// flush sends every held-back event
+func (s *lineShipper) flush() {
+	for service, asm := range s.asm {
+		if evt, ok := asm.Flush(); ok {
+			s.send(service, evt)
+		}
+	}
+}
+
+func (s *lineShipper) send(service string, evt multiline.Event) {
+	log := s.first[service]
+	if len(evt.Lines) > 1 {
+		log.Message = evt.Text()
+		log.Metadata = map[string]interface{}{"multiline_lines": len(evt.Lines)}
+		if class, frame := evt.Details(); class != "" || frame != "" {
+			log.Metadata["exception_class"] = class
+			log.Metadata["top_frame"] = frame
+		}
+	}
+	s.count[service] = 0
+	sendLog(s.url, log)
+}
+
+// javaTrace is printed line by line during the crash phase
+var javaTrace = []string{
+	"Payment gateway call failed order_id=ORD-%d",
+	"java.net.SocketTimeoutException: Read timed out",
+	"\tat java.base/sun.nio.ch.NioSocketImpl.timedRead(NioSocketImpl.java:288)",
+	"\tat com.logflow.payments.GatewayClient.charge(GatewayClient.java:142)",
+	"\tat com.logflow.payments.PaymentService.process(PaymentService.java:87)",
+	"Caused by: java.io.IOException: Connection reset by peer",
+	"\t... 12 more",
 }
 
 func main() {
@@ -52,6 +158,7 @@ func main() {
 	fmt.Printf("📡 Target Server: %s\n", serverURL)
 
 	services := []string{"payment-service", "auth-service", "api-gateway", "database"}
+	shipper := newLineShipper(serverURL)
 
 	// Infinite Burst cycles: HEALTHY → CRASH → HEALTHY (perfect Time-Travel demo)
 	for cycle := 1; ; cycle++ {
@@ -83,46 +190,95 @@ func main() {
 			}
 
 			log := LogEvent{
-				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
 				Service:   services[i%4],
 				Level:     level,
 				Message:   message,
 				Route:     "/api/users/login",
 			}
-			sendLog(serverURL, log)
+			shipper.emit(log)
 			time.Sleep(3 * time.Second) // Realistic rate
 		}
+		shipper.flush()
 
 		fmt.Printf("\n💥 CYCLE %d: CRASH PHASE (100 ERRORs, flood)...\n", cycle)
 
-		// CRASH: ERROR flood (30s window)
+		// CRASH: ERROR flood (30s window). Each failing transaction passes through
+		// all four services, so consecutive logs share a trace id.
+		var traceID string
 		for i := 0; i < 100; i++ {
+			if i%4 == 0 {
+				traceID = newTraceID()
+			}
 			log := LogEvent{
-				Timestamp: time.Now().UTC().Format(time.RFC3339), // FRESH timestamps!
+				TraceID:   traceID,
+				RequestID: fmt.Sprintf("req-%d", i/4+5000),
+				Timestamp: time.Now().UTC().Format(time.RFC3339Nano), // FRESH timestamps!
 				Service:   services[i%4],
 				Level:     "ERROR",
 				Message:   fmt.Sprintf("Transaction failed order_id=ORD-%d reason=TIMEOUT timeout=5000ms attempts=3", i+5000),
 				Route:     "/api/payments/process",
 			}
-			sendLog(serverURL, log)
+			shipper.emit(log)
+
+			// Every so often the payment service dumps a stack trace, one line at a time
+			if i%25 == 0 {
+				for j, line := range javaTrace {
+					if j == 0 {
+						line = fmt.Sprintf(line, i+5000)
+					}
+					log.Service = "payment-service"
+					log.Message = line
+					shipper.emit(log)
+				}
+			}
 			time.Sleep(200 * time.Millisecond) // FLOOD!
 		}
+		shipper.flush()
 
 		fmt.Printf("\n✅ CYCLE %d COMPLETE - Time-Travel ready! (Check UI: healthy=just now, crash=2min ago)\n\n", cycle)
 		time.Sleep(10 * time.Second)
 	}
 }
 
+// sendLog delivers one log, retrying network errors, 429 and 5xx with backoff.
+// The event id is fixed before the first attempt, so a retry of a delivery the
+// server already accepted is acknowledged without being stored twice.
 func sendLog(url string, log LogEvent) {
+	if log.EventID == "" {
+		log.EventID = newEventID()
+	}
 	data, _ := json.Marshal(log)
-	resp, err := http.Post(url+"/ingest", "application/json", bytes.NewReader(data))
-	if err == nil && resp.StatusCode == 201 {
-		fmt.Printf("✅ %s %s %s\n", log.Timestamp[:19], log.Service, log.Level)
-	} else {
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		resp, err := http.Post(url+"/ingest", "application/json", bytes.NewReader(data))
 		status := "ERROR"
+		retryable := true
+		var wait time.Duration
 		if resp != nil {
+			resp.Body.Close()
 			status = resp.Status
+			// The server queues events asynchronously and answers 202 Accepted
+			if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusCreated {
+				fmt.Printf("✅ %s %s %s\n", log.Timestamp[:19], log.Service, log.Level)
+				return
+			}
+			retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(secs) * time.Second
+			}
+		}
+
+		if !retryable || attempt == maxSendAttempts {
+			fmt.Printf("❌ FAILED to send log after %d attempts: %v (Status: %s)\n", attempt, err, status)
+			return
+		}
+		if wait < backoff {
+			wait = backoff
 		}
-		fmt.Printf("❌ FAILED to send log: %v (Status: %s)\n", err, status)
+		fmt.Printf("🔁 Retrying log %s in %s (Status: %s)\n", log.EventID, wait, status)
+		time.Sleep(wait)
+		backoff *= 2
 	}
 }
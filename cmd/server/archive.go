@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress/zstd"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// Archiver defaults, overridable via ARCHIVE_* environment variables
+const (
+	defaultArchiveAfter    = 30 * 24 * time.Hour
+	defaultArchiveInterval = time.Hour
+
+	archiveManifestKey  = "manifest.json"
+	archiveRowGroupSize = 100000
+	archiveReadBatch    = 1000
+
+	// pg_try_advisory_xact_lock key, so one replica archives at a time
+	archiveLockKey = migrationLockKey + 2
+)
+
+// archiveRow is one event in a Parquet archive file. Times are Unix nanoseconds.
+type archiveRow struct {
+	ID         int64  `parquet:"id"`
+	EventID    string `parquet:"event_id,optional"`
+	Timestamp  int64  `parquet:"timestamp,timestamp(nanosecond)"`
+	Service    string `parquet:"service,dict"`
+	Level      string `parquet:"level,dict"`
+	Severity   int32  `parquet:"severity"`
+	Route      string `parquet:"route,optional,dict"`
+	Message    string `parquet:"message"`
+	Metadata   string `parquet:"metadata,optional"` // JSON object
+	TraceID    string `parquet:"trace_id,optional"`
+	SpanID     string `parquet:"span_id,optional"`
+	RequestID  string `parquet:"request_id,optional"`
+	ReceivedAt int64  `parquet:"received_at,optional,timestamp(nanosecond)"`
+	CreatedAt  int64  `parquet:"created_at,timestamp(nanosecond)"`
+}
+
+// archiveManifest lists every archived partition; it is the archive's index
+type archiveManifest struct {
+	Archives []archiveEntry `json:"archives"`
+}
+
+// archiveEntry is one archived partition. From is zero for the initial
+// partition, which had no lower bound.
+type archiveEntry struct {
+	Partition    string    `json:"partition"`
+	Key          string    `json:"key"`
+	From         time.Time `json:"from,omitzero"`
+	To           time.Time `json:"to"`
+	MinTimestamp time.Time `json:"min_timestamp,omitzero"`
+	MaxTimestamp time.Time `json:"max_timestamp,omitzero"`
+	Rows         int64     `json:"rows"`
+	Bytes        int64     `json:"bytes"`
+	SHA256       string    `json:"sha256"`
+	ArchivedAt   time.Time `json:"archived_at"`
+}
+
+// partitionArchiver is implemented by stores whose partitions can be moved to the archive
+type partitionArchiver interface {
+	partitionLister
+	// ExpiredPartitions lists attached partitions that end at or before before
+	ExpiredPartitions(ctx context.Context, before time.Time) ([]logPartition, error)
+	// DetachForArchive detaches an archived partition so no more rows can arrive; false means it was already gone
+	DetachForArchive(ctx context.Context, p logPartition) (bool, error)
+	// DetachedPartitions lists partitions detached from the store and not dropped yet
+	DetachedPartitions(ctx context.Context) ([]logPartition, error)
+	// ExportPartition streams a partition's events oldest first
+	ExportPartition(ctx context.Context, p logPartition, fn func(LogEvent) error) error
+	// CountPartition counts a partition's rows
+	CountPartition(ctx context.Context, p logPartition) (int64, error)
+	// DropDetached drops a detached partition
+	DropDetached(ctx context.Context, p logPartition) error
+	// LockArchive takes the archive lock for one pass; ok is false while another replica holds it
+	LockArchive(ctx context.Context) (unlock func(), ok bool, err error)
+}
+
+// partitionLister is implemented by stores that serve some time ranges from
+// partitions. An archived partition still attached is read from the store, not
+// the archive, so no event is read twice.
+type partitionLister interface {
+	AttachedPartitions(ctx context.Context) ([]logPartition, error)
+}
+
+// archiver moves partitions older than ARCHIVE_AFTER into compressed Parquet
+// files, records them in the manifest and drops them from the store. With a
+// store that has no partitions it only serves reads from an existing archive.
+type archiver struct {
+	blobs    archiveBlobs
+	store    partitionArchiver // nil when read-only
+	after    time.Duration
+	interval time.Duration
+
+	mu       sync.RWMutex
+	manifest archiveManifest
+}
+
+// newArchiver returns nil when no archive target is configured
+func newArchiver(store LogStore) (*archiver, error) {
+	blobs, err := openArchiveBlobs()
+	if err != nil || blobs == nil {
+		return nil, err
+	}
+
+	a := &archiver{
+		blobs:    blobs,
+		after:    envDuration("ARCHIVE_AFTER", defaultArchiveAfter),
+		interval: envDuration("ARCHIVE_INTERVAL", defaultArchiveInterval),
+	}
+	if pa, ok := store.(partitionArchiver); ok && a.after > 0 {
+		a.store = pa
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.loadManifest(ctx); err != nil {
+		return nil, fmt.Errorf("error reading archive manifest: %w", err)
+	}
+
+	if a.store != nil {
+		log.Printf("✅ Archiver started (%s, partitions older than %s)", blobs.Location(""), a.after)
+	} else {
+		log.Printf("✅ Archive opened read-only (%s, %d partitions)", blobs.Location(""), len(a.manifest.Archives))
+	}
+	return a, nil
+}
+
+// start archives once right away, then every interval. A read-only archive
+// still reloads its manifest, to pick up partitions archived elsewhere.
+func (a *archiver) start() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), max(a.interval, time.Hour))
+			if a.store != nil {
+				if err := a.archivePass(ctx); err != nil {
+					log.Printf("❌ Archive pass failed: %v", err)
+				}
+			} else if err := a.loadManifest(ctx); err != nil {
+				log.Printf("❌ Error reloading archive manifest: %v", err)
+			}
+			cancel()
+			time.Sleep(a.interval)
+		}
+	}()
+}
+
+// archivePass archives every expired partition: it exports the partition while
+// it is still attached and readable, checks the file holds every row, records it
+// in the manifest, and only then detaches it, recounts it against the archive and
+// drops it. Reads skip archived partitions that are still attached, so events
+// are never hidden or read twice along the way. Detached partitions left by a
+// failed pass or by PARTITION_DETACH_AFTER are finished first.
+func (a *archiver) archivePass(ctx context.Context) error {
+	unlock, ok, err := a.store.LockArchive(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	defer unlock()
+
+	// Another replica may have archived since we last looked
+	if err := a.loadManifest(ctx); err != nil {
+		return fmt.Errorf("error reading archive manifest: %w", err)
+	}
+	detached, err := a.store.DetachedPartitions(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing detached partitions: %w", err)
+	}
+	for _, p := range detached {
+		if err := a.finishPartition(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	partitions, err := a.store.ExpiredPartitions(ctx, time.Now().Add(-a.after))
+	if err != nil {
+		return fmt.Errorf("error listing partitions: %w", err)
+	}
+	for _, p := range partitions {
+		if _, ok := a.entry(p.Name); !ok {
+			if err := a.archive(ctx, p); err != nil {
+				return err
+			}
+		}
+		detached, err := a.store.DetachForArchive(ctx, p)
+		if err != nil {
+			return fmt.Errorf("error detaching partition %s: %w", p.Name, err)
+		}
+		if !detached {
+			continue
+		}
+		if err := a.finishPartition(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishPartition drops a detached partition once the manifest holds all of its
+// rows. Rows written or deleted between the export and the detach change the
+// count; the table cannot change any more, so it is archived again first.
+func (a *archiver) finishPartition(ctx context.Context, p logPartition) error {
+	rows, err := a.store.CountPartition(ctx, p)
+	if err != nil {
+		return fmt.Errorf("error counting partition %s: %w", p.Name, err)
+	}
+	if entry, ok := a.entry(p.Name); !ok || entry.Rows != rows {
+		if err := a.archive(ctx, p); err != nil {
+			return err
+		}
+	}
+	if err := a.store.DropDetached(ctx, p); err != nil {
+		return fmt.Errorf("error dropping archived partition %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// archive exports a partition and records it in the manifest, replacing an earlier archive of it
+func (a *archiver) archive(ctx context.Context, p logPartition) error {
+	entry, err := a.archivePartition(ctx, p)
+	if err != nil {
+		return fmt.Errorf("error archiving partition %s: %w", p.Name, err)
+	}
+	if err := a.addEntry(ctx, entry); err != nil {
+		return fmt.Errorf("error updating archive manifest: %w", err)
+	}
+	log.Printf("📦 Archived partition %s (%d events, %d bytes) to %s", p.Name, entry.Rows, entry.Bytes, a.blobs.Location(entry.Key))
+	return nil
+}
+
+// archivePartition writes a partition to a temporary Parquet file and uploads it
+func (a *archiver) archivePartition(ctx context.Context, p logPartition) (archiveEntry, error) {
+	entry := archiveEntry{Partition: p.Name, Key: "logs/" + p.Name + ".parquet", From: p.From, To: p.To}
+
+	tmp, err := os.CreateTemp("", "logflow-archive-*.parquet")
+	if err != nil {
+		return entry, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	w := parquet.NewGenericWriter[archiveRow](io.MultiWriter(tmp, hash),
+		parquet.Compression(&zstd.Codec{}),
+		parquet.MaxRowsPerRowGroup(archiveRowGroupSize),
+	)
+	batch := make([]archiveRow, 0, archiveReadBatch)
+	flush := func() error {
+		_, err := w.Write(batch)
+		batch = batch[:0]
+		return err
+	}
+
+	err = a.store.ExportPartition(ctx, p, func(evt LogEvent) error {
+		row, ts := toArchiveRow(evt)
+		if entry.Rows == 0 || ts.Before(entry.MinTimestamp) {
+			entry.MinTimestamp = ts
+		}
+		if ts.After(entry.MaxTimestamp) {
+			entry.MaxTimestamp = ts
+		}
+		entry.Rows++
+		if batch = append(batch, row); len(batch) == cap(batch) {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	if entry.Bytes, err = tmp.Seek(0, io.SeekCurrent); err != nil {
+		return entry, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return entry, err
+	}
+	if err := a.blobs.Put(ctx, entry.Key, tmp, entry.Bytes); err != nil {
+		return entry, err
+	}
+	if err := a.verifyArchive(ctx, entry); err != nil {
+		return entry, err
+	}
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	entry.ArchivedAt = time.Now().UTC()
+	return entry, nil
+}
+
+// verifyArchive checks that the uploaded file holds the rows that were
+// exported, before anything relies on the file
+func (a *archiver) verifyArchive(ctx context.Context, entry archiveEntry) error {
+	obj, err := a.blobs.Open(ctx, entry.Key)
+	if err != nil {
+		return fmt.Errorf("error reopening uploaded archive: %w", err)
+	}
+	defer obj.Close()
+	if obj.Size() != entry.Bytes {
+		return fmt.Errorf("uploaded archive is %d bytes, expected %d", obj.Size(), entry.Bytes)
+	}
+	file, err := parquet.OpenFile(obj, obj.Size())
+	if err != nil {
+		return fmt.Errorf("error reading uploaded archive: %w", err)
+	}
+	if file.NumRows() != entry.Rows {
+		return fmt.Errorf("uploaded archive holds %d rows, expected %d", file.NumRows(), entry.Rows)
+	}
+	return nil
+}
+
+func (a *archiver) loadManifest(ctx context.Context) error {
+	obj, err := a.blobs.Open(ctx, archiveManifestKey)
+	if errors.Is(err, errArchiveNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	var m archiveManifest
+	if err := json.NewDecoder(io.NewSectionReader(obj, 0, obj.Size())).Decode(&m); err != nil {
+		return err
+	}
+	sort.Slice(m.Archives, func(i, j int) bool { return m.Archives[i].To.Before(m.Archives[j].To) })
+
+	a.mu.Lock()
+	a.manifest = m
+	a.mu.Unlock()
+	return nil
+}
+
+// addEntry records an uploaded file in the manifest, in place of any earlier
+// archive of the same partition, and writes the manifest back
+func (a *archiver) addEntry(ctx context.Context, entry archiveEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := archiveManifest{Archives: []archiveEntry{entry}}
+	for _, e := range a.manifest.Archives {
+		if e.Partition != entry.Partition {
+			m.Archives = append(m.Archives, e)
+		}
+	}
+	sort.Slice(m.Archives, func(i, j int) bool { return m.Archives[i].To.Before(m.Archives[j].To) })
+	return a.writeManifest(ctx, m)
+}
+
+// removeEntries drops archived files from the manifest and writes it back
+func (a *archiver) removeEntries(ctx context.Context, remove []archiveEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var m archiveManifest
+	for _, e := range a.manifest.Archives {
+		if !slices.ContainsFunc(remove, func(r archiveEntry) bool { return r.Key == e.Key }) {
+			m.Archives = append(m.Archives, e)
+		}
+	}
+	return a.writeManifest(ctx, m)
+}
+
+// writeManifest uploads m and makes it current; callers hold mu
+func (a *archiver) writeManifest(ctx context.Context, m archiveManifest) error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := a.blobs.Put(ctx, archiveManifestKey, bytes.NewReader(body), int64(len(body))); err != nil {
+		return err
+	}
+	a.manifest = m
+	return nil
+}
+
+// expire removes the archived files whose events all ended before before, for
+// the retention catch-all rule: first from the manifest, so they are never read
+// again, then from storage. A dry run only lists them. A read-only archive is
+// left alone, as is one another replica is busy archiving into.
+func (a *archiver) expire(ctx context.Context, before time.Time, dryRun bool) ([]archiveEntry, error) {
+	if a.store == nil {
+		return nil, nil
+	}
+	if !dryRun {
+		unlock, ok, err := a.store.LockArchive(ctx)
+		if err != nil || !ok {
+			return nil, err
+		}
+		defer unlock()
+		if err := a.loadManifest(ctx); err != nil {
+			return nil, fmt.Errorf("error reading archive manifest: %w", err)
+		}
+	}
+
+	a.mu.RLock()
+	var expired []archiveEntry
+	for _, e := range a.manifest.Archives {
+		if !e.To.After(before) {
+			expired = append(expired, e)
+		}
+	}
+	a.mu.RUnlock()
+	if dryRun || len(expired) == 0 {
+		return expired, nil
+	}
+
+	if err := a.removeEntries(ctx, expired); err != nil {
+		return nil, fmt.Errorf("error updating archive manifest: %w", err)
+	}
+	for _, e := range expired {
+		// The manifest no longer lists it, so a failed delete only leaves an orphaned file
+		if err := a.blobs.Delete(ctx, e.Key); err != nil {
+			log.Printf("⚠️ Error deleting archived file %s: %v", a.blobs.Location(e.Key), err)
+		}
+	}
+	return expired, nil
+}
+
+// entry returns the manifest entry of a partition, if it is archived
+func (a *archiver) entry(partition string) (archiveEntry, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, e := range a.manifest.Archives {
+		if e.Partition == partition {
+			return e, true
+		}
+	}
+	return archiveEntry{}, false
+}
+
+// overlapping returns the archives that can hold events in [from, to] (a zero
+// to is open-ended), oldest first
+func (a *archiver) overlapping(from, to time.Time) []archiveEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var entries []archiveEntry
+	for _, e := range a.manifest.Archives {
+		if e.Rows == 0 || e.MaxTimestamp.Before(from) || (!to.IsZero() && e.MinTimestamp.After(to)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// each calls fn for the archived events matching f, from the requested end,
+// until fn returns false. Archives cover disjoint ranges and are read one batch
+// at a time, so a query never holds more than a row group and what fn keeps.
+// Partitions live still has attached are left to the store.
+func (a *archiver) each(ctx context.Context, f LogFilter, live partitionLister, fn func(*memoryRow) bool) error {
+	from, to := f.From, f.To
+	// Files wholly on the near side of a cursor hold nothing past it
+	if c := f.Cursor; c != nil {
+		if f.Ascending && c.TS.After(from) {
+			from = c.TS
+		} else if !f.Ascending && (to.IsZero() || c.TS.Before(to)) {
+			to = c.TS
+		}
+	}
+	entries := a.overlapping(from, to)
+	if len(entries) > 0 && live != nil {
+		attached, err := live.AttachedPartitions(ctx)
+		if err != nil {
+			return fmt.Errorf("error listing partitions: %w", err)
+		}
+		entries = slices.DeleteFunc(entries, func(e archiveEntry) bool {
+			return slices.ContainsFunc(attached, func(p logPartition) bool { return p.Name == e.Partition })
+		})
+	}
+	if !f.Ascending {
+		slices.Reverse(entries)
+	}
+
+	for _, e := range entries {
+		more := true
+		err := a.readArchive(ctx, e, from, to, !f.Ascending, func(rows []memoryRow) bool {
+			for i := range rows {
+				row := &rows[i]
+				if !f.Ascending {
+					row = &rows[len(rows)-1-i]
+				}
+				if f.matches(row) && !fn(row) {
+					more = false
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("archive %s: %w", e.Key, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// query reads up to f.Limit events matching f from the archive, in listing order
+func (a *archiver) query(ctx context.Context, f LogFilter, live partitionLister) ([]memoryRow, error) {
+	var rows []memoryRow
+	err := a.each(ctx, f, live, func(row *memoryRow) bool {
+		rows = append(rows, *row)
+		return f.Limit <= 0 || len(rows) < f.Limit
+	})
+	return rows, err
+}
+
+// readArchive passes the events of one archive file to fn in batches, oldest
+// first, skipping row groups whose timestamp statistics fall outside [from, to],
+// until fn returns false. With reverse the row groups come newest first, each
+// as one batch (still oldest first within it), so callers can walk it backwards.
+func (a *archiver) readArchive(ctx context.Context, e archiveEntry, from, to time.Time, reverse bool, fn func([]memoryRow) bool) error {
+	obj, err := a.blobs.Open(ctx, e.Key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	file, err := parquet.OpenFile(obj, obj.Size())
+	if err != nil {
+		return err
+	}
+	groups := file.RowGroups()
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	if reverse {
+		slices.Reverse(order)
+	}
+
+	buf := make([]archiveRow, archiveReadBatch)
+	batch := make([]memoryRow, 0, archiveReadBatch)
+	for _, i := range order {
+		if lo, hi, ok := rowGroupTimeBounds(file.Metadata().RowGroups[i]); ok && (hi.Before(from) || (!to.IsZero() && lo.After(to))) {
+			continue
+		}
+		reader := parquet.NewGenericRowGroupReader[archiveRow](groups[i])
+		var group []memoryRow
+		for {
+			n, err := reader.Read(buf)
+			batch = batch[:0]
+			for _, row := range buf[:n] {
+				batch = append(batch, fromArchiveRow(row))
+			}
+			if reverse {
+				group = append(group, batch...)
+			} else if !fn(batch) {
+				reader.Close()
+				return nil
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return err
+			}
+		}
+		reader.Close()
+		if reverse && !fn(group) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowGroupTimeBounds reads the min and max timestamp a writer recorded for a row group
+func rowGroupTimeBounds(rg format.RowGroup) (lo, hi time.Time, ok bool) {
+	for _, col := range rg.Columns {
+		if path := col.MetaData.PathInSchema; len(path) != 1 || path[0] != "timestamp" {
+			continue
+		}
+		stats := col.MetaData.Statistics
+		if len(stats.MinValue) != 8 || len(stats.MaxValue) != 8 {
+			return lo, hi, false
+		}
+		lo = time.Unix(0, int64(binary.LittleEndian.Uint64(stats.MinValue)))
+		hi = time.Unix(0, int64(binary.LittleEndian.Uint64(stats.MaxValue)))
+		return lo, hi, true
+	}
+	return lo, hi, false
+}
+
+func toArchiveRow(evt LogEvent) (archiveRow, time.Time) {
+	ts, _ := parseEventTime(evt.Timestamp)
+	row := archiveRow{
+		ID:        evt.ID,
+		EventID:   evt.EventID,
+		Timestamp: ts.UnixNano(),
+		Service:   evt.Service,
+		Level:     evt.Level,
+		Severity:  int32(evt.Severity),
+		Route:     evt.Route,
+		Message:   evt.Message,
+		TraceID:   evt.TraceID,
+		SpanID:    evt.SpanID,
+		RequestID: evt.RequestID,
+	}
+	if len(evt.Metadata) > 0 {
+		if body, err := json.Marshal(evt.Metadata); err == nil {
+			row.Metadata = string(body)
+		}
+	}
+	if t, err := parseEventTime(evt.ReceivedAt); err == nil {
+		row.ReceivedAt = t.UnixNano()
+	}
+	if t, err := time.Parse(time.RFC3339, evt.CreatedAt); err == nil {
+		row.CreatedAt = t.UnixNano()
+	}
+	return row, ts
+}
+
+func fromArchiveRow(row archiveRow) memoryRow {
+	ts := time.Unix(0, row.Timestamp).UTC()
+	evt := LogEvent{
+		ID:        row.ID,
+		EventID:   row.EventID,
+		Service:   row.Service,
+		Level:     row.Level,
+		Severity:  int(row.Severity),
+		Message:   row.Message,
+		Timestamp: formatEventTime(ts),
+		Route:     row.Route,
+		TraceID:   row.TraceID,
+		SpanID:    row.SpanID,
+		RequestID: row.RequestID,
+		CreatedAt: time.Unix(0, row.CreatedAt).UTC().Format(time.RFC3339),
+	}
+	if row.ReceivedAt != 0 {
+		evt.ReceivedAt = formatEventTime(time.Unix(0, row.ReceivedAt).UTC())
+	}
+	if row.Metadata != "" {
+		json.Unmarshal([]byte(row.Metadata), &evt.Metadata)
+	}
+	return memoryRow{evt: evt, ts: ts}
+}
+
+// archivedStore serves reads from the live store and, wherever the requested
+// range overlaps archived partitions, from the archive as well
+type archivedStore struct {
+	LogStore
+	archive *archiver
+}
+
+func (s *archivedStore) Range(ctx context.Context, from, to time.Time, limit int) ([]LogEvent, error) {
+	return s.Query(ctx, LogFilter{From: from, To: to, Limit: limit})
+}
+
+// live is the store's partition lister, if it has partitions
+func (s *archivedStore) live() partitionLister {
+	pl, _ := s.LogStore.(partitionLister)
+	return pl
+}
+
+// Query merges in archived events whenever the range reaches archived
+// partitions, an open lower bound included. A full newest-first page narrows
+// the archive read to what sorts ahead of its last row, so paging through
+// recent events never touches older files.
+func (s *archivedStore) Query(ctx context.Context, f LogFilter) ([]LogEvent, error) {
+	logs, err := s.LogStore.Query(ctx, f)
+	if err != nil {
+		return logs, err
+	}
+	// A full live page only needs the archived events that sort ahead of its last row
+	af := f
+	if f.Limit > 0 && len(logs) == f.Limit {
+		if ts, err := parseEventTime(logs[len(logs)-1].Timestamp); err == nil {
+			if f.Ascending && (af.To.IsZero() || ts.Before(af.To)) {
+				af.To = ts
+			} else if !f.Ascending && ts.After(af.From) {
+				af.From = ts
+			}
+		}
+	}
+	archived, err := s.archive.query(ctx, af, s.live())
+	if err != nil || len(archived) == 0 {
+		return logs, err
+	}
+
+	// Archived partitions still attached are skipped, so no event is in both
+	rows := make([]memoryRow, 0, len(logs)+len(archived))
+	for _, evt := range logs {
+		ts, _ := parseEventTime(evt.Timestamp)
+		rows = append(rows, memoryRow{evt: evt, ts: ts})
+	}
+	rows = append(rows, archived...)
+	sort.Slice(rows, func(i, j int) bool {
+		if f.Ascending {
+			return rows[i].before(rows[j])
+		}
+		return rows[j].before(rows[i])
+	})
+	if f.Limit > 0 && len(rows) > f.Limit {
+		rows = rows[:f.Limit]
+	}
+
+	merged := make([]LogEvent, len(rows))
+	for i, row := range rows {
+		merged[i] = row.evt
+	}
+	return merged, nil
+}
+
+// Count adds the archived events to the live counts wherever the range reaches
+// archived partitions. Archived partitions still attached are counted live
+// only, so no event counts twice.
+func (s *archivedStore) Count(ctx context.Context, f LogFilter, by []logField, step time.Duration) ([]logCount, error) {
+	counts, err := s.LogStore.Count(ctx, f, by, step)
+	if err != nil {
+		return counts, err
+	}
+	counter := newLogCounter(by, step)
+	for _, lc := range counts {
+		counter.addCount(lc)
+	}
+	// Order does not matter to a count; reading forward streams one batch at a time
+	f.Limit, f.Ascending = 0, true
+	archived := 0
+	err = s.archive.each(ctx, f, s.live(), func(row *memoryRow) bool {
+		counter.add(&row.evt, row.ts)
+		archived++
+		return true
+	})
+	if err != nil || archived == 0 {
+		return counts, err
+	}
+	return counter.result(), nil
+}
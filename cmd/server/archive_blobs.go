@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var errArchiveNotFound = errors.New("archive object not found")
+
+// archiveBlobs stores archive files and the manifest under slash-separated keys
+type archiveBlobs interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open returns errArchiveNotFound for a missing key
+	Open(ctx context.Context, key string) (archiveObject, error)
+	// Delete removes a key; a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Location describes where a key lives, for logs
+	Location(key string) string
+}
+
+// archiveObject is random access to one stored file, which Parquet readers need
+type archiveObject interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// openArchiveBlobs picks the archive target: an S3-compatible bucket when
+// ARCHIVE_S3_BUCKET is set, else ARCHIVE_DIR. It returns nil when neither is.
+func openArchiveBlobs() (archiveBlobs, error) {
+	if bucket := os.Getenv("ARCHIVE_S3_BUCKET"); bucket != "" {
+		return newS3Blobs(bucket)
+	}
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return dirBlobs{dir: dir}, nil
+	}
+	return nil, nil
+}
+
+// dirBlobs keeps the archive in a local directory
+type dirBlobs struct {
+	dir string
+}
+
+// Put writes through a temporary file and renames it into place, so readers
+// never see a partial file or manifest
+func (b dirBlobs) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dest := b.Location(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (b dirBlobs) Open(ctx context.Context, key string) (archiveObject, error) {
+	f, err := os.Open(b.Location(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errArchiveNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fileObject{File: f, size: info.Size()}, nil
+}
+
+func (b dirBlobs) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(b.Location(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b dirBlobs) Location(key string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(key))
+}
+
+type fileObject struct {
+	*os.File
+	size int64
+}
+
+func (f fileObject) Size() int64 { return f.size }
+
+// s3Blobs keeps the archive in an S3-compatible bucket (AWS S3, MinIO, R2, ...)
+type s3Blobs struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newS3Blobs connects with ARCHIVE_S3_* settings. ARCHIVE_S3_INSECURE=true talks
+// plain HTTP, for a local MinIO.
+func newS3Blobs(bucket string) (*s3Blobs, error) {
+	endpoint := os.Getenv("ARCHIVE_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("ARCHIVE_S3_ACCESS_KEY"), os.Getenv("ARCHIVE_S3_SECRET_KEY"), ""),
+		Secure: !envBool("ARCHIVE_S3_INSECURE", false),
+		Region: os.Getenv("ARCHIVE_S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 client: %w", err)
+	}
+
+	// A fresh MinIO has no buckets; create ours rather than fail every upload
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("error checking bucket %s: %w", bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv("ARCHIVE_S3_REGION")}); err != nil {
+			return nil, fmt.Errorf("error creating bucket %s: %w", bucket, err)
+		}
+		log.Printf("🗂️ Created archive bucket %s", bucket)
+	}
+	return &s3Blobs{client: client, bucket: bucket, prefix: strings.Trim(os.Getenv("ARCHIVE_S3_PREFIX"), "/")}, nil
+}
+
+func (b *s3Blobs) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := b.client.PutObject(ctx, b.bucket, b.objectName(key), r, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (b *s3Blobs) Open(ctx context.Context, key string) (archiveObject, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, b.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; Stat is the first request and surfaces a missing key
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, errArchiveNotFound
+		}
+		return nil, err
+	}
+	return s3Object{Object: obj, size: info.Size}, nil
+}
+
+// Delete succeeds for a missing key, as S3 DELETE does
+func (b *s3Blobs) Delete(ctx context.Context, key string) error {
+	return b.client.RemoveObject(ctx, b.bucket, b.objectName(key), minio.RemoveObjectOptions{})
+}
+
+func (b *s3Blobs) Location(key string) string {
+	return "s3://" + b.bucket + "/" + b.objectName(key)
+}
+
+func (b *s3Blobs) objectName(key string) string {
+	if b.prefix == "" {
+		return key
+	}
+	return path.Join(b.prefix, key)
+}
+
+type s3Object struct {
+	*minio.Object
+	size int64
+}
+
+func (o s3Object) Size() int64 { return o.size }
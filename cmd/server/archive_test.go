@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakePartition is one partition of fakePartitionStore
+type fakePartition struct {
+	p      logPartition
+	events []LogEvent
+}
+
+// fakePartitionStore keeps events in named partitions the way postgresStore's
+// logs table does: reads see attached partitions only, and detached ones wait
+// as plain tables until they are dropped
+type fakePartitionStore struct {
+	*memoryStore
+	parts map[string]*fakePartition
+	// Runs inside DetachForArchive before the partition is detached
+	beforeDetach func(name string)
+	detachErr    error
+}
+
+func newFakePartitionStore() *fakePartitionStore {
+	return &fakePartitionStore{memoryStore: newMemoryStore(), parts: map[string]*fakePartition{}}
+}
+
+// addDay creates the daily partition starting at day, holding one event per message
+func (s *fakePartitionStore) addDay(day time.Time, messages ...string) logPartition {
+	p := logPartition{Name: partitionName(day), From: day, To: day.AddDate(0, 0, 1)}
+	fp := &fakePartition{p: p}
+	for i, msg := range messages {
+		fp.add(day.Add(time.Duration(i+1)*time.Hour), msg)
+	}
+	s.parts[p.Name] = fp
+	return p
+}
+
+func (fp *fakePartition) add(ts time.Time, msg string) {
+	fp.events = append(fp.events, LogEvent{
+		ID: ts.UnixNano(), Timestamp: formatEventTime(ts), Service: "api", Level: "INFO",
+		Severity: sevInfo, Message: msg, CreatedAt: ts.Format(time.RFC3339),
+	})
+}
+
+// live loads the attached partitions into a memory store to read from
+func (s *fakePartitionStore) live(ctx context.Context) *memoryStore {
+	m := newMemoryStore()
+	for _, fp := range s.parts {
+		if !fp.p.Detached {
+			m.Insert(ctx, slices.Clone(fp.events))
+		}
+	}
+	return m
+}
+
+func (s *fakePartitionStore) Query(ctx context.Context, f LogFilter) ([]LogEvent, error) {
+	return s.live(ctx).Query(ctx, f)
+}
+
+func (s *fakePartitionStore) Count(ctx context.Context, f LogFilter, by []logField, step time.Duration) ([]logCount, error) {
+	return s.live(ctx).Count(ctx, f, by, step)
+}
+
+func (s *fakePartitionStore) list(detached bool) []logPartition {
+	var out []logPartition
+	for _, fp := range s.parts {
+		if fp.p.Detached == detached {
+			out = append(out, fp.p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].To.Before(out[j].To) })
+	return out
+}
+
+func (s *fakePartitionStore) AttachedPartitions(ctx context.Context) ([]logPartition, error) {
+	return s.list(false), nil
+}
+
+func (s *fakePartitionStore) DetachedPartitions(ctx context.Context) ([]logPartition, error) {
+	return s.list(true), nil
+}
+
+func (s *fakePartitionStore) ExpiredPartitions(ctx context.Context, before time.Time) ([]logPartition, error) {
+	var out []logPartition
+	for _, p := range s.list(false) {
+		if !p.To.After(before) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func (s *fakePartitionStore) DetachForArchive(ctx context.Context, p logPartition) (bool, error) {
+	if s.beforeDetach != nil {
+		s.beforeDetach(p.Name)
+	}
+	if s.detachErr != nil {
+		return false, s.detachErr
+	}
+	fp, ok := s.parts[p.Name]
+	if !ok || fp.p.Detached {
+		return false, nil
+	}
+	fp.p.Detached = true
+	return true, nil
+}
+
+func (s *fakePartitionStore) ExportPartition(ctx context.Context, p logPartition, fn func(LogEvent) error) error {
+	events := slices.Clone(s.parts[p.Name].events)
+	sort.Slice(events, func(i, j int) bool { return events[i].Timestamp < events[j].Timestamp })
+	for _, evt := range events {
+		if err := fn(evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakePartitionStore) CountPartition(ctx context.Context, p logPartition) (int64, error) {
+	return int64(len(s.parts[p.Name].events)), nil
+}
+
+func (s *fakePartitionStore) DropDetached(ctx context.Context, p logPartition) error {
+	if fp, ok := s.parts[p.Name]; ok && !fp.p.Detached {
+		return fmt.Errorf("partition %s is attached to logs", p.Name)
+	}
+	delete(s.parts, p.Name)
+	return nil
+}
+
+func (s *fakePartitionStore) DropPartition(ctx context.Context, p logPartition) (bool, error) {
+	if fp, ok := s.parts[p.Name]; !ok || fp.p.Detached {
+		return false, nil
+	}
+	delete(s.parts, p.Name)
+	return true, nil
+}
+
+func (s *fakePartitionStore) LockArchive(ctx context.Context) (func(), bool, error) {
+	return func() {}, true, nil
+}
+
+// flakyBlobs fails every Put while failing is set, like an unreachable bucket
+type flakyBlobs struct {
+	dirBlobs
+	failing bool
+}
+
+func (b *flakyBlobs) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if b.failing {
+		return errors.New("bucket unreachable")
+	}
+	return b.dirBlobs.Put(ctx, key, r, size)
+}
+
+func newTestArchive(t *testing.T, store partitionArchiver) (*archiver, *flakyBlobs) {
+	blobs := &flakyBlobs{dirBlobs: dirBlobs{dir: t.TempDir()}}
+	return &archiver{blobs: blobs, store: store, after: 48 * time.Hour, interval: time.Hour}, blobs
+}
+
+func messages(events []LogEvent) []string {
+	out := make([]string, len(events))
+	for i, evt := range events {
+		out[i] = evt.Message
+	}
+	return out
+}
+
+func countTotal(t *testing.T, store LogStore, f LogFilter) int64 {
+	t.Helper()
+	counts, err := store.Count(context.Background(), f, nil, 0)
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	var n int64
+	for _, c := range counts {
+		n += c.Count
+	}
+	return n
+}
+
+func TestArchivePassKeepsEventsReadable(t *testing.T) {
+	ctx := context.Background()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	old := today.AddDate(0, 0, -10)
+
+	store := newFakePartitionStore()
+	expired := store.addDay(old, "old 1", "old 2")
+	store.addDay(today, "new")
+	archive, blobs := newTestArchive(t, store)
+	reads := &archivedStore{LogStore: store, archive: archive}
+
+	// No lower bound: the archive must still be consulted
+	oldRange := LogFilter{To: old.Add(20 * time.Hour), Ascending: true}
+
+	blobs.failing = true
+	if err := archive.archivePass(ctx); err == nil {
+		t.Fatal("archive pass succeeded with the bucket down")
+	}
+	if store.parts[expired.Name].p.Detached {
+		t.Fatal("partition detached before its archive was recorded")
+	}
+	got, err := reads.Query(ctx, oldRange)
+	if err != nil || !slices.Equal(messages(got), []string{"old 1", "old 2"}) {
+		t.Fatalf("while the bucket is down: %v, %v", messages(got), err)
+	}
+
+	blobs.failing = false
+	if err := archive.archivePass(ctx); err != nil {
+		t.Fatalf("archivePass: %v", err)
+	}
+	if _, ok := store.parts[expired.Name]; ok {
+		t.Fatal("archived partition not dropped")
+	}
+	entry, ok := archive.entry(expired.Name)
+	if !ok || entry.Rows != 2 {
+		t.Fatalf("manifest entry = %+v, %t", entry, ok)
+	}
+
+	got, err = reads.Query(ctx, oldRange)
+	if err != nil || !slices.Equal(messages(got), []string{"old 1", "old 2"}) {
+		t.Errorf("archived, without from: %v, %v", messages(got), err)
+	}
+	got, err = reads.Query(ctx, LogFilter{})
+	if err != nil || !slices.Equal(messages(got), []string{"new", "old 2", "old 1"}) {
+		t.Errorf("open-ended, newest first: %v, %v", messages(got), err)
+	}
+	got, err = reads.Query(ctx, LogFilter{Limit: 1})
+	if err != nil || !slices.Equal(messages(got), []string{"new"}) {
+		t.Errorf("first page: %v, %v", messages(got), err)
+	}
+	if n := countTotal(t, reads, LogFilter{To: old.Add(20 * time.Hour)}); n != 2 {
+		t.Errorf("count without from = %d, want 2", n)
+	}
+	if n := countTotal(t, reads, LogFilter{}); n != 3 {
+		t.Errorf("open-ended count = %d, want 3", n)
+	}
+}
+
+func TestArchivedReadsSkipAttachedPartitions(t *testing.T) {
+	ctx := context.Background()
+	old := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -10)
+
+	store := newFakePartitionStore()
+	expired := store.addDay(old, "old 1", "old 2")
+	store.detachErr = errors.New("lock timeout")
+	archive, _ := newTestArchive(t, store)
+	reads := &archivedStore{LogStore: store, archive: archive}
+
+	// Recorded in the manifest, but the detach failed: the rows are live and archived
+	if err := archive.archivePass(ctx); err == nil {
+		t.Fatal("archive pass succeeded without detaching")
+	}
+	if _, ok := archive.entry(expired.Name); !ok {
+		t.Fatal("archive not recorded")
+	}
+	got, err := reads.Query(ctx, LogFilter{})
+	if err != nil || !slices.Equal(messages(got), []string{"old 2", "old 1"}) {
+		t.Errorf("query = %v, %v", messages(got), err)
+	}
+	if n := countTotal(t, reads, LogFilter{}); n != 2 {
+		t.Errorf("count = %d, want 2", n)
+	}
+
+	// The next pass finishes without exporting again
+	store.detachErr = nil
+	if err := archive.archivePass(ctx); err != nil {
+		t.Fatalf("archivePass: %v", err)
+	}
+	if _, ok := store.parts[expired.Name]; ok {
+		t.Error("partition not dropped")
+	}
+	if got, _ := reads.Query(ctx, LogFilter{}); len(got) != 2 {
+		t.Errorf("after the drop: %v", messages(got))
+	}
+}
+
+func TestArchivePassRearchivesLateRows(t *testing.T) {
+	ctx := context.Background()
+	old := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -10)
+
+	store := newFakePartitionStore()
+	expired := store.addDay(old, "old 1")
+	// A late event lands after the export but before the detach
+	store.beforeDetach = func(name string) {
+		store.parts[name].add(old.Add(23*time.Hour), "late")
+	}
+	archive, _ := newTestArchive(t, store)
+	reads := &archivedStore{LogStore: store, archive: archive}
+
+	if err := archive.archivePass(ctx); err != nil {
+		t.Fatalf("archivePass: %v", err)
+	}
+	if entry, _ := archive.entry(expired.Name); entry.Rows != 2 {
+		t.Errorf("manifest holds %d rows, want 2", entry.Rows)
+	}
+	got, err := reads.Query(ctx, LogFilter{Ascending: true})
+	if err != nil || !slices.Equal(messages(got), []string{"old 1", "late"}) {
+		t.Errorf("query = %v, %v", messages(got), err)
+	}
+}
+
+func TestArchivePassFinishesDetachedPartitions(t *testing.T) {
+	ctx := context.Background()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	store := newFakePartitionStore()
+	// Detached by PARTITION_DETACH_AFTER: unreadable until archived
+	p := store.addDay(today.AddDate(0, 0, -1), "detached")
+	store.parts[p.Name].p.Detached = true
+	archive, _ := newTestArchive(t, store)
+	reads := &archivedStore{LogStore: store, archive: archive}
+
+	if err := archive.archivePass(ctx); err != nil {
+		t.Fatalf("archivePass: %v", err)
+	}
+	if _, ok := store.parts[p.Name]; ok {
+		t.Error("detached partition not dropped")
+	}
+	got, err := reads.Query(ctx, LogFilter{})
+	if err != nil || !slices.Equal(messages(got), []string{"detached"}) {
+		t.Errorf("query = %v, %v", messages(got), err)
+	}
+}
+
+func TestRetentionDropsDetachedPartitions(t *testing.T) {
+	ctx := context.Background()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	store := newFakePartitionStore()
+	expired := store.addDay(today.AddDate(0, 0, -40), "expired")
+	kept := store.addDay(today.AddDate(0, 0, -5), "kept")
+	for _, p := range []logPartition{expired, kept} {
+		store.parts[p.Name].p.Detached = true
+	}
+	attached := store.addDay(today.AddDate(0, 0, -35), "attached")
+	rules, err := parseRetentionRules("*:30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &retentionEnforcer{store: store, rules: rules, batchSize: 100}
+
+	report, err := e.run(ctx, rules, true)
+	if err != nil || len(report.Partitions) != 2 || len(store.parts) != 3 {
+		t.Fatalf("dry run: %+v, %v, %d partitions left", report.Partitions, err, len(store.parts))
+	}
+
+	report, err = e.run(ctx, rules, false)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var names []string
+	for _, pr := range report.Partitions {
+		names = append(names, pr.Name)
+	}
+	slices.Sort(names)
+	if want := []string{expired.Name, attached.Name}; !slices.Equal(names, []string{min(want[0], want[1]), max(want[0], want[1])}) {
+		t.Errorf("dropped %v, want %v", names, want)
+	}
+	if _, ok := store.parts[kept.Name]; !ok || len(store.parts) != 1 {
+		t.Errorf("left %d partitions, want only %s", len(store.parts), kept.Name)
+	}
+}
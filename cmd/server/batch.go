@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Maximum number of events accepted in one batch request
+const maxBatchEvents = 10000
+
+// batchResult reports the outcome of one event inside a batch, so clients can retry only failures
+type batchResult struct {
+	Index   int    `json:"index"`
+	Status  string `json:"status"`
+	EventID string `json:"event_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validateEvent fills defaults, canonicalizes the level and checks that an event can be stored
+func validateEvent(evt *LogEvent) error {
+	// The receive time is always the server's; the event time defaults to it
+	received := time.Now().UTC()
+	evt.ReceivedAt = formatEventTime(received)
+	evt.Highlights = nil
+	ts := received
+	if evt.Timestamp != "" {
+		var err error
+		if ts, err = parseEventTime(evt.Timestamp); err != nil {
+			return err
+		}
+	}
+	ts, err := applyClockSkew(evt, ts, received)
+	if err != nil {
+		return err
+	}
+	evt.Timestamp = formatEventTime(ts)
+
+	liftTraceContext(evt)
+
+	evt.Service = strings.TrimSpace(evt.Service)
+	switch {
+	case evt.Service == "":
+		return errors.New("service is required")
+	case len(evt.Service) > maxServiceLen:
+		return fmt.Errorf("service exceeds %d characters", maxServiceLen)
+	case len(evt.Route) > maxRouteLen:
+		return fmt.Errorf("route exceeds %d characters", maxRouteLen)
+	case len(evt.EventID) > maxEventIDLen:
+		return fmt.Errorf("event_id exceeds %d characters", maxEventIDLen)
+	case len(evt.TraceID) > maxTraceIDLen:
+		return fmt.Errorf("trace_id exceeds %d characters", maxTraceIDLen)
+	case len(evt.SpanID) > maxSpanIDLen:
+		return fmt.Errorf("span_id exceeds %d characters", maxSpanIDLen)
+	case len(evt.RequestID) > maxRequestIDLen:
+		return fmt.Errorf("request_id exceeds %d characters", maxRequestIDLen)
+	case len(evt.Message) > maxMessageBytes:
+		return fmt.Errorf("message exceeds %d bytes", maxMessageBytes)
+	}
+	for _, field := range []struct{ name, value string }{
+		{"message", evt.Message}, {"service", evt.Service}, {"route", evt.Route},
+		{"level", evt.Level}, {"event_id", evt.EventID}, {"trace_id", evt.TraceID},
+		{"span_id", evt.SpanID}, {"request_id", evt.RequestID},
+	} {
+		if err := checkText(field.name, field.value); err != nil {
+			return err
+		}
+	}
+
+	// The level wins over a numeric severity; neither means INFO
+	switch {
+	case evt.Level != "":
+		sev, err := parseLevel(evt.Level)
+		if err != nil {
+			return err
+		}
+		evt.Severity = sev
+	case evt.Severity > 0:
+		evt.Severity = canonicalSeverity(evt.Severity)
+	default:
+		evt.Severity = sevInfo
+	}
+	evt.Level = severityNames[evt.Severity]
+
+	if len(evt.Metadata) > 0 {
+		if err := checkMetadataText(evt.Metadata); err != nil {
+			return err
+		}
+		b, err := json.Marshal(evt.Metadata)
+		if err != nil {
+			return errors.New("metadata is not valid JSON")
+		}
+		if len(b) > maxMetadataBytes {
+			return fmt.Errorf("metadata exceeds %d bytes", maxMetadataBytes)
+		}
+	}
+	return nil
+}
+
+// checkText rejects text Postgres cannot store: NUL bytes are refused by both
+// text and jsonb columns, and invalid UTF-8 by the database encoding
+func checkText(name, value string) error {
+	switch {
+	case strings.IndexByte(value, 0) >= 0:
+		return fmt.Errorf("%s contains a NUL byte", name)
+	case !utf8.ValidString(value):
+		return fmt.Errorf("%s is not valid UTF-8", name)
+	}
+	return nil
+}
+
+// checkMetadataText applies checkText to every key and string value in metadata
+func checkMetadataText(value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if err := checkText("metadata key", key); err != nil {
+				return err
+			}
+			if err := checkMetadataText(inner); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, inner := range v {
+			if err := checkMetadataText(inner); err != nil {
+				return err
+			}
+		}
+	case string:
+		return checkText("metadata value", v)
+	}
+	return nil
+}
+
+// metadataValue converts metadata to a JSONB parameter, or NULL when missing or invalid
+func metadataValue(metadata map[string]interface{}) interface{} {
+	if len(metadata) == 0 {
+		return nil
+	}
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		log.Printf("⚠️ Invalid metadata, using NULL")
+		return nil
+	}
+	return string(metadataBytes)
+}
+
+// isBatchRequest reports whether an /ingest body carries more than one event,
+// either by content type (NDJSON) or by being a JSON array
+func isBatchRequest(r *http.Request, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		switch mediaType {
+		case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/json-seq":
+			return true
+		}
+	}
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// decodeBatch splits a JSON array or newline-delimited JSON body into raw events
+func decodeBatch(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		// The record separator prefix of application/json-seq is harmless to strip
+		line = bytes.TrimPrefix(line, []byte{0x1e})
+		items = append(items, json.RawMessage(line))
+	}
+	return items, nil
+}
+
+// POST /ingest/batch - Queue many logs from a JSON array or NDJSON body
+func (s *server) batchIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+	s.ingestBatch(w, r, body)
+}
+
+// ingestBatch validates and queues a batch. An Idempotency-Key header names the
+// whole request; events without their own event_id get "<key>:<index>".
+func (s *server) ingestBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	items, err := decodeBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchEvents {
+		http.Error(w, fmt.Sprintf("Batch too large: %d events (max %d)", len(items), maxBatchEvents), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	var accepted []LogEvent
+	var acceptedIdx []int
+
+	// Validate each event individually so one bad line doesn't sink the batch
+	for i, raw := range items {
+		results[i] = batchResult{Index: i, Status: "rejected"}
+
+		var evt LogEvent
+		if err := json.Unmarshal(raw, &evt); err != nil {
+			results[i].Error = "Invalid JSON"
+			continue
+		}
+		// Header-derived fields go in first so validation covers them too
+		if key := r.Header.Get("Idempotency-Key"); evt.EventID == "" && key != "" {
+			evt.EventID = fmt.Sprintf("%s:%d", key, i)
+		}
+		applyTraceHeaders(r, &evt)
+		if err := validateEvent(&evt); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		accepted = append(accepted, evt)
+		acceptedIdx = append(acceptedIdx, i)
+	}
+
+	// Continuation lines are accepted as part of the event their first line started
+	merged, origin := s.multiline.assembleIndexed(accepted)
+	if err := s.pipeline.Enqueue(merged, nil); err != nil {
+		s.pipeline.writeQueueFull(w, err)
+		return
+	}
+
+	for j, i := range acceptedIdx {
+		results[i].Status = "accepted"
+		results[i].EventID = merged[origin[j]].EventID
+	}
+
+	rejected := len(items) - len(accepted)
+	log.Printf("✅ QUEUED BATCH: accepted=%d, rejected=%d", len(accepted), rejected)
+
+	status := "success"
+	code := http.StatusAccepted
+	switch {
+	case len(accepted) == 0:
+		status = "failed"
+		code = http.StatusBadRequest
+	case rejected > 0:
+		status = "partial"
+		code = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   status,
+		"accepted": len(accepted),
+		"rejected": rejected,
+		"results":  results,
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Default cap on an ingest body after decompression (32 MiB)
+const defaultMaxDecompressedBytes = 32 << 20
+
+// zstdBody closes the decoder together with the underlying request body
+type zstdBody struct {
+	dec  *zstd.Decoder
+	body io.Closer
+}
+
+func (z *zstdBody) Read(p []byte) (int, error) { return z.dec.Read(p) }
+
+func (z *zstdBody) Close() error {
+	z.dec.Close()
+	return z.body.Close()
+}
+
+// gzipBody closes the gzip reader together with the underlying request body
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// decompressMiddleware honors Content-Encoding: gzip / zstd on ingest paths and caps
+// the decompressed size so a small compressed payload can't expand without bound
+func (s *server) decompressMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+		switch encoding {
+		case "", "identity":
+			// Nothing to decode
+
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid gzip body")
+				return
+			}
+			r.Body = &gzipBody{Reader: gz, body: r.Body}
+
+		case "zstd":
+			// The window cap stops a frame from allocating more memory than the body limit allows
+			window := uint64(s.maxDecompressedBytes)
+			if window < zstd.MinWindowSize {
+				window = zstd.MinWindowSize
+			}
+			dec, err := zstd.NewReader(r.Body,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxMemory(window),
+				zstd.WithDecoderMaxWindow(window),
+			)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid zstd body")
+				return
+			}
+			r.Body = &zstdBody{dec: dec, body: r.Body}
+
+		default:
+			writeJSONError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Encoding: %s", encoding))
+			return
+		}
+
+		if encoding != "" && encoding != "identity" {
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxDecompressedBytes)
+
+		next(w, r)
+	}
+}
+
+// readIngestBody reads a (possibly decompressed) request body, answering 413 when it
+// exceeds the configured limit and 400 when it cannot be decoded
+func (s *server) readIngestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		// zstd can refuse a frame up front when its declared size is over the limit
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) || errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":     fmt.Sprintf("Payload too large: decompressed body exceeds %d bytes", s.maxDecompressedBytes),
+				"max_bytes": s.maxDecompressedBytes,
+			})
+			return nil, false
+		}
+		writeJSONError(w, http.StatusBadRequest, "Error reading body: "+err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+// writeJSONError sends {"error": msg} with the given status code
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envInt64 reads an integer setting from the environment, falling back to def
+func envInt64(name string, def int64) int64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		log.Printf("⚠️ Invalid %s=%q, using default %d", name, raw, def)
+		return def
+	}
+	return v
+}
+
+// envPositiveInt reads a count that has no meaning below 1, such as a queue
+// size or worker count, and refuses to start on anything smaller
+func envPositiveInt(name string, def int) int {
+	v := envInt64(name, int64(def))
+	if v < 1 {
+		log.Fatalf("%s must be at least 1, got %d", name, v)
+	}
+	return int(v)
+}
+
+// envDuration reads a duration setting (e.g. "5s", "10m") from the environment, falling back to def.
+// Durations must be positive, except 0 for settings whose default is 0 (off).
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil || v < 0 || (v == 0 && def != 0) {
+		log.Printf("⚠️ Invalid %s=%q, using default %s", name, raw, def)
+		return def
+	}
+	return v
+}
+
+// envBool reads a boolean setting (true/false/1/0) from the environment, falling back to def
+func envBool(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("⚠️ Invalid %s=%q, using default %t", name, raw, def)
+		return def
+	}
+	return v
+}
+
+// parseLongDuration accepts Go durations plus whole days (d), weeks (w) and 365-day years (y),
+// for settings measured in days rather than seconds. The result is always positive.
+func parseLongDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if n := len(s); n > 1 && strings.ContainsRune("dwy", rune(s[n-1])) {
+		count, err := strconv.Atoi(s[:n-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		day := 24 * time.Hour
+		d = time.Duration(count) * map[byte]time.Duration{'d': day, 'w': 7 * day, 'y': 365 * day}[s[n-1]]
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page size limits for /logs
+const (
+	defaultLogsPageSize    = 100
+	defaultMaxLogsPageSize = 1000
+)
+
+// maxLogsPageSize caps limit on /logs; LOGS_MAX_PAGE_SIZE overrides it at startup
+var maxLogsPageSize = defaultMaxLogsPageSize
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// logCursor is a position in the (timestamp, id) order of events. Timestamps
+// tie often, so the id keeps pages from skipping or repeating events.
+type logCursor struct {
+	TS time.Time // full nanosecond timestamp
+	ID int64
+}
+
+func cursorAt(evt LogEvent) (logCursor, error) {
+	ts, err := parseEventTime(evt.Timestamp)
+	if err != nil {
+		return logCursor{}, err
+	}
+	return logCursor{TS: ts, ID: evt.ID}, nil
+}
+
+// before reports whether the row sorts before the cursor position, oldest first
+func (c logCursor) before(row *memoryRow) bool {
+	if !row.ts.Equal(c.TS) {
+		return row.ts.Before(c.TS)
+	}
+	return row.evt.ID < c.ID
+}
+
+// beyond reports whether the row comes after the cursor in the listing order:
+// older for newest-first listings, newer for oldest-first ones
+func (c logCursor) beyond(row *memoryRow, ascending bool) bool {
+	if ascending {
+		return !c.before(row) && !(row.ts.Equal(c.TS) && row.evt.ID == c.ID)
+	}
+	return c.before(row)
+}
+
+// sql renders the beyond condition as a row comparison over the columns of
+// logs_keyset_idx, so Postgres seeks straight to the cursor
+func (c logCursor) sql(ascending bool, args []interface{}, argCount int) (string, []interface{}, int) {
+	op := "<"
+	if ascending {
+		op = ">"
+	}
+	cond := fmt.Sprintf("(timestamp, timestamp_nanos, id) %s ($%d, $%d, $%d)", op, argCount, argCount+1, argCount+2)
+	args = append(args, c.TS.Truncate(time.Microsecond), c.TS.Nanosecond()%1000, c.ID)
+	return cond, args, argCount + 3
+}
+
+// pageCursor is what a /logs cursor token carries: where the previous page
+// ended and which way to read from there
+type pageCursor struct {
+	logCursor
+	// Back reads toward the start of the listing (prev_cursor) instead of onward
+	Back bool
+}
+
+// Tokens are opaque to clients; the version prefix leaves room to change them
+const cursorVersion = "1"
+
+func (c pageCursor) String() string {
+	dir := "n"
+	if c.Back {
+		dir = "p"
+	}
+	raw := strings.Join([]string{cursorVersion, dir, strconv.FormatInt(c.TS.UnixNano(), 10), strconv.FormatInt(c.ID, 10)}, ":")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parsePageCursor(token string) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 4 || parts[0] != cursorVersion || (parts[1] != "n" && parts[1] != "p") {
+		return pageCursor{}, errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	return pageCursor{
+		logCursor: logCursor{TS: time.Unix(0, nanos).UTC(), ID: id},
+		Back:      parts[1] == "p",
+	}, nil
+}
+
+// logsPage fetches one page of a /logs listing. Without a cursor it is the first
+// page; a Back cursor reads the other way and restores the listing order. The
+// cursors returned are nil where no page lies in that direction.
+func (s *server) logsPage(r *http.Request, f LogFilter, cur *pageCursor) (logs []LogEvent, next, prev *string, err error) {
+	limit := f.Limit
+	f.Limit = limit + 1 // one extra row tells whether another page follows
+	if cur != nil {
+		f.Cursor = &cur.logCursor
+		if cur.Back {
+			f.Ascending = !f.Ascending
+		}
+	}
+
+	logs, err = s.store.Query(r.Context(), f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	more := len(logs) > limit
+	if more {
+		logs = logs[:limit]
+	}
+	if cur != nil && cur.Back {
+		slices.Reverse(logs)
+	}
+	if len(logs) == 0 {
+		return logs, nil, nil, nil
+	}
+
+	first, err := cursorAt(logs[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	last, err := cursorAt(logs[len(logs)-1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Coming from a page means there is one that way; the extra row tells about the other
+	hasNext, hasPrev := more, cur != nil
+	if cur != nil && cur.Back {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext {
+		token := pageCursor{logCursor: last}.String()
+		next = &token
+	}
+	if hasPrev {
+		token := pageCursor{logCursor: first, Back: true}.String()
+		prev = &token
+	}
+	return logs, next, prev, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	ts := time.Date(2024, time.March, 10, 12, 0, 0, 123456789, time.UTC)
+	for _, cur := range []pageCursor{
+		{logCursor: logCursor{TS: ts, ID: 42}},
+		{logCursor: logCursor{TS: ts, ID: 7}, Back: true},
+		{logCursor: logCursor{TS: time.Unix(0, 0).UTC(), ID: 0}},
+	} {
+		got, err := parsePageCursor(cur.String())
+		if err != nil || !got.TS.Equal(cur.TS) || got.ID != cur.ID || got.Back != cur.Back {
+			t.Errorf("%+v came back as %+v, %v", cur, got, err)
+		}
+	}
+
+	token := pageCursor{logCursor: logCursor{TS: ts, ID: 42}, Back: true}.String()
+	if raw, _ := base64.RawURLEncoding.DecodeString(token); string(raw) != fmt.Sprintf("1:p:%d:42", ts.UnixNano()) {
+		t.Errorf("token carries %q", raw)
+	}
+}
+
+func TestParsePageCursorInvalid(t *testing.T) {
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	for _, token := range []string{
+		"",
+		"not base64!",
+		encode("1:n:1700000000"),
+		encode("2:n:1700000000:1"),
+		encode("1:x:1700000000:1"),
+		encode("1:n:soon:1"),
+		encode("1:n:1700000000:one"),
+		encode("1:n:1700000000:1:extra"),
+	} {
+		if _, err := parsePageCursor(token); err != errInvalidCursor {
+			t.Errorf("%q: got %v, want errInvalidCursor", token, err)
+		}
+	}
+}
+
+func TestLogCursorSQL(t *testing.T) {
+	cur := logCursor{TS: time.Date(2024, time.March, 10, 12, 0, 0, 123456789, time.UTC), ID: 9}
+	cond, args, next := cur.sql(false, []interface{}{"api"}, 2)
+	if cond != "(timestamp, timestamp_nanos, id) < ($2, $3, $4)" || next != 5 {
+		t.Errorf("cond %q, next arg %d", cond, next)
+	}
+	// Postgres keeps microseconds; the remaining nanoseconds go in their own column
+	if len(args) != 4 || !args[1].(time.Time).Equal(cur.TS.Truncate(time.Microsecond)) || args[2] != 789 || args[3] != int64(9) {
+		t.Errorf("args = %v", args)
+	}
+	if cond, _, _ := cur.sql(true, nil, 1); cond != "(timestamp, timestamp_nanos, id) > ($1, $2, $3)" {
+		t.Errorf("ascending cond %q", cond)
+	}
+}
+
+func TestLogsPageWalk(t *testing.T) {
+	store := newMemoryStore()
+	base := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	var events []LogEvent
+	for i := range 5 {
+		// Pairs share a timestamp, so pages have to split ties by id
+		events = append(events, LogEvent{Service: "api", Message: fmt.Sprint(i), Timestamp: formatEventTime(base.Add(time.Duration(i/2) * time.Nanosecond))})
+	}
+	store.Insert(context.Background(), events)
+	s := &server{store: store}
+	r := httptest.NewRequest(http.MethodGet, "/logs", nil)
+
+	page := func(cur *string) (msgs []string, next, prev *string) {
+		t.Helper()
+		var pc *pageCursor
+		if cur != nil {
+			parsed, err := parsePageCursor(*cur)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc = &parsed
+		}
+		logs, next, prev, err := s.logsPage(r, LogFilter{Limit: 2}, pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, evt := range logs {
+			msgs = append(msgs, evt.Message)
+		}
+		return msgs, next, prev
+	}
+
+	// Newest first, onward to the end
+	first, next, prev := page(nil)
+	if !slices.Equal(first, []string{"4", "3"}) || next == nil || prev != nil {
+		t.Fatalf("first page %v, next %v, prev %v", first, next, prev)
+	}
+	second, next, prev := page(next)
+	if !slices.Equal(second, []string{"2", "1"}) || next == nil || prev == nil {
+		t.Fatalf("second page %v", second)
+	}
+	last, end, _ := page(next)
+	if !slices.Equal(last, []string{"0"}) || end != nil {
+		t.Fatalf("last page %v, next %v", last, end)
+	}
+
+	// and back again from the second page
+	back, next, prev := page(prev)
+	if !slices.Equal(back, first) || next == nil || prev != nil {
+		t.Errorf("back to %v, next %v, prev %v", back, next, prev)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Dead-letter defaults, overridable via DEAD_LETTER_PATH and WAL_MAX_REPLAYS
+const (
+	defaultDeadLetterPath = "data/dead-letter.ndjson"
+	// Replays of a failed WAL batch, with the database reachable, before it is dead-lettered
+	defaultWALMaxReplays = 10
+)
+
+// deadLetterError marks an event the database refused on its own (e.g. a value a
+// column cannot hold). Retrying cannot help, so it is set aside rather than retried.
+type deadLetterError struct {
+	err error
+}
+
+func (e *deadLetterError) Error() string { return "dead-lettered: " + e.err.Error() }
+func (e *deadLetterError) Unwrap() error { return e.err }
+
+// deadLetterLog appends events that could not be written to an NDJSON file, one
+// {"at","reason","event"} object per line, so an operator can inspect and re-send them
+type deadLetterLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openDeadLetterLog(path string) (*deadLetterLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating dead-letter directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening dead-letter file: %w", err)
+	}
+	return &deadLetterLog{file: f}, nil
+}
+
+// Write records events with the reason they were given up on
+func (d *deadLetterLog) Write(events []LogEvent, reason string) error {
+	var buf []byte
+	at := formatEventTime(time.Now().UTC())
+	for _, evt := range events {
+		line, err := json.Marshal(map[string]interface{}{"at": at, "reason": reason, "event": evt})
+		if err != nil {
+			return fmt.Errorf("error encoding dead-letter record: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.file.Write(buf); err != nil {
+		return fmt.Errorf("error writing dead-letter file: %w", err)
+	}
+	return d.file.Sync()
+}
+
+func (d *deadLetterLog) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dedup defaults, overridable via DEDUP_* environment variables
+const (
+	defaultDedupHorizon = 15 * time.Minute
+	defaultDedupMaxKeys = 1000000
+)
+
+// Dedup modes
+const (
+	dedupOff  = "off"  // every delivery is stored
+	dedupID   = "id"   // deliveries repeating a client event_id are dropped
+	dedupHash = "hash" // events without an event_id get one derived from their content
+)
+
+// dedupCache remembers event ids seen within the horizon. Duplicate deliveries are
+// acknowledged with the original id instead of being written again.
+type dedupCache struct {
+	mu      sync.Mutex
+	mode    string
+	horizon time.Duration
+	maxKeys int
+	keys    map[string]*list.Element
+	order   *list.List // oldest first, for expiry and the key cap
+}
+
+type dedupEntry struct {
+	id   string
+	seen time.Time
+}
+
+func newDedupCache(mode string, horizon time.Duration, maxKeys int) *dedupCache {
+	switch mode {
+	case "":
+		mode = dedupID
+	case dedupOff, dedupID, dedupHash:
+	default:
+		log.Printf("⚠️ Invalid DEDUP_MODE=%q, using %q", mode, dedupID)
+		mode = dedupID
+	}
+	return &dedupCache{
+		mode:    mode,
+		horizon: horizon,
+		maxKeys: maxKeys,
+		keys:    map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// newEventID returns a random 128-bit id for events the producer did not name
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contentEventID hashes the fields that make an event what it is. Metadata maps
+// marshal with sorted keys, so equal events always hash alike. Only the time the
+// client sent counts: clock-skew notes depend on when a copy arrived, so they are
+// left out and a clamped event hashes by its original time, and an event sent
+// without a timestamp (validateEvent defaulted it to the receive time) hashes none.
+func contentEventID(evt LogEvent) string {
+	if evt.Timestamp == evt.ReceivedAt {
+		evt.Timestamp = ""
+	}
+	metadata := evt.Metadata
+	if _, skewed := metadata["clock_skew"]; skewed {
+		metadata = make(map[string]interface{}, len(evt.Metadata))
+		for k, v := range evt.Metadata {
+			metadata[k] = v
+		}
+		if original, ok := metadata["original_timestamp"].(string); ok {
+			evt.Timestamp = original
+		}
+		delete(metadata, "clock_skew")
+		delete(metadata, "clock_skew_seconds")
+		delete(metadata, "original_timestamp")
+	}
+
+	h := sha256.New()
+	for _, field := range []string{evt.Service, evt.Level, evt.Timestamp, evt.Route, evt.Message} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	if len(metadata) > 0 {
+		if b, err := json.Marshal(metadata); err == nil {
+			h.Write(b)
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// claim gives every event an id and reports which ones were already seen within
+// the horizon; their EventID is replaced with the id of the original delivery
+func (c *dedupCache) claim(events []LogEvent) []bool {
+	now := time.Now()
+	dup := make([]bool, len(events))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+
+	for i := range events {
+		evt := &events[i]
+		evt.EventID = strings.TrimSpace(evt.EventID)
+		if evt.EventID == "" {
+			if c.mode != dedupHash {
+				evt.EventID = newEventID()
+				continue
+			}
+			evt.EventID = contentEventID(*evt)
+		}
+		if c.mode == dedupOff {
+			continue
+		}
+
+		if el, ok := c.keys[evt.EventID]; ok {
+			evt.EventID = el.Value.(*dedupEntry).id
+			dup[i] = true
+			continue
+		}
+		c.add(evt.EventID, now)
+	}
+	return dup
+}
+
+// release forgets ids claimed by a delivery that was then refused, so the retry is not a duplicate
+func (c *dedupCache) release(events []LogEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, evt := range events {
+		if el, ok := c.keys[evt.EventID]; ok {
+			c.order.Remove(el)
+			delete(c.keys, evt.EventID)
+		}
+	}
+}
+
+// remember records ids without checking them, e.g. for events replayed from the WAL
+func (c *dedupCache) remember(ids []string, seen time.Time) {
+	if c.mode == dedupOff {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := c.keys[id]; !ok && id != "" {
+			c.add(id, seen)
+		}
+	}
+}
+
+// add inserts a key; callers hold mu
+func (c *dedupCache) add(id string, seen time.Time) {
+	c.keys[id] = c.order.PushBack(&dedupEntry{id: id, seen: seen})
+	for len(c.keys) > c.maxKeys {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.keys, oldest.Value.(*dedupEntry).id)
+	}
+}
+
+// expire drops keys older than the horizon; callers hold mu
+func (c *dedupCache) expire(now time.Time) {
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		entry := el.Value.(*dedupEntry)
+		if now.Sub(entry.seen) <= c.horizon {
+			return
+		}
+		c.order.Remove(el)
+		delete(c.keys, entry.id)
+	}
+}
+
+// warm loads ids stored within the horizon so client retries across a
+// restart are still recognised
+func (c *dedupCache) warm(store LogStore) {
+	if c.mode == dedupOff {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	entries, err := store.RecentEventIDs(ctx, time.Now().Add(-c.horizon), c.maxKeys)
+	if err != nil {
+		log.Printf("⚠️ Could not load recent event ids for dedup: %v", err)
+		return
+	}
+
+	// The cache expects oldest first
+	for i := len(entries) - 1; i >= 0; i-- {
+		c.remember([]string{entries[i].ID}, entries[i].Stored)
+	}
+	log.Printf("✅ Dedup cache warmed with %d event ids (mode=%s, horizon=%s)", len(entries), c.mode, c.horizon)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupModes(t *testing.T) {
+	events := func() []LogEvent {
+		return []LogEvent{
+			{Service: "api", Message: "a", EventID: " e1 "},
+			{Service: "api", Message: "b"},
+			{Service: "api", Message: "b"},
+			{Service: "api", Message: "c", EventID: "e1"},
+		}
+	}
+	tests := []struct {
+		mode string
+		dup  []bool
+	}{
+		{dedupOff, []bool{false, false, false, false}},
+		{dedupID, []bool{false, false, false, true}},
+		{dedupHash, []bool{false, false, true, true}},
+		{"bogus", []bool{false, false, false, true}}, // falls back to id
+	}
+	for _, tt := range tests {
+		c := newDedupCache(tt.mode, time.Hour, 100)
+		batch := events()
+		if got := c.claim(batch); !slices.Equal(got, tt.dup) {
+			t.Errorf("%s: dup = %v, want %v", tt.mode, got, tt.dup)
+		}
+		if batch[0].EventID != "e1" || batch[1].EventID == "" {
+			t.Errorf("%s: ids %q %q", tt.mode, batch[0].EventID, batch[1].EventID)
+		}
+		hashed := strings.HasPrefix(batch[1].EventID, "sha256:")
+		if hashed != (tt.mode == dedupHash) || (hashed && batch[1].EventID != batch[2].EventID) {
+			t.Errorf("%s: generated ids %q %q", tt.mode, batch[1].EventID, batch[2].EventID)
+		}
+	}
+}
+
+func TestContentEventID(t *testing.T) {
+	base := LogEvent{Service: "api", Level: "INFO", Message: "m", Timestamp: "2024-03-10T12:00:00Z", ReceivedAt: "2024-03-10T12:00:01Z", Metadata: map[string]interface{}{"a": 1, "b": 2}}
+	id := contentEventID(base)
+
+	reordered := base
+	reordered.Metadata = map[string]interface{}{"b": 2, "a": 1}
+	if contentEventID(reordered) != id {
+		t.Error("metadata order changed the id")
+	}
+	changed := base
+	changed.Message = "n"
+	if contentEventID(changed) == id {
+		t.Error("different message hashed alike")
+	}
+
+	// A clamped copy hashes by the time the client sent
+	skewed := base
+	skewed.Timestamp = "2024-03-10T12:00:01Z"
+	skewed.Metadata = map[string]interface{}{"a": 1, "b": 2, "clock_skew": "future", "clock_skew_seconds": 3600, "original_timestamp": base.Timestamp}
+	if contentEventID(skewed) != id {
+		t.Error("clock skew notes changed the id")
+	}
+
+	// Without a client timestamp the receive time must not count
+	first, second := base, base
+	first.Timestamp, first.ReceivedAt = "2024-03-10T12:00:05Z", "2024-03-10T12:00:05Z"
+	second.Timestamp, second.ReceivedAt = "2024-03-10T12:00:09Z", "2024-03-10T12:00:09Z"
+	if contentEventID(first) != contentEventID(second) {
+		t.Error("receive time changed the id")
+	}
+}
+
+func TestDedupReleaseAndRemember(t *testing.T) {
+	c := newDedupCache(dedupID, time.Hour, 100)
+	c.claim([]LogEvent{{EventID: "refused"}})
+	c.release([]LogEvent{{EventID: "refused"}})
+	if dup := c.claim([]LogEvent{{EventID: "refused"}}); dup[0] {
+		t.Error("released id still a duplicate")
+	}
+
+	c.remember([]string{"replayed", ""}, time.Now())
+	if dup := c.claim([]LogEvent{{EventID: "replayed"}}); !dup[0] {
+		t.Error("remembered id not a duplicate")
+	}
+	if _, ok := c.keys[""]; ok {
+		t.Error("empty id remembered")
+	}
+
+	off := newDedupCache(dedupOff, time.Hour, 100)
+	off.remember([]string{"x"}, time.Now())
+	if len(off.keys) != 0 {
+		t.Error("dedup off remembered ids")
+	}
+}
+
+func TestDedupExpiryAndCap(t *testing.T) {
+	c := newDedupCache(dedupID, time.Minute, 2)
+	c.remember([]string{"old"}, time.Now().Add(-2*time.Minute))
+	c.remember([]string{"recent"}, time.Now())
+	if dup := c.claim([]LogEvent{{EventID: "old"}, {EventID: "recent"}}); dup[0] || !dup[1] {
+		t.Errorf("dup = %v, want only the id within the horizon", dup)
+	}
+
+	// The expired "old" was claimed afresh, so "recent" is now the oldest key and goes first
+	c.claim([]LogEvent{{EventID: "newest"}})
+	if len(c.keys) != 2 {
+		t.Errorf("%d keys, want 2", len(c.keys))
+	}
+	if _, ok := c.keys["recent"]; ok {
+		t.Error("oldest key kept past the cap")
+	}
+}
+
+func TestDedupWarm(t *testing.T) {
+	store := newMemoryStore()
+	store.Insert(context.Background(), []LogEvent{
+		{Service: "api", Message: "a", EventID: "stored", Timestamp: formatEventTime(time.Now())},
+	})
+	c := newDedupCache(dedupID, time.Hour, 100)
+	c.warm(store)
+	if dup := c.claim([]LogEvent{{EventID: "stored"}}); !dup[0] {
+		t.Error("stored id not recognised after warm")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version reported to Elasticsearch clients; Beats and the official clients refuse
+// to talk to servers that look too old, so this is overridable via ES_COMPAT_VERSION
+const defaultESCompatVersion = "8.11.0"
+
+func esCompatVersion() string {
+	if v := os.Getenv("ES_COMPAT_VERSION"); v != "" {
+		return v
+	}
+	return defaultESCompatVersion
+}
+
+// esBulkItem is one entry of the "items" array in a bulk response
+type esBulkItem struct {
+	Index   string         `json:"_index"`
+	ID      string         `json:"_id,omitempty"`
+	Version int            `json:"_version,omitempty"`
+	Result  string         `json:"result,omitempty"`
+	Status  int            `json:"status"`
+	Error   *esBulkError   `json:"error,omitempty"`
+	Shards  map[string]int `json:"_shards,omitempty"`
+}
+
+type esBulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// writeESError sends an error in the shape Elasticsearch clients expect
+func writeESError(w http.ResponseWriter, code int, errType, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  esBulkError{Type: errType, Reason: reason},
+		"status": code,
+	})
+}
+
+// rootHandler serves the LogFlow banner, which doubles as the Elasticsearch
+// "GET /" probe that Beats, Fluent Bit and Vector send before bulk indexing
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	if r.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "LogFlow API is running",
+		"status":       "active",
+		"name":         "logflow",
+		"cluster_name": "logflow",
+		"cluster_uuid": "logflow",
+		"version": map[string]interface{}{
+			"number":                              esCompatVersion(),
+			"build_flavor":                        "default",
+			"lucene_version":                      "9.8.0",
+			"minimum_wire_compatibility_version":  "7.17.0",
+			"minimum_index_compatibility_version": "7.0.0",
+			"logflow_version":                     "1.0.0",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+// GET /_license - minimal license probe
+func esLicenseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"license": map[string]interface{}{
+			"status": "active",
+			"uid":    "logflow",
+			"type":   "basic",
+			"mode":   "basic",
+		},
+	})
+}
+
+// popField removes and returns an ECS field from a document, accepting both the
+// dotted form ("log.level": ...) and the nested form ("log": {"level": ...})
+func popField(doc map[string]interface{}, path string) interface{} {
+	if v, ok := doc[path]; ok {
+		delete(doc, path)
+		return v
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		return nil
+	}
+	child, ok := doc[head].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	v := popField(child, rest)
+	if len(child) == 0 {
+		delete(doc, head)
+	}
+	return v
+}
+
+func popString(doc map[string]interface{}, paths ...string) string {
+	for _, path := range paths {
+		switch v := popField(doc, path).(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// parseESTimestamp accepts ISO-8601 strings and epoch milliseconds
+func parseESTimestamp(v interface{}) (string, error) {
+	switch ts := v.(type) {
+	case nil:
+		return "", nil
+	case float64:
+		return formatEventTime(time.UnixMicro(int64(ts * 1000))), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return formatEventTime(t), nil
+		}
+		if ms, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			return formatEventTime(time.UnixMilli(ms)), nil
+		}
+	}
+	return "", fmt.Errorf("failed to parse field [@timestamp] with value [%v]", v)
+}
+
+// esDocToEvent maps well-known ECS fields onto LogEvent and keeps the rest as metadata
+func esDocToEvent(doc map[string]interface{}, index string) (LogEvent, error) {
+	ts, err := parseESTimestamp(popField(doc, "@timestamp"))
+	if err != nil {
+		return LogEvent{}, err
+	}
+
+	evt := LogEvent{
+		Timestamp: ts,
+		Level:     popString(doc, "log.level", "level"),
+		Service:   popString(doc, "service.name"),
+		Message:   popString(doc, "message"),
+		Route:     popString(doc, "url.path"),
+	}
+	if evt.Service == "" {
+		evt.Service = "unknown_service"
+	}
+	doc["es_index"] = index
+	evt.Metadata = doc
+	foreignLevel(&evt)
+	return evt, nil
+}
+
+// POST /_bulk and /{index}/_bulk - Elasticsearch bulk API
+func (s *server) esBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeESError(w, http.StatusMethodNotAllowed, "illegal_argument_exception", "bulk requires POST or PUT")
+		return
+	}
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	start := time.Now()
+
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+	defaultIndex := r.PathValue("index")
+
+	lines := bytes.Split(body, []byte("\n"))
+	var items []map[string]*esBulkItem
+	var events []LogEvent
+	var eventItems []*esBulkItem
+
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			writeESError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Malformed action/metadata line [%d]", i+1))
+			return
+		}
+
+		for op, meta := range action {
+			index := meta.Index
+			if index == "" {
+				index = defaultIndex
+			}
+			item := &esBulkItem{Index: index, ID: meta.ID}
+			items = append(items, map[string]*esBulkItem{op: item})
+
+			switch op {
+			case "index", "create":
+				// The source document follows on the next line
+			case "update":
+				i++ // skip the partial document
+				fallthrough
+			case "delete":
+				item.Status = http.StatusBadRequest
+				item.Error = &esBulkError{Type: "action_request_validation_exception", Reason: op + " is not supported by LogFlow"}
+				continue
+			default:
+				writeESError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Unknown action [%s] on line [%d]", op, i+1))
+				return
+			}
+
+			i++
+			if i >= len(lines) || len(bytes.TrimSpace(lines[i])) == 0 {
+				writeESError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Missing source for action on line [%d]", i))
+				return
+			}
+
+			var doc map[string]interface{}
+			if err := json.Unmarshal(bytes.TrimSpace(lines[i]), &doc); err != nil {
+				item.Status = http.StatusBadRequest
+				item.Error = &esBulkError{Type: "document_parsing_exception", Reason: "failed to parse document"}
+				continue
+			}
+			evt, err := esDocToEvent(doc, index)
+			if err == nil {
+				err = validateEvent(&evt)
+			}
+			if err != nil {
+				item.Status = http.StatusBadRequest
+				item.Error = &esBulkError{Type: "document_parsing_exception", Reason: err.Error()}
+				continue
+			}
+			events = append(events, evt)
+			eventItems = append(eventItems, item)
+		}
+	}
+
+	// Lines of one stack trace are indexed as their own documents; they all report created
+	events = s.multiline.assemble(events)
+
+	// Beats and Vector retry the whole request on 429
+	if err := s.pipeline.Enqueue(events, nil); err != nil {
+		s.pipeline.setRetryAfter(w)
+		writeESError(w, http.StatusTooManyRequests, "es_rejected_execution_exception", err.Error())
+		return
+	}
+
+	for _, item := range eventItems {
+		item.Version = 1
+		item.Result = "created"
+		item.Status = http.StatusCreated
+		item.Shards = map[string]int{"total": 1, "successful": 1, "failed": 0}
+	}
+
+	log.Printf("✅ QUEUED BULK: items=%d, indexed=%d", len(items), len(eventItems))
+
+	// Judged per item: multiline assembly may have merged several into one event
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"took":   time.Since(start).Milliseconds(),
+		"errors": len(eventItems) != len(items),
+		"items":  items,
+	})
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Columns a logField can name directly; anything under metadata. is a JSON path
+var logFieldColumns = map[string]bool{
+	"service": true, "level": true, "route": true, "message": true,
+	"event_id": true, "trace_id": true, "span_id": true, "request_id": true,
+}
+
+// logField is a column of logs or, for metadata.<path>, a value inside metadata
+type logField struct {
+	Column string   // a logFieldColumns entry, or "metadata"
+	Path   []string // keys inside metadata
+}
+
+// parseLogField reads a field name such as service or metadata.http.status
+func parseLogField(name string) (logField, error) {
+	if rest, ok := strings.CutPrefix(name, "metadata."); ok {
+		path := strings.Split(rest, ".")
+		for _, key := range path {
+			if key == "" {
+				return logField{}, fmt.Errorf("empty key in %q", name)
+			}
+		}
+		return logField{Column: "metadata", Path: path}, nil
+	}
+	if !logFieldColumns[name] {
+		return logField{}, fmt.Errorf("unknown field %q", name)
+	}
+	return logField{Column: name}, nil
+}
+
+func (f logField) String() string {
+	if f.Column == "metadata" {
+		return "metadata." + strings.Join(f.Path, ".")
+	}
+	return f.Column
+}
+
+// sql renders the field as a text expression; a missing metadata key is NULL
+func (f logField) sql(args []interface{}, argCount int) (string, []interface{}, int) {
+	if f.Column != "metadata" {
+		return f.Column, args, argCount
+	}
+	// One parameter per key, so keys never need escaping
+	params := make([]string, len(f.Path))
+	for i, key := range f.Path {
+		params[i] = fmt.Sprintf("$%d", argCount)
+		args = append(args, key)
+		argCount++
+	}
+	return fmt.Sprintf("jsonb_extract_path_text(metadata, %s)", strings.Join(params, ", ")), args, argCount
+}
+
+// value reads the field from an event the way jsonb_extract_path_text renders it;
+// ok is false where SQL would see NULL
+func (f logField) value(evt *LogEvent) (string, bool) {
+	switch f.Column {
+	case "service":
+		return evt.Service, true
+	case "level":
+		return evt.Level, true
+	case "message":
+		return evt.Message, true
+	case "route":
+		return evt.Route, evt.Route != ""
+	case "event_id":
+		return evt.EventID, evt.EventID != ""
+	case "trace_id":
+		return evt.TraceID, evt.TraceID != ""
+	case "span_id":
+		return evt.SpanID, evt.SpanID != ""
+	case "request_id":
+		return evt.RequestID, evt.RequestID != ""
+	}
+
+	switch v := f.raw(evt).(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		body, _ := json.Marshal(v)
+		return string(body), true
+	}
+}
+
+// raw returns the decoded JSON value at a metadata path, nil when absent or null
+func (f logField) raw(evt *LogEvent) interface{} {
+	var v interface{} = evt.Metadata
+	for _, key := range f.Path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+// jsonPath renders a metadata path as a strict SQL/JSON path; keys are quoted
+// as JSON strings, which jsonpath accepts
+func (f logField) jsonPath() string {
+	var b strings.Builder
+	b.WriteString("strict $")
+	for _, key := range f.Path {
+		quoted, _ := json.Marshal(key)
+		b.WriteByte('.')
+		b.Write(quoted)
+	}
+	return b.String()
+}
+
+// containing builds {"a":{"b":v}} for the metadata path, the document
+// `metadata @> ...` looks for
+func (f logField) containing(v interface{}) string {
+	for i := len(f.Path) - 1; i >= 0; i-- {
+		v = map[string]interface{}{f.Path[i]: v}
+	}
+	body, _ := json.Marshal(v)
+	return string(body)
+}
+
+// fieldMatcher compares a field with a value: = and != exactly, =~ and !~ with a
+// regular expression that must match the whole value, in with a list of values.
+// Metadata fields also take numeric comparisons (> >= < <=) and exists / missing.
+type fieldMatcher struct {
+	Field  logField
+	Op     string
+	Value  string
+	Values []string // for in
+	// For =~ and !~: the anchored, portable pattern sent to Postgres, and the
+	// same pattern compiled for the memory store
+	pattern string
+	re      *regexp.Regexp
+	number  float64
+}
+
+// allows reports whether op applies to the field
+func (f logField) allows(op string) bool {
+	switch op {
+	case "=", "!=", "=~", "!~", "in":
+		return true
+	case ">", ">=", "<", "<=", "exists", "missing":
+		return f.Column == "metadata"
+	}
+	return false
+}
+
+func newFieldMatcher(field logField, op, value string) (fieldMatcher, error) {
+	m := fieldMatcher{Field: field, Op: op, Value: value}
+	if !field.allows(op) {
+		return m, fmt.Errorf("operator %s does not apply to %s", op, field)
+	}
+	switch op {
+	case "=~", "!~":
+		// Check the pattern as written so errors quote what the user typed
+		if _, err := regexp.Compile(value); err != nil {
+			return m, fmt.Errorf("invalid regular expression: %v", err)
+		}
+		portable, err := portableRegex(value)
+		if err != nil {
+			return m, fmt.Errorf("invalid regular expression: %v", err)
+		}
+		m.pattern = anchoredPattern(portable)
+		// Postgres lets . match a newline, and RE2 does under the s flag
+		m.re = regexp.MustCompile("(?s)" + m.pattern)
+	case ">", ">=", "<", "<=":
+		n, ok := parseMetadataNumber(value)
+		if !ok {
+			return m, fmt.Errorf("%s %s needs a number, got %q", field, op, value)
+		}
+		m.number = n
+	case "in":
+		return m, fmt.Errorf("use newFieldInMatcher for in")
+	}
+	return m, nil
+}
+
+// newFieldInMatcher matches events whose field equals any of values
+func newFieldInMatcher(field logField, values []string) (fieldMatcher, error) {
+	if len(values) == 0 {
+		return fieldMatcher{}, fmt.Errorf("%s in needs at least one value", field)
+	}
+	return fieldMatcher{Field: field, Op: "in", Values: values}, nil
+}
+
+// parseMetadataNumber reads a finite number, as jsonpath's .double() would
+func parseMetadataNumber(s string) (float64, bool) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseMetadataFilters reads the metadata.<path> parameters of /logs:
+//
+//	metadata.user_id=user_3                 equality
+//	metadata.region=us&metadata.region=eu   any of the values (in)
+//	metadata.user_id=*                      the key is present
+//	metadata.user_id!=*                     the key is absent
+//	metadata.user_id!=user_3                not equal, or absent
+//	metadata.duration_ms>=500               numeric; also <=, and =>500 / =<500 for > / <
+func parseMetadataFilters(q url.Values) ([]fieldMatcher, error) {
+	keys := make([]string, 0, len(q))
+	for key := range q {
+		if strings.HasPrefix(key, "metadata.") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var matchers []fieldMatcher
+	add := func(field logField, op, value string) error {
+		m, err := newFieldMatcher(field, op, value)
+		if err == nil {
+			matchers = append(matchers, m)
+		}
+		return err
+	}
+	for _, key := range keys {
+		// metadata.a>=5 arrives as key "metadata.a>" and value "5"
+		name, keyOp := key, "="
+		for suffix, op := range map[string]string{">": ">=", "<": "<=", "!": "!="} {
+			if strings.HasSuffix(key, suffix) {
+				name, keyOp = strings.TrimSuffix(key, suffix), op
+				break
+			}
+		}
+		field, err := parseLogField(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var equals []string
+		for _, v := range q[key] {
+			op := keyOp
+			switch {
+			case v == "*" && keyOp == "=":
+				op = "exists"
+			case v == "*" && keyOp == "!=":
+				op = "missing"
+			case keyOp == "=":
+				// =>5 and =<5 are strict comparisons when a number follows
+				for _, prefix := range []string{">=", "<=", ">", "<"} {
+					if rest, ok := strings.CutPrefix(v, prefix); ok {
+						if _, isNumber := parseMetadataNumber(rest); isNumber {
+							op, v = prefix, rest
+						}
+						break
+					}
+				}
+			}
+			if op == "=" {
+				equals = append(equals, v)
+				continue
+			}
+			if err := add(field, op, v); err != nil {
+				return nil, err
+			}
+		}
+
+		switch len(equals) {
+		case 0:
+		case 1:
+			err = add(field, "=", equals[0])
+		default:
+			var m fieldMatcher
+			if m, err = newFieldInMatcher(field, equals); err == nil {
+				matchers = append(matchers, m)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matchers, nil
+}
+
+func anchoredPattern(re string) string {
+	return "^(?:" + re + ")$"
+}
+
+// ASCII spellings of the class escapes. RE2 reads \d, \s and \w as ASCII while
+// Postgres follows the database locale, so both are given these instead.
+var portableClasses = map[byte]string{
+	'd': `0-9`,
+	's': `\t\n\f\r `,
+	'w': `0-9A-Za-z_`,
+}
+
+var regexBoundRe = regexp.MustCompile(`^\{([0-9]+)(,([0-9]*))?\}`)
+
+// Postgres refuses repetition counts above 255 (RE_DUP_MAX)
+const maxRegexRepeat = 255
+
+// portableRegex restricts a pattern to the syntax Go's RE2 and Postgres's
+// advanced regular expressions read the same way, so =~ and !~ select the same
+// events from either store. \d \s \w and their negations become explicit ASCII
+// classes; other accepted escapes are \t \n \f \r \v and escaped punctuation.
+// Everything else the two dialects disagree on is an error: other escapes
+// (\b is a word boundary in one and a backspace in the other), (? groups other
+// than (?:, POSIX [:classes:] and collating elements, and braces that are not
+// a repetition count.
+func portableRegex(re string) (string, error) {
+	var out strings.Builder
+	inClass := false
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+		switch {
+		case c == '\\' && i+1 < len(re):
+			e := re[i+1]
+			i++
+			switch {
+			case portableClasses[e] != "":
+				if inClass {
+					out.WriteString(portableClasses[e])
+				} else {
+					out.WriteString("[" + portableClasses[e] + "]")
+				}
+			case e >= 'A' && e <= 'Z' && portableClasses[e+'a'-'A'] != "":
+				if inClass {
+					// Postgres has no negated class inside brackets
+					return "", fmt.Errorf(`\%c is not supported inside [ ]`, e)
+				}
+				out.WriteString("[^" + portableClasses[e+'a'-'A'] + "]")
+			case strings.IndexByte("tnfrv", e) >= 0, strings.IndexByte(`\.+*?()[]{}|^$/-`, e) >= 0:
+				out.WriteByte('\\')
+				out.WriteByte(e)
+			default:
+				r, _ := utf8.DecodeRuneInString(re[i:])
+				return "", fmt.Errorf(`\%c is not supported; use \d \s \w, \t \n \f \r \v or an escaped symbol`, r)
+			}
+			continue
+		case inClass:
+			if c == '[' && i+1 < len(re) && strings.IndexByte(":.=", re[i+1]) >= 0 {
+				return "", fmt.Errorf("[%c in a character class is not supported; list the characters or use a range", re[i+1])
+			}
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			out.WriteByte(c)
+			// A ] right after [ or [^ is a literal in both dialects
+			if i+1 < len(re) && re[i+1] == '^' {
+				i++
+				out.WriteByte('^')
+			}
+			if i+1 < len(re) && re[i+1] == ']' {
+				i++
+				out.WriteByte(']')
+			}
+			continue
+		case c == '(' && strings.HasPrefix(re[i:], "(?") && !strings.HasPrefix(re[i:], "(?:"):
+			return "", errors.New("only (?: groups are supported; flags, named groups and lookarounds are not")
+		case c == '{':
+			bound := regexBoundRe.FindStringSubmatch(re[i:])
+			if bound == nil {
+				return "", errors.New(`a literal { must be escaped as \{`)
+			}
+			for _, n := range []string{bound[1], bound[3]} {
+				if v, err := strconv.Atoi(n); n != "" && (err != nil || v > maxRegexRepeat) {
+					return "", fmt.Errorf("repetition count %s exceeds %d", n, maxRegexRepeat)
+				}
+			}
+			out.WriteString(bound[0])
+			i += len(bound[0]) - 1
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return out.String(), nil
+}
+
+// jsonCandidates lists the JSON values a metadata equality accepts for a query
+// string: the string itself, and the number or boolean it spells
+func jsonCandidates(value string) []interface{} {
+	candidates := []interface{}{value}
+	if n, err := strconv.ParseFloat(value, 64); err == nil && json.Valid([]byte(value)) {
+		candidates = append(candidates, n)
+	}
+	if value == "true" || value == "false" {
+		candidates = append(candidates, value == "true")
+	}
+	return candidates
+}
+
+// matches evaluates the matcher the way its SQL condition does: a missing value
+// never equals or matches anything
+func (m fieldMatcher) matches(evt *LogEvent) bool {
+	if m.Field.Column == "metadata" {
+		switch m.Op {
+		case "=":
+			return metadataEquals(m.Field.raw(evt), m.Value)
+		case "in":
+			raw := m.Field.raw(evt)
+			for _, value := range m.Values {
+				if metadataEquals(raw, value) {
+					return true
+				}
+			}
+			return false
+		case "exists":
+			return m.Field.raw(evt) != nil
+		case "missing":
+			return m.Field.raw(evt) == nil
+		case ">", ">=", "<", "<=":
+			return m.compare(m.Field.raw(evt))
+		}
+	}
+
+	v, ok := m.Field.value(evt)
+	switch m.Op {
+	case "=":
+		return ok && v == m.Value
+	case "!=":
+		return !ok || v != m.Value
+	case "=~":
+		return ok && m.re.MatchString(v)
+	case "in":
+		return ok && slices.Contains(m.Values, v)
+	default:
+		return !ok || !m.re.MatchString(v)
+	}
+}
+
+// metadataEquals is JSON containment of one candidate value
+func metadataEquals(raw interface{}, value string) bool {
+	for _, candidate := range jsonCandidates(value) {
+		if raw == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// compare applies a numeric comparison to a JSON number or numeric string
+func (m fieldMatcher) compare(raw interface{}) bool {
+	var n float64
+	switch v := raw.(type) {
+	case float64:
+		n = v
+	case string:
+		var ok bool
+		if n, ok = parseMetadataNumber(v); !ok {
+			return false
+		}
+	default:
+		return false
+	}
+	switch m.Op {
+	case ">":
+		return n > m.number
+	case ">=":
+		return n >= m.number
+	case "<":
+		return n < m.number
+	default:
+		return n <= m.number
+	}
+}
+
+func (m fieldMatcher) sql(args []interface{}, argCount int) (string, []interface{}, int) {
+	// Equality, in and existence on metadata are containment and jsonpath
+	// tests, which the logs_metadata_idx GIN index serves
+	if m.Field.Column == "metadata" {
+		switch m.Op {
+		case "=", "in":
+			values := m.Values
+			if m.Op == "=" {
+				values = []string{m.Value}
+			}
+			var conds []string
+			for _, value := range values {
+				for _, candidate := range jsonCandidates(value) {
+					conds = append(conds, fmt.Sprintf("metadata @> $%d::jsonb", argCount))
+					args = append(args, m.Field.containing(candidate))
+					argCount++
+				}
+			}
+			return "(" + strings.Join(conds, " OR ") + ")", args, argCount
+		case "exists", "missing":
+			cond := fmt.Sprintf("metadata @? $%d::jsonpath", argCount)
+			args = append(args, m.Field.jsonPath()+" ? (@ != null)")
+			if m.Op == "missing" {
+				cond = "NOT COALESCE(" + cond + ", FALSE)"
+			}
+			return cond, args, argCount + 1
+		case ">", ">=", "<", "<=":
+			// .double() reads numeric strings too; @? turns type errors into false
+			args = append(args, fmt.Sprintf("%s ? (@.double() %s %s)", m.Field.jsonPath(), m.Op, strconv.FormatFloat(m.number, 'f', -1, 64)))
+			return fmt.Sprintf("metadata @? $%d::jsonpath", argCount), args, argCount + 1
+		}
+	}
+
+	expr, args, argCount := m.Field.sql(args, argCount)
+	var cond string
+	switch m.Op {
+	case "=":
+		cond = fmt.Sprintf("%s = $%d", expr, argCount)
+		args = append(args, m.Value)
+	case "!=":
+		cond = fmt.Sprintf("%s IS DISTINCT FROM $%d", expr, argCount)
+		args = append(args, m.Value)
+	case "=~":
+		cond = fmt.Sprintf("%s ~ $%d", expr, argCount)
+		args = append(args, m.pattern)
+	case "in":
+		params := make([]string, len(m.Values))
+		for i, value := range m.Values {
+			params[i] = fmt.Sprintf("$%d", argCount)
+			args = append(args, value)
+			argCount++
+		}
+		return fmt.Sprintf("%s IN (%s)", expr, strings.Join(params, ", ")), args, argCount
+	default:
+		cond = fmt.Sprintf("COALESCE(%s !~ $%d, TRUE)", expr, argCount)
+		args = append(args, m.pattern)
+	}
+	return cond, args, argCount + 1
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GELF limits a message to 128 chunks
+	maxGELFChunks = 128
+	// Largest UDP datagram we read
+	maxGELFDatagram = 65536
+	// Incomplete chunk sets we track at once; past this the oldest is dropped
+	maxGELFPendingSets = 4096
+	// Default GELF_CHUNK_BUFFER_BYTES: chunk bytes held across all incomplete sets
+	defaultGELFChunkBufferBytes = 64 << 20
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// gelfMessage is the GELF 1.1 payload; underscore-prefixed additional fields
+// are collected separately by parseGELF
+type gelfMessage struct {
+	Version      string          `json:"version"`
+	Host         string          `json:"host"`
+	ShortMessage string          `json:"short_message"`
+	FullMessage  string          `json:"full_message"`
+	Timestamp    json.RawMessage `json:"timestamp"`
+	Level        *int            `json:"level"`
+	Facility     string          `json:"facility"`
+	Line         json.RawMessage `json:"line"`
+	File         string          `json:"file"`
+}
+
+// parseGELF maps a decompressed GELF payload onto LogEvent
+func parseGELF(payload []byte) (LogEvent, error) {
+	var msg gelfMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return LogEvent{}, fmt.Errorf("invalid GELF JSON: %w", err)
+	}
+	if msg.ShortMessage == "" {
+		return LogEvent{}, errors.New("short_message is required")
+	}
+
+	var raw map[string]interface{}
+	json.Unmarshal(payload, &raw)
+
+	metadata := map[string]interface{}{}
+	for k, v := range raw {
+		// _id is reserved by the spec
+		if strings.HasPrefix(k, "_") && k != "_id" {
+			metadata[strings.TrimPrefix(k, "_")] = v
+		}
+	}
+	if msg.Host != "" {
+		metadata["host"] = msg.Host
+	}
+	if msg.Facility != "" {
+		metadata["facility"] = msg.Facility
+	}
+	if msg.File != "" {
+		metadata["file"] = msg.File
+	}
+
+	evt := LogEvent{
+		Message: msg.ShortMessage,
+		// GELF's default level is 1 (alert), but senders that omit it are rarely alerting
+		Level: "INFO",
+	}
+	// Stack traces live in full_message, so prefer it and keep the summary line
+	if msg.FullMessage != "" {
+		evt.Message = msg.FullMessage
+		metadata["short_message"] = msg.ShortMessage
+	}
+	if msg.Level != nil {
+		evt.Level = syslogSeverityLevel(*msg.Level)
+		metadata["syslog_level"] = *msg.Level
+	}
+
+	if ts := strings.Trim(string(msg.Timestamp), `"`); ts != "" && ts != "null" {
+		t, err := parseEpochSeconds(ts)
+		if err != nil {
+			return LogEvent{}, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		evt.Timestamp = formatEventTime(t)
+	}
+
+	// The Docker driver names the container; fall back to the sending host
+	evt.Service = popString(metadata, "service", "container_name", "tag")
+	evt.Service = strings.TrimPrefix(evt.Service, "/")
+	if evt.Service == "" {
+		evt.Service = msg.Host
+	}
+	if evt.Service == "" {
+		evt.Service = "unknown_service"
+	}
+	evt.Route = popString(metadata, "route")
+
+	evt.Metadata = metadata
+	return evt, nil
+}
+
+// decompressGELF detects gzip and zlib payloads by their magic bytes; the
+// decompressed message is capped at limit bytes
+func decompressGELF(payload []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case len(payload) >= 2 && payload[0] == 0x78 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0:
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return payload, nil
+	}
+
+	// Same decompression-bomb guard as the HTTP ingest paths
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, fmt.Errorf("decompressed message exceeds %d bytes", limit)
+	}
+	return out, nil
+}
+
+// gelfChunkSet collects the chunks of one message until all have arrived
+type gelfChunkSet struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// gelfAssembler reassembles chunked UDP messages and expires incomplete sets.
+// Chunk bytes held across all sets are capped by budget; the oldest sets are
+// dropped to make room, so a flood of partial messages can't exhaust memory.
+// A single message is capped at maxMessage bytes.
+type gelfAssembler struct {
+	mu         sync.Mutex
+	sets       map[string]*gelfChunkSet
+	pending    int64 // chunk bytes held in sets
+	budget     int64
+	maxMessage int64
+	timeout    time.Duration
+}
+
+func newGELFAssembler(timeout time.Duration, budget, maxMessage int64) *gelfAssembler {
+	a := &gelfAssembler{sets: map[string]*gelfChunkSet{}, budget: budget, maxMessage: maxMessage, timeout: timeout}
+	go a.expireLoop()
+	return a
+}
+
+// drop forgets a set and releases its bytes; callers hold mu
+func (a *gelfAssembler) drop(id string, set *gelfChunkSet) {
+	delete(a.sets, id)
+	a.pending -= int64(set.size)
+}
+
+// evictOldest drops the longest-waiting set other than keep; callers hold mu
+func (a *gelfAssembler) evictOldest(keep, reason string) {
+	var oldestID string
+	var oldest *gelfChunkSet
+	for id, set := range a.sets {
+		if id != keep && (oldest == nil || set.started.Before(oldest.started)) {
+			oldestID, oldest = id, set
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	log.Printf("⚠️ Dropping incomplete GELF message (%s): %d/%d chunks, %d bytes", reason, oldest.received, len(oldest.parts), oldest.size)
+	a.drop(oldestID, oldest)
+}
+
+// add stores one chunk and returns the full payload once the set is complete
+func (a *gelfAssembler) add(datagram []byte) ([]byte, error) {
+	if len(datagram) < 12 {
+		return nil, errors.New("truncated chunk header")
+	}
+	id := string(datagram[2:10])
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > maxGELFChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk %d/%d", seq, count)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	set, ok := a.sets[id]
+	if !ok {
+		if len(a.sets) >= maxGELFPendingSets {
+			a.evictOldest(id, "too many incomplete messages")
+		}
+		set = &gelfChunkSet{parts: make([][]byte, count), started: time.Now()}
+		a.sets[id] = set
+	}
+	if len(set.parts) != count {
+		a.drop(id, set)
+		return nil, errors.New("chunk count changed mid-message")
+	}
+	if set.parts[seq] != nil {
+		return nil, nil // duplicate chunk
+	}
+
+	chunk := len(datagram) - 12
+	if int64(set.size+chunk) > a.maxMessage {
+		a.drop(id, set)
+		return nil, fmt.Errorf("chunked message exceeds %d bytes", a.maxMessage)
+	}
+	if int64(set.size+chunk) > a.budget {
+		a.drop(id, set)
+		return nil, fmt.Errorf("chunked message exceeds the %d byte chunk buffer", a.budget)
+	}
+	// The set itself fits, so dropping others always makes room
+	for a.pending+int64(chunk) > a.budget {
+		a.evictOldest(id, "chunk buffer full")
+	}
+	set.parts[seq] = append([]byte(nil), datagram[12:]...)
+	set.received++
+	set.size += chunk
+	a.pending += int64(chunk)
+	if set.received < count {
+		return nil, nil
+	}
+
+	a.drop(id, set)
+	return bytes.Join(set.parts, nil), nil
+}
+
+func (a *gelfAssembler) expireLoop() {
+	// Floored so a nanosecond timeout cannot make a zero interval
+	ticker := time.NewTicker(max(a.timeout/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.mu.Lock()
+		for id, set := range a.sets {
+			if time.Since(set.started) > a.timeout {
+				log.Printf("⚠️ Dropping incomplete GELF message: %d/%d chunks after %s", set.received, len(set.parts), a.timeout)
+				a.drop(id, set)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// storeGELF decodes one complete GELF payload and queues it on the regular ingest path
+func (s *server) storeGELF(payload []byte, source string) {
+	defer recoverListener("GELF message from " + source)
+	data, err := decompressGELF(payload, s.maxDecompressedBytes)
+	if err != nil {
+		log.Printf("⚠️ Dropping GELF message from %s: %v", source, err)
+		return
+	}
+	evt, err := parseGELF(data)
+	if err == nil {
+		err = validateEvent(&evt)
+	}
+	if err != nil {
+		log.Printf("⚠️ Dropping GELF message from %s: %v", source, err)
+		return
+	}
+	// The Docker driver sends one message per output line, so traces need reassembling
+	s.offerLine(source, evt)
+}
+
+// startGELF starts the optional listeners configured by GELF_UDP_ADDR and
+// GELF_TCP_ADDR (e.g. ":12201"); GELF_CHUNK_TIMEOUT bounds chunk reassembly, and
+// GELF_TCP_MAX_CONNS and GELF_TCP_IDLE_TIMEOUT the TCP connections
+func (s *server) startGELF() {
+	if addr := os.Getenv("GELF_UDP_ADDR"); addr != "" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Fatalf("Failed to start GELF UDP listener: %v", err)
+		}
+		timeout := envDuration("GELF_CHUNK_TIMEOUT", 5*time.Second)
+		budget := envInt64("GELF_CHUNK_BUFFER_BYTES", defaultGELFChunkBufferBytes)
+		if budget < 1 {
+			log.Fatalf("GELF_CHUNK_BUFFER_BYTES must be positive, got %d", budget)
+		}
+		log.Printf("📡 GELF UDP listening on %s", addr)
+		go s.serveGELFUDP(conn, newGELFAssembler(timeout, budget, s.maxDecompressedBytes))
+	}
+
+	if addr := os.Getenv("GELF_TCP_ADDR"); addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Failed to start GELF TCP listener: %v", err)
+		}
+		maxConns := envPositiveInt("GELF_TCP_MAX_CONNS", defaultTCPMaxConns)
+		idle := envDuration("GELF_TCP_IDLE_TIMEOUT", defaultTCPIdleTimeout)
+		log.Printf("📡 GELF TCP listening on %s", addr)
+		go serveTCP(ln, "GELF", maxConns, idle, s.handleGELFConn)
+	}
+}
+
+func (s *server) serveGELFUDP(conn net.PacketConn, assembler *gelfAssembler) {
+	buf := make([]byte, maxGELFDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("❌ GELF UDP read error: %v", err)
+			return
+		}
+		datagram := buf[:n]
+
+		if !bytes.HasPrefix(datagram, gelfChunkMagic) {
+			s.storeGELF(append([]byte(nil), datagram...), addr.String())
+			continue
+		}
+
+		payload, err := assembler.add(datagram)
+		if err != nil {
+			log.Printf("⚠️ Dropping GELF chunk from %s: %v", addr, err)
+			continue
+		}
+		if payload != nil {
+			s.storeGELF(payload, addr.String())
+		}
+	}
+}
+
+// handleGELFConn reads null-byte delimited messages
+func (s *server) handleGELFConn(conn net.Conn) {
+	defer conn.Close()
+	source := conn.RemoteAddr().String()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxDecompressedBytes))
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		frame := bytes.TrimSpace(scanner.Bytes())
+		if len(frame) > 0 {
+			s.storeGELF(append([]byte(nil), frame...), source)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("⚠️ GELF TCP connection %s closed: %v", source, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGELF(t *testing.T) {
+	evt, err := parseGELF([]byte(`{"version":"1.1","host":"web-1","short_message":"boom","full_message":"boom\n\tat a.B.c",
+		"timestamp":1700000000.25,"level":3,"_container_name":"/checkout","_route":"/pay","_user_id":7,"_id":"x"}`))
+	if err != nil {
+		t.Fatalf("parseGELF: %v", err)
+	}
+	if evt.Service != "checkout" || evt.Route != "/pay" || evt.Level != "ERROR" || evt.Message != "boom\n\tat a.B.c" {
+		t.Errorf("event = %+v", evt)
+	}
+	if evt.Timestamp != "2023-11-14T22:13:20.25Z" {
+		t.Errorf("timestamp = %q", evt.Timestamp)
+	}
+	md := evt.Metadata
+	if md["host"] != "web-1" || md["short_message"] != "boom" || md["user_id"] != float64(7) || md["syslog_level"] != 3 {
+		t.Errorf("metadata = %v", md)
+	}
+	if _, ok := md["id"]; ok {
+		t.Error("reserved _id kept")
+	}
+
+	evt, err = parseGELF([]byte(`{"short_message":"hi","host":"db-2"}`))
+	if err != nil || evt.Service != "db-2" || evt.Level != "INFO" || evt.Timestamp != "" {
+		t.Errorf("minimal message = %+v, %v", evt, err)
+	}
+
+	for _, body := range []string{`{"host":"a"}`, `not json`, `{"short_message":"x","timestamp":"soon"}`} {
+		if _, err := parseGELF([]byte(body)); err == nil {
+			t.Errorf("%s: parsed without error", body)
+		}
+	}
+}
+
+func TestDecompressGELF(t *testing.T) {
+	plain := []byte(`{"short_message":"hi"}`)
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(plain)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(plain)
+	zw.Close()
+
+	for name, payload := range map[string][]byte{"plain": plain, "gzip": gz.Bytes(), "zlib": zl.Bytes()} {
+		out, err := decompressGELF(payload, 1<<20)
+		if err != nil || !bytes.Equal(out, plain) {
+			t.Errorf("%s: %q, %v", name, out, err)
+		}
+	}
+	if _, err := decompressGELF([]byte{0x1f, 0x8b, 0x00}, 1<<20); err == nil {
+		t.Error("truncated gzip accepted")
+	}
+	if _, err := decompressGELF(gz.Bytes(), int64(len(plain)-1)); err == nil {
+		t.Error("message over the limit accepted")
+	}
+}
+
+// gelfID pads a readable name to an 8-byte message id
+func gelfID(name string) string { return fmt.Sprintf("%-8s", name)[:8] }
+
+// gelfChunk builds one chunk datagram of message name
+func gelfChunk(name string, seq, count int, data string) []byte {
+	header := append([]byte{0x1e, 0x0f}, gelfID(name)...)
+	return append(append(header, byte(seq), byte(count)), data...)
+}
+
+func TestGELFAssembler(t *testing.T) {
+	a := newGELFAssembler(time.Minute, 1<<20, 1<<20)
+
+	if out, err := a.add(gelfChunk("m1", 1, 2, "world")); out != nil || err != nil {
+		t.Fatalf("first chunk: %q, %v", out, err)
+	}
+	if out, err := a.add(gelfChunk("m1", 1, 2, "world")); out != nil || err != nil {
+		t.Errorf("duplicate chunk: %q, %v", out, err)
+	}
+	out, err := a.add(gelfChunk("m1", 0, 2, "hello "))
+	if err != nil || string(out) != "hello world" {
+		t.Errorf("out of order: %q, %v", out, err)
+	}
+	if len(a.sets) != 0 || a.pending != 0 {
+		t.Errorf("%d sets, %d bytes left after completion", len(a.sets), a.pending)
+	}
+
+	a.add(gelfChunk("m2", 0, 3, "a"))
+	if _, err := a.add(gelfChunk("m2", 1, 2, "b")); err == nil || a.pending != 0 {
+		t.Errorf("changed chunk count: %v, %d bytes held", err, a.pending)
+	}
+
+	small := newGELFAssembler(time.Minute, 1<<20, 4)
+	small.add(gelfChunk("m4", 0, 2, "abc"))
+	if _, err := small.add(gelfChunk("m4", 1, 2, "de")); err == nil || len(small.sets) != 0 {
+		t.Errorf("message over the limit: %v, %d sets held", err, len(small.sets))
+	}
+
+	for _, chunk := range [][]byte{{0x1e, 0x0f, 1}, gelfChunk("m3", 0, 0, "x"), gelfChunk("m3", 2, 2, "x"), gelfChunk("m3", 0, maxGELFChunks+1, "x")} {
+		if _, err := a.add(chunk); err == nil {
+			t.Errorf("chunk %x accepted", chunk)
+		}
+	}
+}
+
+func TestGELFAssemblerEvictsOldestOverBudget(t *testing.T) {
+	a := newGELFAssembler(time.Minute, 10, 1<<20)
+	a.add(gelfChunk("old", 0, 2, "aaaa"))
+	a.sets[gelfID("old")].started = time.Now().Add(-time.Second)
+	a.add(gelfChunk("mid", 0, 2, "bbbb"))
+
+	// Six more bytes than fit: only the oldest set has to go
+	if _, err := a.add(gelfChunk("new", 0, 2, "cccc")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, ok := a.sets[gelfID("old")]; ok || len(a.sets) != 2 || a.pending != 8 {
+		t.Errorf("sets %v, %d bytes held", a.sets, a.pending)
+	}
+	if out, _ := a.add(gelfChunk("mid", 1, 2, "!")); string(out) != "bbbb!" {
+		t.Errorf("surviving set completed as %q", out)
+	}
+
+	// A chunk bigger than the whole buffer is refused without evicting anything
+	if _, err := a.add(gelfChunk("huge", 0, 2, strings.Repeat("x", 11))); err == nil {
+		t.Error("chunk larger than the buffer accepted")
+	}
+	if _, ok := a.sets[gelfID("new")]; !ok || a.pending != 4 {
+		t.Errorf("sets %v, %d bytes held", a.sets, a.pending)
+	}
+}
+
+func TestGELFAssemblerEvictsOldestPastSetLimit(t *testing.T) {
+	a := newGELFAssembler(time.Minute, 1<<30, 1<<20)
+	start := time.Now().Add(-time.Hour)
+	for i := range maxGELFPendingSets {
+		id := fmt.Sprintf("s%d", i)
+		a.add(gelfChunk(id, 0, 2, "x"))
+		a.sets[gelfID(id)].started = start.Add(time.Duration(i) * time.Millisecond)
+	}
+	if _, err := a.add(gelfChunk("latest", 0, 2, "x")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, ok := a.sets[gelfID("s0")]; ok || len(a.sets) != maxGELFPendingSets {
+		t.Errorf("%d sets, oldest kept: %t", len(a.sets), ok)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/serilevanjalines/LogFlow/internal/multiline"
+)
+
+// newIngestServer wires the ingest handlers to an in-memory store, with
+// continuation lines of Go traces joined when config says so
+func newIngestServer(t *testing.T, config multilineConfig) (*server, *memoryStore) {
+	t.Helper()
+	store := newMemoryStore()
+	tail := newTailBroker(16, 16)
+	s := &server{
+		store:                store,
+		tail:                 tail,
+		pipeline:             newWritePipeline(64, 1, 16, 10*time.Millisecond, time.Second, nil, nil, newDedupCache(dedupID, time.Hour, 1000), store, tail),
+		hecAcks:              newHECAckTracker(time.Minute),
+		multiline:            config,
+		maxDecompressedBytes: 1 << 10,
+	}
+	t.Cleanup(s.pipeline.Close)
+	return s, store
+}
+
+// storedLogs drains the pipeline and returns what reached the store, oldest first
+func storedLogs(t *testing.T, s *server, store *memoryStore) []LogEvent {
+	t.Helper()
+	s.pipeline.Close()
+	logs, err := store.Query(context.Background(), LogFilter{Ascending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logs
+}
+
+func post(h http.HandlerFunc, path, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIngestHandler(t *testing.T) {
+	s, store := newIngestServer(t, multilineConfig{})
+	w := post(s.ingestHandler, "/ingest", "application/json", `{"service":"api","level":"warn","message":"slow","event_id":"e1"}`)
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"event_id":"e1"`) {
+		t.Fatalf("ingest: %d %s", w.Code, w.Body)
+	}
+	// A retried delivery is acknowledged again but stored once
+	if w := post(s.ingestHandler, "/ingest", "application/json", `{"service":"api","message":"slow","event_id":"e1"}`); w.Code != http.StatusAccepted {
+		t.Errorf("retry: %d %s", w.Code, w.Body)
+	}
+	if w := post(s.ingestHandler, "/ingest", "application/json", `{"message":"no service"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid event: %d", w.Code)
+	}
+
+	logs := storedLogs(t, s, store)
+	if len(logs) != 1 || logs[0].Service != "api" || logs[0].Level != "WARNING" || logs[0].EventID != "e1" {
+		t.Errorf("stored %+v", logs)
+	}
+}
+
+func TestBatchIngestHandler(t *testing.T) {
+	s, store := newIngestServer(t, withMultiline(multiline.Go))
+	body := `{"service":"api","level":"error","message":"panic: boom"}
+{"service":"api","level":"error","message":"main.foo()"}
+not json
+{"service":"worker","message":"started"}`
+	w := post(s.batchIngestHandler, "/ingest/batch", "application/x-ndjson", body)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Status   string        `json:"status"`
+		Accepted int           `json:"accepted"`
+		Results  []batchResult `json:"results"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Status != "partial" || resp.Accepted != 3 || resp.Results[2].Status != "rejected" {
+		t.Errorf("response %+v", resp)
+	}
+	// Both lines of the trace report the event they were merged into
+	if id := resp.Results[0].EventID; id == "" || resp.Results[1].EventID != id || resp.Results[3].EventID == id {
+		t.Errorf("event ids %+v", resp.Results)
+	}
+
+	logs := storedLogs(t, s, store)
+	if len(logs) != 2 || logs[0].Message != "panic: boom\nmain.foo()" || logs[1].Message != "started" {
+		t.Errorf("stored %+v", logs)
+	}
+}
+
+func TestOTLPLogsHandler(t *testing.T) {
+	s, store := newIngestServer(t, multilineConfig{})
+	body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+		"scopeLogs":[{"logRecords":[{"severityText":"ERROR","body":{"stringValue":"boom"}},
+		{"body":{"stringValue":"` + strings.Repeat("x", maxMessageBytes+1) + `"}}]}]}]}`
+	s.maxDecompressedBytes = 1 << 20
+	w := post(s.otlpLogsHandler, "/v1/logs", "application/json", body)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"rejectedLogRecords":"1"`) {
+		t.Fatalf("otlp: %d %s", w.Code, w.Body)
+	}
+	logs := storedLogs(t, s, store)
+	if len(logs) != 1 || logs[0].Service != "api" || logs[0].Level != "ERROR" || logs[0].Message != "boom" {
+		t.Errorf("stored %+v", logs)
+	}
+}
+
+func TestLokiPushHandler(t *testing.T) {
+	s, store := newIngestServer(t, multilineConfig{})
+	now := time.Now().UnixNano()
+	long := strings.Repeat("x", maxServiceLen+1)
+	body := fmt.Sprintf(`{"streams":[{"stream":{"service":"api"},"values":[["%d","first"]]},
+		{"stream":{"service":"%s"},"values":[["%d","bad service"]]}]}`, now, long, now)
+	w := post(s.lokiPushHandler, "/loki/api/v1/push", "application/json", body)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("push: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Accepted int             `json:"accepted"`
+		Rejected []lokiRejection `json:"rejected"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Accepted != 1 || len(resp.Rejected) != 1 || resp.Rejected[0].Index != 1 || resp.Rejected[0].Stream != 1 {
+		t.Errorf("response %+v", resp)
+	}
+
+	bad := fmt.Sprintf(`{"streams":[{"stream":{"service":"%s"},"values":[["%d","bad service"]]}]}`, long, now)
+	if w := post(s.lokiPushHandler, "/loki/api/v1/push", "application/json", bad); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"status":"failed"`) {
+		t.Errorf("invalid push: %d %s", w.Code, w.Body)
+	}
+
+	logs := storedLogs(t, s, store)
+	if len(logs) != 1 || logs[0].Message != "first" {
+		t.Errorf("stored %+v", logs)
+	}
+}
+
+func TestESBulkHandler(t *testing.T) {
+	s, store := newIngestServer(t, withMultiline(multiline.Go))
+	body := `{"index":{}}
+{"service":"api","level":"error","message":"panic: boom"}
+{"create":{}}
+{"service":"api","level":"error","message":"main.foo()"}
+`
+	w := post(s.esBulkHandler, "/_bulk", "application/x-ndjson", body)
+	var resp struct {
+		Errors bool                    `json:"errors"`
+		Items  []map[string]esBulkItem `json:"items"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("bulk: %d %s", w.Code, w.Body)
+	}
+	// The continuation line was merged, not lost, so it is not an error
+	if resp.Errors || len(resp.Items) != 2 || resp.Items[1]["create"].Status != http.StatusCreated {
+		t.Errorf("response %s", w.Body)
+	}
+
+	logs := storedLogs(t, s, store)
+	if len(logs) != 1 || logs[0].Message != "panic: boom\nmain.foo()" {
+		t.Errorf("stored %+v", logs)
+	}
+}
+
+func TestHECEventAcks(t *testing.T) {
+	t.Setenv("HEC_TOKENS", "secret")
+	s, store := newIngestServer(t, multilineConfig{})
+	r := httptest.NewRequest(http.MethodPost, "/services/collector/event", strings.NewReader(`{"event":"disk full","fields":{"service":"db"}}{"event":{"message":"second"}}`))
+	r.Header.Set("Authorization", "Splunk secret")
+	r.Header.Set("X-Splunk-Request-Channel", "ch")
+	w := httptest.NewRecorder()
+	s.hecEventHandler(w, r)
+
+	var resp hecResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || resp.AckID == nil {
+		t.Fatalf("event: %d %s", w.Code, w.Body)
+	}
+	logs := storedLogs(t, s, store)
+	if len(logs) != 2 || logs[0].Service != "db" || logs[1].Service != "unknown_service" {
+		t.Errorf("stored %+v", logs)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/services/collector/ack?channel=ch", strings.NewReader(fmt.Sprintf(`{"acks":[%d]}`, *resp.AckID)))
+	r.Header.Set("Authorization", "Splunk secret")
+	w = httptest.NewRecorder()
+	s.hecAckHandler(w, r)
+	if want := fmt.Sprintf(`{"acks":{"%d":true}}`, *resp.AckID); strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("ack: %s, want %s", w.Body, want)
+	}
+}
+
+func TestDecompressMiddlewareLimit(t *testing.T) {
+	s, store := newIngestServer(t, multilineConfig{})
+	h := s.decompressMiddleware(s.ingestHandler)
+	gzipped := func(body string) *http.Request {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write([]byte(body))
+		gw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/ingest", &buf)
+		r.Header.Set("Content-Encoding", "gzip")
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	h(w, gzipped(`{"service":"api","message":"`+strings.Repeat("a", int(s.maxDecompressedBytes))+`"}`))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	h(w, gzipped(`{"service":"api","message":"small"}`))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("small body: %d %s", w.Code, w.Body)
+	}
+
+	if logs := storedLogs(t, s, store); len(logs) != 1 || logs[0].Message != "small" {
+		t.Errorf("stored %+v", logs)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Stream labels that become first-class LogEvent fields, in order of preference
+var (
+	lokiServiceLabels = []string{"service", "service_name", "app", "application", "job", "container"}
+	lokiLevelLabels   = []string{"level", "severity", "detected_level", "lvl"}
+	lokiRouteLabels   = []string{"route", "http_route", "path"}
+)
+
+type lokiStream struct {
+	Labels  map[string]string
+	Entries []lokiEntry
+}
+
+// lokiRejection reports an entry that failed validation: its position in the
+// push overall and within its stream
+type lokiRejection struct {
+	Index  int    `json:"index"`
+	Stream int    `json:"stream"`
+	Entry  int    `json:"entry"`
+	Error  string `json:"error"`
+}
+
+type lokiEntry struct {
+	Timestamp time.Time
+	Line      string
+	Metadata  map[string]string // structured metadata
+}
+
+// lokiJSONPush is the JSON flavour of a push request:
+// {"streams": [{"stream": {...labels}, "values": [["<unix ns>", "line", {...metadata}]]}]}
+type lokiJSONPush struct {
+	Streams []struct {
+		Stream map[string]string   `json:"stream"`
+		Values [][]json.RawMessage `json:"values"`
+	} `json:"streams"`
+}
+
+func decodeLokiJSON(body []byte) ([]lokiStream, error) {
+	var push lokiJSONPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+
+	streams := make([]lokiStream, 0, len(push.Streams))
+	for _, s := range push.Streams {
+		stream := lokiStream{Labels: s.Stream}
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				return nil, fmt.Errorf("value must be [timestamp, line]")
+			}
+			var tsStr, line string
+			if err := json.Unmarshal(v[0], &tsStr); err != nil {
+				return nil, fmt.Errorf("invalid timestamp %s", v[0])
+			}
+			ns, err := strconv.ParseInt(tsStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", tsStr)
+			}
+			if err := json.Unmarshal(v[1], &line); err != nil {
+				return nil, fmt.Errorf("invalid line %s", v[1])
+			}
+			entry := lokiEntry{Timestamp: time.Unix(0, ns).UTC(), Line: line}
+			if len(v) > 2 {
+				if err := json.Unmarshal(v[2], &entry.Metadata); err != nil {
+					return nil, fmt.Errorf("invalid structured metadata %s", v[2])
+				}
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// decodeLokiProto parses a logproto.PushRequest
+func decodeLokiProto(b []byte) ([]lokiStream, error) {
+	var streams []lokiStream
+	err := walkProto(b, func(f protoField) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		var stream lokiStream
+		err := walkProto(f.Bytes, func(sf protoField) error {
+			switch sf.Num {
+			case 1: // labels
+				labels, err := parseLokiLabels(string(sf.Bytes))
+				stream.Labels = labels
+				return err
+			case 2: // entries
+				entry, err := decodeLokiEntry(sf.Bytes)
+				stream.Entries = append(stream.Entries, entry)
+				return err
+			}
+			return nil
+		})
+		streams = append(streams, stream)
+		return err
+	})
+	return streams, err
+}
+
+func decodeLokiEntry(b []byte) (lokiEntry, error) {
+	var entry lokiEntry
+	err := walkProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1: // google.protobuf.Timestamp
+			var seconds, nanos int64
+			err := walkProto(f.Bytes, func(tf protoField) error {
+				switch tf.Num {
+				case 1:
+					seconds = int64(tf.Varint)
+				case 2:
+					nanos = int64(int32(tf.Varint))
+				}
+				return nil
+			})
+			entry.Timestamp = time.Unix(seconds, nanos).UTC()
+			return err
+		case 2:
+			entry.Line = string(f.Bytes)
+		case 3: // structuredMetadata
+			var name, value string
+			err := walkProto(f.Bytes, func(lf protoField) error {
+				switch lf.Num {
+				case 1:
+					name = string(lf.Bytes)
+				case 2:
+					value = string(lf.Bytes)
+				}
+				return nil
+			})
+			if entry.Metadata == nil {
+				entry.Metadata = map[string]string{}
+			}
+			entry.Metadata[name] = value
+			return err
+		}
+		return nil
+	})
+	return entry, err
+}
+
+// parseLokiLabels parses a Prometheus-style label set: {app="api", level="error"}
+func parseLokiLabels(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid label set %q", s)
+	}
+	s = s[1 : len(s)-1]
+
+	labels := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return labels, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, fmt.Errorf("invalid label near %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+
+		// Quoted values use Go-style escapes
+		rest := s[eq+1:]
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return nil, fmt.Errorf("unterminated value for label %q", name)
+		}
+		value, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q", name)
+		}
+		labels[name] = value
+		s = rest[end+1:]
+	}
+}
+
+// takeLabel returns and removes the first of names present in labels
+func takeLabel(labels map[string]string, names []string) string {
+	for _, name := range names {
+		if v, ok := labels[name]; ok && v != "" {
+			delete(labels, name)
+			return v
+		}
+	}
+	return ""
+}
+
+// lokiToEvent maps stream labels onto service/level/route and keeps the rest as metadata
+func lokiToEvent(streamLabels map[string]string, entry lokiEntry) LogEvent {
+	labels := make(map[string]string, len(streamLabels)+len(entry.Metadata))
+	for k, v := range streamLabels {
+		labels[k] = v
+	}
+	// Structured metadata can carry per-line level or route, so it wins over stream labels
+	for k, v := range entry.Metadata {
+		labels[k] = v
+	}
+
+	evt := LogEvent{
+		Service:   takeLabel(labels, lokiServiceLabels),
+		Level:     takeLabel(labels, lokiLevelLabels),
+		Route:     takeLabel(labels, lokiRouteLabels),
+		Message:   entry.Line,
+		Timestamp: formatEventTime(entry.Timestamp),
+	}
+	if evt.Service == "" {
+		evt.Service = "unknown_service"
+	}
+	if len(labels) > 0 {
+		evt.Metadata = make(map[string]interface{}, len(labels))
+		for k, v := range labels {
+			evt.Metadata[k] = v
+		}
+	}
+	foreignLevel(&evt)
+	return evt
+}
+
+// POST /loki/api/v1/push - Loki push API (snappy protobuf or JSON)
+func (s *server) lokiPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var streams []lokiStream
+	var err error
+	if mediaType == "application/json" {
+		streams, err = decodeLokiJSON(body)
+	} else {
+		// Promtail and Grafana Agent send snappy block-compressed protobuf
+		n, lenErr := snappy.DecodedLen(body)
+		if lenErr != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid snappy body")
+			return
+		}
+		if int64(n) > s.maxDecompressedBytes {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Payload too large: decompressed body exceeds %d bytes", s.maxDecompressedBytes))
+			return
+		}
+		decoded, decErr := snappy.Decode(nil, body)
+		if decErr != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid snappy body")
+			return
+		}
+		streams, err = decodeLokiProto(decoded)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid push request: "+err.Error())
+		return
+	}
+
+	// Validate entries one by one, as /ingest/batch does, so a bad line is reported
+	// instead of failing the push; assembly then only sees lines that will be stored
+	var accepted []LogEvent
+	var rejected []lokiRejection
+	i := 0
+	for si, stream := range streams {
+		for ei, entry := range stream.Entries {
+			evt := lokiToEvent(stream.Labels, entry)
+			if err := validateEvent(&evt); err != nil {
+				rejected = append(rejected, lokiRejection{Index: i, Stream: si, Entry: ei, Error: err.Error()})
+			} else {
+				accepted = append(accepted, evt)
+			}
+			i++
+		}
+	}
+
+	events := s.multiline.assemble(accepted)
+	if err := s.pipeline.Enqueue(events, nil); err != nil {
+		s.pipeline.writeQueueFull(w, err)
+		return
+	}
+
+	log.Printf("✅ QUEUED LOKI PUSH: streams=%d, entries=%d, rejected=%d", len(streams), len(accepted), len(rejected))
+	if len(rejected) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	status := "partial"
+	code := http.StatusMultiStatus
+	if len(accepted) == 0 {
+		status = "failed"
+		code = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   status,
+		"accepted": len(accepted),
+		"rejected": rejected,
+	})
+}
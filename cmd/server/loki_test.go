@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeLokiJSON(t *testing.T) {
+	streams, err := decodeLokiJSON([]byte(`{"streams":[{"stream":{"app":"api","level":"warn","pod":"api-1"},
+		"values":[["1700000000000000001","slow request",{"route":"/pay","level":"error"}],["1700000000500000000","second"]]}]}`))
+	if err != nil {
+		t.Fatalf("decodeLokiJSON: %v", err)
+	}
+	if len(streams) != 1 || len(streams[0].Entries) != 2 {
+		t.Fatalf("streams = %+v", streams)
+	}
+	entry := streams[0].Entries[0]
+	if entry.Line != "slow request" || entry.Timestamp.UnixNano() != 1700000000000000001 || entry.Metadata["route"] != "/pay" {
+		t.Errorf("entry = %+v", entry)
+	}
+
+	// Structured metadata wins over stream labels; unknown labels stay as metadata
+	evt := lokiToEvent(streams[0].Labels, entry)
+	if evt.Service != "api" || evt.Level != "ERROR" || evt.Route != "/pay" || evt.Metadata["pod"] != "api-1" || len(evt.Metadata) != 1 {
+		t.Errorf("event = %+v", evt)
+	}
+	if evt := lokiToEvent(streams[0].Labels, streams[0].Entries[1]); evt.Level != "WARNING" || evt.Timestamp != "2023-11-14T22:13:20.5Z" {
+		t.Errorf("second event = %+v", evt)
+	}
+	if evt := lokiToEvent(nil, lokiEntry{Line: "x"}); evt.Service != "unknown_service" || evt.Metadata != nil {
+		t.Errorf("unlabelled event = %+v", evt)
+	}
+
+	for _, body := range []string{
+		`{"streams":[{"values":[["1"]]}]}`,
+		`{"streams":[{"values":[[1,"x"]]}]}`,
+		`{"streams":[{"values":[["soon","x"]]}]}`,
+		`{"streams":[{"values":[["1",2]]}]}`,
+		`{"streams":[{"values":[["1","x",["meta"]]]}]}`,
+		`{"streams":`,
+	} {
+		if _, err := decodeLokiJSON([]byte(body)); err == nil {
+			t.Errorf("%s: decoded without error", body)
+		}
+	}
+}
+
+func TestDecodeLokiProto(t *testing.T) {
+	ts := pbVarint(pbVarint(nil, 1, 1700000000), 2, 250000000)
+	meta := pbBytes(pbBytes(nil, 1, []byte("trace")), 2, []byte("abc"))
+	entry := pbBytes(pbBytes(pbBytes(nil, 1, ts), 2, []byte("hello")), 3, meta)
+	stream := pbBytes(pbBytes(nil, 1, []byte(`{app="api", note="a \"quoted\" value"}`)), 2, entry)
+	streams, err := decodeLokiProto(pbBytes(nil, 1, stream))
+	if err != nil {
+		t.Fatalf("decodeLokiProto: %v", err)
+	}
+	if len(streams) != 1 || len(streams[0].Entries) != 1 {
+		t.Fatalf("streams = %+v", streams)
+	}
+	got := streams[0]
+	if got.Labels["app"] != "api" || got.Labels["note"] != `a "quoted" value` {
+		t.Errorf("labels = %v", got.Labels)
+	}
+	if e := got.Entries[0]; e.Line != "hello" || !e.Timestamp.Equal(time.Unix(1700000000, 250000000)) || e.Metadata["trace"] != "abc" {
+		t.Errorf("entry = %+v", e)
+	}
+
+	bad := pbBytes(nil, 1, pbBytes(nil, 1, []byte(`app="api"`)))
+	if _, err := decodeLokiProto(bad); err == nil {
+		t.Error("label set without braces accepted")
+	}
+	if _, err := decodeLokiProto([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Error("truncated request accepted")
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	labels, err := parseLokiLabels(` {job="varlogs", path="C:\\logs", empty=""} `)
+	if err != nil || labels["job"] != "varlogs" || labels["path"] != `C:\logs` || len(labels) != 3 {
+		t.Errorf("labels = %v, %v", labels, err)
+	}
+	if labels, err := parseLokiLabels("{}"); err != nil || len(labels) != 0 {
+		t.Errorf("empty set = %v, %v", labels, err)
+	}
+	for _, s := range []string{`job="x"`, `{job=x}`, `{="x"}`, `{job="x}`, `{job="\q"}`} {
+		if _, err := parseLokiLabels(s); err == nil {
+			t.Errorf("%s: parsed without error", s)
+		}
+	}
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib" // pgx driver
@@ -50,10 +52,10 @@ var (
 	stockRe    = regexp.MustCompile(`current_stock=(\d+)`)
 )
 
-func seedDB() {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM logs").Scan(&count)
-	if count > 0 {
+func seedDB(store LogStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if agg, _ := store.Aggregate(ctx, time.Time{}); agg.Total > 0 {
 		return
 	}
 
@@ -65,8 +67,11 @@ func seedDB() {
 		{Service: "auth-service", Level: "WARNING", Message: "Latency spike detected in session-store (320ms)", Timestamp: time.Now().Add(-5 * time.Minute).Format(time.RFC3339)},
 	}
 
-	for _, l := range initialLogs {
-		db.Exec("INSERT INTO logs (timestamp, service, level, message) VALUES ($1, $2, $3, $4)", l.Timestamp, l.Service, l.Level, l.Message)
+	for i := range initialLogs {
+		validateEvent(&initialLogs[i])
+	}
+	if err := store.Insert(ctx, initialLogs); err != nil {
+		log.Printf("❌ Error seeding database: %v", err)
 	}
 }
 
@@ -125,62 +130,36 @@ CRITICAL RULES:
 - Add line breaks between sections for readability`
 
 type LogEvent struct {
-	ID        int64                  `json:"id,omitempty"`
-	Service   string                 `json:"service"`
-	Level     string                 `json:"level"`
-	Message   string                 `json:"message"`
-	Timestamp string                 `json:"timestamp"`
-	Route     string                 `json:"route,omitempty"`
-	Metadata  map[string]interface{} `json:"metadata,omitempty"`
-	CreatedAt string                 `json:"created_at,omitempty"`
+	ID         int64                  `json:"id,omitempty"`
+	EventID    string                 `json:"event_id,omitempty"`
+	Service    string                 `json:"service"`
+	Level      string                 `json:"level"`
+	Severity   int                    `json:"severity,omitempty"`
+	Message    string                 `json:"message"`
+	Timestamp  string                 `json:"timestamp"`
+	Route      string                 `json:"route,omitempty"`
+	TraceID    string                 `json:"trace_id,omitempty"`
+	SpanID     string                 `json:"span_id,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	ReceivedAt string                 `json:"received_at,omitempty"`
+	CreatedAt  string                 `json:"created_at,omitempty"`
+	// Matched excerpts of Message, only in search responses
+	Highlights []string `json:"highlights,omitempty"`
 }
 
-var (
-	db           *sql.DB
-	geminiClient *ai.Client
-)
+var geminiClient *ai.Client
 
-func getLogsInTimeRange(startTime, endTime time.Time, limit int) []LogEvent {
+func (s *server) getLogsInTimeRange(ctx context.Context, startTime, endTime time.Time, limit int) []LogEvent {
 	// 🔍 DEBUG: Log the query range with full timestamp info
 	log.Printf("🔍 DB QUERY: %s → %s (UTC)", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
 	log.Printf("   Start: %v | End: %v", startTime.Unix(), endTime.Unix())
 
-	query := `
-        SELECT id, service, level, route, message, metadata, timestamp, created_at
-        FROM logs WHERE timestamp BETWEEN $1 AND $2 ORDER BY timestamp DESC LIMIT $3
-    `
-
-	rows, err := db.Query(query, startTime, endTime, limit)
+	logs, err := s.store.Range(ctx, startTime, endTime, limit)
 	if err != nil {
 		log.Printf("❌ Query error: %v", err)
 		return nil
 	}
-	defer rows.Close()
-
-	var logs []LogEvent
-	for rows.Next() {
-		var evt LogEvent
-		var metadataJSON []byte
-		var route sql.NullString
-		var ts, createdAt time.Time // ✅ DECLARE ALL FIRST
-
-		// ✅ FIXED ORDER: id, service, level, route, message, metadata, timestamp, created_at
-		err := rows.Scan(&evt.ID, &evt.Service, &evt.Level, &route, &evt.Message, &metadataJSON, &ts, &createdAt)
-		if err != nil {
-			log.Printf("❌ Scan error: %v", err)
-			continue
-		}
-
-		evt.Timestamp = ts.Format(time.RFC3339)
-		if route.Valid {
-			evt.Route = route.String
-		}
-		if len(metadataJSON) > 0 {
-			json.Unmarshal(metadataJSON, &evt.Metadata)
-		}
-		evt.CreatedAt = createdAt.Format(time.RFC3339)
-		logs = append(logs, evt)
-	}
 
 	// 📊 DEBUG: Report how many logs were found
 	log.Printf("📊 TOTAL LOGS in range [%s, %s]: %d", startTime.Format("15:04:05"), endTime.Format("15:04:05"), len(logs))
@@ -197,46 +176,7 @@ func formatLogsForAI(logs []LogEvent) string {
 	return sb.String()
 }
 
-// Initialize database connection
-func initDB() error {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		return fmt.Errorf("DATABASE_URL environment variable not set")
-	}
-
-	// Ensure simple protocol for pooled Postgres (transaction mode compatibility)
-	if parsedURL, err := url.Parse(dbURL); err == nil {
-		query := parsedURL.Query()
-		// pgx uses default_query_exec_mode instead of simple_protocol
-		if query.Get("default_query_exec_mode") == "" {
-			query.Set("default_query_exec_mode", "simple_protocol")
-			parsedURL.RawQuery = query.Encode()
-			dbURL = parsedURL.String()
-		}
-	}
-
-	var err error
-	// Use "pgx" driver
-	db, err = sql.Open("pgx", dbURL)
-	if err != nil {
-		return fmt.Errorf("error opening database: %w", err)
-	}
-
-	// Test connection
-	if err := db.Ping(); err != nil {
-		return fmt.Errorf("error connecting to database: %w", err)
-	}
-
-	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
-
-	log.Println("✅ Connected to Supabase PostgreSQL!")
-	return nil
-}
-
-func timeCompareHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) timeCompareHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "POST only", 405)
 		return
@@ -292,8 +232,8 @@ func timeCompareHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("   🟢 Healthy window: %s → %s", healthyStart.Format(time.RFC3339), healthyEnd.Format(time.RFC3339))
 	log.Printf("   🔴 Crash window:   %s → %s", crashStart.Format(time.RFC3339), crashEnd.Format(time.RFC3339))
 
-	healthyLogs := getLogsInTimeRange(healthyStart, healthyEnd, 25)
-	crashLogs := getLogsInTimeRange(crashStart, crashEnd, 25)
+	healthyLogs := s.getLogsInTimeRange(r.Context(), healthyStart, healthyEnd, 25)
+	crashLogs := s.getLogsInTimeRange(r.Context(), crashStart, crashEnd, 25)
 
 	log.Printf("✅ Query complete: healthy=%d logs, crash=%d logs", len(healthyLogs), len(crashLogs))
 
@@ -363,7 +303,7 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization, Last-Event-ID")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -395,14 +335,101 @@ func main() {
 		log.Println("⚠️  .env file not found, using system environment variables")
 	}
 
-	// Initialize database
-	if err := initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	// `server migrate up|down|status` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+
+	maxLogsPageSize = int(envInt64("LOGS_MAX_PAGE_SIZE", defaultMaxLogsPageSize))
+
+	// Open the log store (Postgres unless LOG_STORE says otherwise)
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("Failed to initialize log store: %v", err)
+	}
+	defer store.Close()
+	retention := newRetentionEnforcer(store)
+	tail := newTailBroker(
+		int(envInt64("TAIL_HISTORY", defaultTailHistory)),
+		envPositiveInt("TAIL_BUFFER", defaultTailBuffer),
+	)
+	app := &server{
+		store:                store,
+		retention:            retention,
+		tail:                 tail,
+		maxDecompressedBytes: envInt64("MAX_DECOMPRESSED_BYTES", defaultMaxDecompressedBytes),
+	}
+
+	// Aged partitions move to Parquet files; reads reaching back that far include them
+	archive, err := newArchiver(store)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	if archive != nil {
+		app.store = &archivedStore{LogStore: store, archive: archive}
+		retention.archive = archive
 	}
-	defer db.Close()
 
 	// Seed database if empty
-	seedDB()
+	seedDB(store)
+
+	// Duplicate deliveries within the horizon are acknowledged without being stored again
+	dedup := newDedupCache(
+		os.Getenv("DEDUP_MODE"),
+		envDuration("DEDUP_HORIZON", defaultDedupHorizon),
+		int(envInt64("DEDUP_MAX_KEYS", defaultDedupMaxKeys)),
+	)
+	dedup.warm(store)
+
+	// HEC ack ids of channels that stop polling are forgotten after HEC_ACK_TTL
+	app.hecAcks = newHECAckTracker(envDuration("HEC_ACK_TTL", defaultHECAckTTL))
+
+	// Open the write-ahead log so accepted events survive restarts and database outages
+	var wal *writeAheadLog
+	var walLeftover []walRecord
+	walDir := os.Getenv("WAL_DIR")
+	if walDir == "" {
+		walDir = defaultWALDir
+	}
+	if walDir != "off" {
+		wal, walLeftover, err = openWAL(walDir, envInt64("WAL_SEGMENT_BYTES", defaultWALSegmentBytes), envBool("WAL_FSYNC", true), int(envInt64("WAL_MAX_REPLAYS", defaultWALMaxReplays)))
+		if err != nil {
+			log.Fatalf("Failed to open WAL: %v", err)
+		}
+		log.Printf("✅ WAL opened at %s (%d batches to replay)", walDir, len(walLeftover))
+	} else {
+		log.Println("⚠️ WAL disabled, accepted events are lost if the server stops before they are written")
+	}
+
+	// Events the database refuses are set aside here instead of failing their whole batch
+	var deadLetters *deadLetterLog
+	deadLetterPath := os.Getenv("DEAD_LETTER_PATH")
+	if deadLetterPath == "" {
+		deadLetterPath = defaultDeadLetterPath
+	}
+	if deadLetterPath != "off" {
+		deadLetters, err = openDeadLetterLog(deadLetterPath)
+		if err != nil {
+			log.Fatalf("Failed to open dead-letter file: %v", err)
+		}
+	}
+
+	// Start the asynchronous write pipeline used by every ingest path
+	app.pipeline = newWritePipeline(
+		envPositiveInt("INGEST_QUEUE_SIZE", defaultQueueSize),
+		envPositiveInt("INGEST_WRITERS", defaultWriters),
+		envPositiveInt("INGEST_BATCH_SIZE", defaultBatchSize),
+		envDuration("INGEST_FLUSH_INTERVAL", defaultFlushInterval),
+		envDuration("INGEST_RETRY_AFTER", defaultRetryAfter),
+		wal,
+		deadLetters,
+		dedup,
+		store,
+		tail,
+	)
+	if wal != nil {
+		go replayWAL(wal, app.pipeline, walLeftover, envDuration("WAL_REPLAY_INTERVAL", defaultWALReplayInterval))
+	}
 
 	// Initialize Gemini client
 	apiKey := os.Getenv("GEMINI_API_KEY")
@@ -413,27 +440,54 @@ func main() {
 	log.Println("✅ Gemini AI client initialized")
 
 	// Register handlers
-	http.HandleFunc("/ingest", corsMiddleware(ingestHandler))
-	http.HandleFunc("/ai/compare", corsMiddleware(timeCompareHandler))
-	http.HandleFunc("/logs", corsMiddleware(logsHandler))
-	http.HandleFunc("/metrics", corsMiddleware(metricsHandler))
-	http.HandleFunc("/metrics/advanced", corsMiddleware(advancedMetricsHandler))
-	http.HandleFunc("/ai/query", corsMiddleware(aiQueryHandler))
-	http.HandleFunc("/ai/summary", corsMiddleware(aiSummaryHandler))
-	http.HandleFunc("/health", corsMiddleware(healthHandler))
-	http.HandleFunc("/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"message": "LogFlow API is running", "version": "1.0.0", "status": "active"}`)
-	}))
+	http.HandleFunc("/ingest", corsMiddleware(app.decompressMiddleware(app.ingestHandler)))
+	http.HandleFunc("/ingest/batch", corsMiddleware(app.decompressMiddleware(app.batchIngestHandler)))
+	http.HandleFunc("/v1/logs", corsMiddleware(app.decompressMiddleware(app.otlpLogsHandler)))
+	http.HandleFunc("/loki/api/v1/push", corsMiddleware(app.decompressMiddleware(app.lokiPushHandler)))
+	http.HandleFunc("/_bulk", corsMiddleware(app.decompressMiddleware(app.esBulkHandler)))
+	http.HandleFunc("/{index}/_bulk", corsMiddleware(app.decompressMiddleware(app.esBulkHandler)))
+	http.HandleFunc("/_license", corsMiddleware(esLicenseHandler))
+	http.HandleFunc("/services/collector", corsMiddleware(app.decompressMiddleware(app.hecEventHandler)))
+	http.HandleFunc("/services/collector/event", corsMiddleware(app.decompressMiddleware(app.hecEventHandler)))
+	http.HandleFunc("/services/collector/event/1.0", corsMiddleware(app.decompressMiddleware(app.hecEventHandler)))
+	http.HandleFunc("/services/collector/raw", corsMiddleware(app.decompressMiddleware(app.hecRawHandler)))
+	http.HandleFunc("/services/collector/raw/1.0", corsMiddleware(app.decompressMiddleware(app.hecRawHandler)))
+	http.HandleFunc("/services/collector/ack", corsMiddleware(app.hecAckHandler))
+	http.HandleFunc("/services/collector/health", corsMiddleware(hecHealthHandler))
+	http.HandleFunc("/ai/compare", corsMiddleware(app.timeCompareHandler))
+	http.HandleFunc("/logs", corsMiddleware(app.logsHandler))
+	http.HandleFunc("/logs/aggregate", corsMiddleware(app.logsAggregateHandler))
+	http.HandleFunc("/logs/tail", corsMiddleware(app.logsTailHandler))
+	http.HandleFunc("/query", corsMiddleware(app.queryHandler))
+	http.HandleFunc("/metrics", corsMiddleware(app.metricsHandler))
+	http.HandleFunc("/metrics/advanced", corsMiddleware(app.advancedMetricsHandler))
+	http.HandleFunc("/metrics/pipeline", corsMiddleware(app.pipelineMetricsHandler))
+	http.HandleFunc("/traces/{id}/logs", corsMiddleware(app.traceLogsHandler))
+	http.HandleFunc("/ai/query", corsMiddleware(app.aiQueryHandler))
+	http.HandleFunc("/ai/summary", corsMiddleware(app.aiSummaryHandler))
+	http.HandleFunc("/health", corsMiddleware(app.healthHandler))
+	http.HandleFunc("/retention/dry-run", corsMiddleware(app.retentionDryRunHandler))
+	http.HandleFunc("/", corsMiddleware(rootHandler))
 	http.HandleFunc("/api/compare", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/ai/compare?"+r.URL.RawQuery, http.StatusMovedPermanently)
 	}))
 	// Start background monitoring
-	go monitorErrorRate()
+	go monitorErrorRate(store)
+	retention.start()
+	if archive != nil {
+		archive.start()
+	}
+
+	// Event-time checks apply to every receiver
+	initClockSkew()
+
+	// Optional syslog and GELF listeners; their lines can be joined into multiline events
+	app.multiline = loadMultiline()
+	if app.multiline.enabled() {
+		app.lineStreams = newStreamAssembler(app.multiline, envDuration("MULTILINE_TIMEOUT", defaultMultilineTimeout), app.pipeline.Offer)
+	}
+	app.startSyslog()
+	app.startGELF()
 
 	// Handle dynamic port for deployment (Render, Railway, Cloud Run)
 	port := os.Getenv("PORT")
@@ -441,201 +495,150 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("🚀 LogFlow server listening on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	srv := &http.Server{Addr: ":" + port}
+	// Live tail streams never finish on their own; end them when shutdown starts
+	srv.RegisterOnShutdown(tail.Close)
+	go func() {
+		log.Printf("🚀 LogFlow server listening on :%s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On shutdown, stop taking requests and drain the write pipeline so accepted events are stored
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Println("🛑 Shutting down, draining write pipeline...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	if app.lineStreams != nil {
+		app.lineStreams.flush()
+	}
+	app.pipeline.Close()
+	if wal != nil {
+		wal.Close()
+	}
+	if deadLetters != nil {
+		deadLetters.Close()
+	}
 }
 
 // POST /ingest - Store log in database
-func ingestHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) ingestHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Content negotiation: NDJSON or a JSON array goes through the batch path
+	if isBatchRequest(r, body) {
+		s.ingestBatch(w, r, body)
+		return
+	}
+
 	var evt LogEvent
-	if err := json.NewDecoder(r.Body).Decode(&evt); err != nil {
+	if err := json.Unmarshal(body, &evt); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	// Set timestamp if not provided
-	if evt.Timestamp == "" {
-		evt.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	if evt.EventID == "" {
+		evt.EventID = r.Header.Get("Idempotency-Key")
 	}
+	applyTraceHeaders(r, &evt)
 
-	// Parse timestamp
-	ts, err := time.Parse(time.RFC3339, evt.Timestamp)
-	if err != nil {
-		http.Error(w, "Invalid timestamp format", http.StatusBadRequest)
+	if err := validateEvent(&evt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// 📝 DEBUG: Log ingestion details
-	log.Printf("📝 Ingesting log: Service=%s, Level=%s, Time=%s", evt.Service, evt.Level, ts.Format(time.RFC3339))
-
-	// Handle metadata - convert to JSONB or NULL
-	var metadataJSON interface{}
-	if len(evt.Metadata) > 0 {
-		metadataBytes, err := json.Marshal(evt.Metadata)
-		if err != nil {
-			log.Printf("⚠️ Invalid metadata, using NULL")
-			metadataJSON = nil // ✅ FALLBACK
-		} else {
-			metadataJSON = metadataBytes
-		}
-	} else {
-		metadataJSON = nil // ✅ MISSING = NULL (no error!)
-	}
-
-	// Insert into database
-	query := `
-		INSERT INTO logs (timestamp, service, level, route, message, metadata)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, created_at
-	`
-
-	var createdAt time.Time
-	err = db.QueryRow(
-		query,
-		ts,
-		evt.Service,
-		evt.Level,
-		sql.NullString{String: evt.Route, Valid: evt.Route != ""}, // Handle empty route
-		evt.Message,
-		metadataJSON,
-	).Scan(&evt.ID, &createdAt)
+	log.Printf("📝 Ingesting log: Service=%s, Level=%s, Time=%s", evt.Service, evt.Level, evt.Timestamp)
 
-	if err != nil {
-		log.Printf("❌ Error inserting log: %v", err)
-		http.Error(w, "Error storing log", http.StatusInternalServerError)
+	// Hand off to the write pipeline; a full queue means back off and retry.
+	// A repeated delivery gets the same answer, with the original event_id.
+	events := []LogEvent{evt}
+	if err := s.pipeline.Enqueue(events, nil); err != nil {
+		s.pipeline.writeQueueFull(w, err)
 		return
 	}
 
-	evt.CreatedAt = createdAt.Format(time.RFC3339)
-	log.Printf("✅ STORED: ID=%d, Service=%s, Level=%s", evt.ID, evt.Service, evt.Level)
-
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "success",
-		"id":     evt.ID,
+		"status":   "accepted",
+		"event_id": events[0].EventID,
 	})
 }
 
 // GET /metrics - System metrics
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Get counts by level in last 24 hours (Performance fix: avoid scanning entire history)
-	query := `
-		SELECT
-			level,
-			COUNT(*) as count
-		FROM logs
-		WHERE timestamp > NOW() - INTERVAL '24 hours'
-		GROUP BY level
-	`
-
-	rows, err := db.Query(query)
+	// Get counts by service and severity in last 24 hours (Performance fix: avoid scanning entire history)
+	agg, err := s.store.Aggregate(r.Context(), time.Now().Add(-24*time.Hour))
 	if err != nil {
 		http.Error(w, "Error querying metrics", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	metrics := make(map[string]int)
-	totalLogs := 0
+	totalLogs := agg.Total
 	errorLogs := 0
 	infoLogs := 0
 	warnLogs := 0
 
-	for rows.Next() {
-		var level string
-		var count int
-		rows.Scan(&level, &count)
-
-		// Handle both "WARN" and "WARNING"
-		normalizedLevel := level
-		if level == "WARN" {
-			normalizedLevel = "WARNING"
-		}
-
-		metrics[normalizedLevel] = count
-		totalLogs += count
-
-		if normalizedLevel == "ERROR" {
-			errorLogs = count
-		}
-		if normalizedLevel == "INFO" {
-			infoLogs = count
-		}
-		if normalizedLevel == "WARNING" {
-			warnLogs = count
+	for severity, count := range agg.BySeverity {
+		metrics[severityName(severity)] += count
+
+		// FATAL counts towards the error rate as well
+		switch {
+		case severity >= sevError:
+			errorLogs += count
+		case severity >= sevWarning:
+			warnLogs += count
+		case severity >= sevInfo:
+			infoLogs += count
 		}
 	}
 
 	// Get top services by error count in last 24 hours
-	serviceQuery := `
-		SELECT
-			service,
-			COUNT(*) as count
-		FROM logs
-		WHERE level = 'ERROR' AND timestamp > NOW() - INTERVAL '24 hours'
-		GROUP BY service
-		ORDER BY count DESC
-		LIMIT 5
-	`
-
-	rows2, err := db.Query(serviceQuery)
-	if err != nil {
-		http.Error(w, "Error querying services", http.StatusInternalServerError)
-		return
-	}
-	defer rows2.Close()
-
 	topServices := []map[string]interface{}{}
-	for rows2.Next() {
-		var service string
-		var count int
-		rows2.Scan(&service, &count)
+	for _, svc := range rankServices(agg.ErrorsByService, 5) {
 		status := "Online"
-		if count > 5 {
+		if svc.Count > 5 {
 			status = "Degraded"
 		}
 		topServices = append(topServices, map[string]interface{}{
-			"name":   service,
-			"errors": count,
+			"name":   svc.Service,
+			"errors": svc.Count,
 			"status": status,
 		})
 	}
 
 	// Get all healthy services in last 24 hours
-	allServicesQuery := `
-		SELECT DISTINCT service
-		FROM logs
-		WHERE timestamp > NOW() - INTERVAL '24 hours'
-		ORDER BY service ASC
-	`
-
-	rows3, err := db.Query(allServicesQuery)
-	if err != nil {
-		http.Error(w, "Error querying all services", http.StatusInternalServerError)
-		return
-	}
-	defer rows3.Close()
-
 	allServices := []map[string]interface{}{}
 	errorServiceNames := make(map[string]bool)
 	for _, svc := range topServices {
 		errorServiceNames[svc["name"].(string)] = true
 	}
 
-	for rows3.Next() {
-		var service string
-		rows3.Scan(&service)
+	serviceNames := make([]string, 0, len(agg.ByService))
+	for service := range agg.ByService {
+		serviceNames = append(serviceNames, service)
+	}
+	sort.Strings(serviceNames)
+	for _, service := range serviceNames {
 		if !errorServiceNames[service] {
 			allServices = append(allServices, map[string]interface{}{
 				"name":   service,
@@ -655,9 +658,7 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get unique services count in last 24 hours
-	uniqueServicesQuery := `SELECT COUNT(DISTINCT service) FROM logs WHERE timestamp > NOW() - INTERVAL '24 hours'`
-	var serviceCount int
-	db.QueryRow(uniqueServicesQuery).Scan(&serviceCount)
+	serviceCount := len(agg.ByService)
 
 	// Debug logging
 	log.Printf("DEBUG METRICS: errorLogs=%d, infoLogs=%d, warnLogs=%d, totalLogs=%d, errorRate=%d%%", errorLogs, infoLogs, warnLogs, totalLogs, errorRate)
@@ -668,6 +669,9 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 			"ERROR":   errorLogs,
 			"INFO":    infoLogs,
 			"WARNING": warnLogs,
+			"DEBUG":   metrics["DEBUG"],
+			"TRACE":   metrics["TRACE"],
+			"FATAL":   metrics["FATAL"],
 			"total":   totalLogs,
 		},
 		"error_rate":      errorRate,
@@ -686,25 +690,20 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Background job: Check error rate every minute
-func monitorErrorRate() {
+func monitorErrorRate(store LogStore) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		// Get error count in last 5 minutes
-		query := `
-			SELECT COUNT(*) as errors
-			FROM logs
-			WHERE level = 'ERROR'
-			AND timestamp > NOW() - INTERVAL '5 minutes'
-		`
-
-		var errorCount int
-		err := db.QueryRow(query).Scan(&errorCount)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		agg, err := store.Aggregate(ctx, time.Now().Add(-5*time.Minute))
+		cancel()
 		if err != nil {
 			log.Printf("Error checking error rate: %v", err)
 			continue
 		}
+		errorCount := agg.Count(sevError)
 
 		// Alert if > 10 errors in 5 min
 		if errorCount > 10 {
@@ -715,130 +714,140 @@ func monitorErrorRate() {
 }
 
 // GET /logs - Query logs from database
-func logsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) logsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse query parameters
-	serviceFilter := r.URL.Query().Get("service")
-	levelFilter := r.URL.Query().Get("level")
-	routeFilter := r.URL.Query().Get("route")
-	fromStr := r.URL.Query().Get("from")
-	toStr := r.URL.Query().Get("to")
-	limitStr := r.URL.Query().Get("limit")
-	if limitStr == "" {
-		limitStr = "100"
+	filter, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	// ✅ Convert limit to integer
-	limit := 100
-	if l, err := strconv.Atoi(limitStr); err == nil {
-		limit = l
+	// cursor=... continues from next_cursor or prev_cursor of an earlier page
+	var cursor *pageCursor
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		c, err := parsePageCursor(token)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cursor = &c
 	}
 
-	// Build query
-	query := `
-		SELECT id, timestamp, service, level, route, message, metadata, created_at
-		FROM logs
-		WHERE 1=1
-	`
-	args := []interface{}{}
-	argCount := 1
+	logs, next, prev, err := s.logsPage(r, filter, cursor)
+	if err != nil {
+		log.Printf("❌ Error querying logs: %v", err)
+		http.Error(w, "Error querying logs", http.StatusInternalServerError)
+		return
+	}
 
-	if serviceFilter != "" {
-		query += fmt.Sprintf(" AND service = $%d", argCount)
-		args = append(args, serviceFilter)
-		argCount++
+	// Apply PII scrubbing to sidebar logs as well
+	for i := range logs {
+		logs[i].Message = scrubPII(logs[i].Message)
+		// Highlight the scrubbed text, so excerpts never bring PII back
+		if filter.Search != nil {
+			logs[i].Highlights = filter.Search.highlight(logs[i].Message)
+		}
 	}
 
-	if levelFilter != "" {
-		query += fmt.Sprintf(" AND level = $%d", argCount)
-		args = append(args, levelFilter)
-		argCount++
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":       len(logs),
+		"logs":        logs,
+		"next_cursor": next,
+		"prev_cursor": prev,
+	})
+}
+
+// parseLogFilter reads the filter parameters shared by /logs and /logs/aggregate
+func parseLogFilter(q url.Values) (LogFilter, error) {
+	filter := LogFilter{
+		Service:   q.Get("service"),
+		EventID:   q.Get("event_id"),
+		TraceID:   normalizeTraceID(q.Get("trace_id")),
+		RequestID: q.Get("request_id"),
+		Route:     q.Get("route"),
 	}
+	fromStr := q.Get("from")
+	toStr := q.Get("to")
 
-	if routeFilter != "" {
-		query += fmt.Sprintf(" AND route = $%d", argCount)
-		args = append(args, routeFilter)
-		argCount++
+	// ✅ Convert limit to integer, capped at the maximum page size
+	filter.Limit = defaultLogsPageSize
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		filter.Limit = min(l, maxLogsPageSize)
+	}
+
+	// level=ERROR, level>=WARNING, min_level=... compare on the stored severity
+	levelFilters, err := parseLevelFilters(q)
+	if err != nil {
+		return filter, err
+	}
+	filter.Levels = levelFilters
+
+	// metadata.<path>=... compare values inside the metadata JSON
+	if filter.Matchers, err = parseMetadataFilters(q); err != nil {
+		return filter, err
+	}
+
+	// q=... full-text search over the message
+	if text := q.Get("q"); text != "" {
+		if filter.Search, err = parseSearchQuery(text); err != nil {
+			return filter, err
+		}
 	}
 
 	if fromStr != "" {
-		if fromTime, err := time.Parse(time.RFC3339, fromStr); err == nil {
-			query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-			args = append(args, fromTime)
-			argCount++
+		if fromTime, err := parseEventTime(fromStr); err == nil {
+			filter.From = fromTime
 		}
 	}
 
 	if toStr != "" {
-		if toTime, err := time.Parse(time.RFC3339, toStr); err == nil {
-			query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-			args = append(args, toTime)
-			argCount++
+		if toTime, err := parseEventTime(toStr); err == nil {
+			filter.To = toTime
 		}
 	}
+	return filter, nil
+}
 
-	query += " ORDER BY timestamp DESC"
-	query += fmt.Sprintf(" LIMIT $%d", argCount)
-	args = append(args, limit)
+// GET /logs/aggregate - Count logs matching the /logs filters, grouped by fields and time buckets
+func (s *server) logsAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Execute query
-	rows, err := db.Query(query, args...)
+	filter, err := parseLogFilter(r.URL.Query())
 	if err != nil {
-		log.Printf("❌ Error querying logs: %v", err)
-		http.Error(w, "Error querying logs", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
-
-	// Parse results
-	var logs []LogEvent
-	for rows.Next() {
-		var evt LogEvent
-		var timestamp, createdAt time.Time
-		var metadataJSON []byte
-		var route sql.NullString
-
-		err := rows.Scan(
-			&evt.ID,
-			&timestamp,
-			&evt.Service,
-			&evt.Level,
-			&route,
-			&evt.Message,
-			&metadataJSON,
-			&createdAt,
-		)
-		if err != nil {
-			log.Printf("❌ Error scanning row: %v", err)
-			continue
-		}
-
-		evt.Timestamp = timestamp.Format(time.RFC3339)
-		evt.CreatedAt = createdAt.Format(time.RFC3339)
 
-		if route.Valid {
-			evt.Route = route.String
+	// by=service,metadata.user_id groups by columns and metadata keys
+	var by []logField
+	if raw := r.URL.Query().Get("by"); raw != "" {
+		for _, name := range strings.Split(raw, ",") {
+			field, err := parseLogField(strings.TrimSpace(name))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			by = append(by, field)
 		}
+	}
 
-		if len(metadataJSON) > 0 {
-			json.Unmarshal(metadataJSON, &evt.Metadata)
+	var step time.Duration
+	if raw := r.URL.Query().Get("step"); raw != "" {
+		if step, err = parseLongDuration(raw); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid step %q", raw))
+			return
 		}
-
-		// Apply PII scrubbing to sidebar logs as well
-		evt.Message = scrubPII(evt.Message)
-
-		logs = append(logs, evt)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"count": len(logs),
-		"logs":  logs,
-	})
+	s.writeCounts(w, r, filter, by, step)
 }
 
 // AI Query Handler
@@ -861,7 +870,7 @@ type AIQueryResponse struct {
 	Services     []string   `json:"services"`
 }
 
-func aiQueryHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) aiQueryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -914,51 +923,17 @@ func aiQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("   Time window: %s (%s to %s)", timeDesc, fromTime.Format("15:04"), toTime.Format("15:04"))
 
-	query := `
-		SELECT id, timestamp, service, level, route, message, metadata, created_at
-		FROM logs
-		WHERE timestamp BETWEEN $1 AND $2
-		ORDER BY timestamp DESC
-		LIMIT 100
-	`
-	args := []interface{}{fromTime, toTime}
-
-	rows, err := db.Query(query, args...)
+	logs, err := s.store.Range(r.Context(), fromTime, toTime, 100)
 	if err != nil {
 		log.Printf("❌ Error querying logs: %v", err)
 		http.Error(w, "Error querying logs", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	var relevantLogs []LogEvent
 	context := ""
 
-	for rows.Next() {
-		var evt LogEvent
-		var timestamp, createdAt time.Time
-		var metadataJSON []byte
-		var route sql.NullString
-
-		err := rows.Scan(
-			&evt.ID,
-			&timestamp,
-			&evt.Service,
-			&evt.Level,
-			&route,
-			&evt.Message,
-			&metadataJSON,
-			&createdAt,
-		)
-		if err != nil {
-			continue
-		}
-
-		evt.Timestamp = timestamp.Format(time.RFC3339)
-		if route.Valid {
-			evt.Route = route.String
-		}
-
+	for _, evt := range logs {
 		relevantLogs = append(relevantLogs, evt)
 		scrubbedMsg := scrubPII(evt.Message)
 		context += fmt.Sprintf("[%s] ID:%d Service: %s, Level: %s, Message: %s\n",
@@ -969,7 +944,7 @@ func aiQueryHandler(w http.ResponseWriter, r *http.Request) {
 	errorCount := 0
 	serviceMap := make(map[string]bool)
 	for _, log := range relevantLogs {
-		if log.Level == "ERROR" {
+		if log.Level == "ERROR" || log.Level == "FATAL" {
 			errorCount++
 		}
 		serviceMap[log.Service] = true
@@ -1044,51 +1019,27 @@ type AISummaryResponse struct {
 	TopServices  map[string]int `json:"top_services"`
 }
 
-func aiSummaryHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) aiSummaryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Get statistics from database
-	statsQuery := `
-		SELECT
-			COUNT(*) as total,
-			COUNT(CASE WHEN level = 'ERROR' THEN 1 END) as errors,
-			COUNT(CASE WHEN level = 'WARN' OR level = 'WARNING' THEN 1 END) as warnings,
-			COUNT(CASE WHEN level = 'INFO' THEN 1 END) as info
-		FROM logs
-	`
-
-	var totalLogs, errorCount, warningCount, infoCount int
-	err := db.QueryRow(statsQuery).Scan(&totalLogs, &errorCount, &warningCount, &infoCount)
+	agg, err := s.store.Aggregate(r.Context(), time.Time{})
 	if err != nil {
 		http.Error(w, "Error getting statistics", http.StatusInternalServerError)
 		return
 	}
+	totalLogs := agg.Total
+	errorCount := agg.Count(sevError)
+	warningCount := agg.BySeverity[sevWarning]
+	infoCount := agg.BySeverity[sevInfo]
 
 	// Get top services
-	serviceQuery := `
-		SELECT service, COUNT(*) as count
-		FROM logs
-		GROUP BY service
-		ORDER BY count DESC
-		LIMIT 5
-	`
-
-	rows, err := db.Query(serviceQuery)
-	if err != nil {
-		http.Error(w, "Error querying services", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
 	topServices := make(map[string]int)
-	for rows.Next() {
-		var service string
-		var count int
-		rows.Scan(&service, &count)
-		topServices[service] = count
+	for _, svc := range rankServices(agg.ByService, 5) {
+		topServices[svc.Service] = svc.Count
 	}
 
 	context := fmt.Sprintf(`Log Statistics:
@@ -1131,8 +1082,8 @@ Top Services:`, totalLogs, errorCount, warningCount, infoCount)
 }
 
 // Health check endpoint
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	if err := db.Ping(); err != nil {
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.Ping(r.Context()); err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status":   "unhealthy",
@@ -1149,19 +1100,12 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Advanced metrics handler - extract structured data from log messages
-func advancedMetricsHandler(w http.ResponseWriter, r *http.Request) {
-	query := `
-		SELECT message, level, service FROM logs 
-		WHERE message IS NOT NULL 
-		ORDER BY created_at DESC LIMIT 10000
-	`
-
-	rows, err := db.Query(query)
+func (s *server) advancedMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	logs, err := s.store.Query(r.Context(), LogFilter{Limit: 10000})
 	if err != nil {
 		http.Error(w, "Error querying logs", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	userIDs := make(map[string]int)
 	orderIDs := make(map[string]int)
@@ -1171,9 +1115,8 @@ func advancedMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	attemptCounts := []int{}
 	stockLevels := []int{}
 
-	for rows.Next() {
-		var message, level, service string
-		rows.Scan(&message, &level, &service)
+	for _, evt := range logs {
+		message := evt.Message
 
 		// Extract user_id
 		if matches := userRe.FindStringSubmatch(message); len(matches) > 1 {
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps logs in process memory. It implements the same semantics as
+// postgresStore, so handlers behave the same without a database.
+type memoryStore struct {
+	mu     sync.RWMutex
+	nextID int64
+	rows   []memoryRow // ordered by (ts, id)
+	// Stored events by (event_id, timestamp), the unique key postgresStore enforces
+	eventKeys map[memoryEventKey]struct{}
+}
+
+type memoryEventKey struct {
+	id string
+	ts time.Time
+}
+
+type memoryRow struct {
+	evt     LogEvent
+	ts      time.Time
+	created time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{eventKeys: map[memoryEventKey]struct{}{}}
+}
+
+func (s *memoryStore) Insert(ctx context.Context, events []LogEvent) error {
+	rows := make([]memoryRow, len(events))
+	now := time.Now().UTC()
+	for i, evt := range events {
+		ts, err := parseEventTime(evt.Timestamp)
+		if err != nil {
+			return fmt.Errorf("event %d: invalid timestamp: %w", i, err)
+		}
+		evt.Timestamp = formatEventTime(ts)
+		evt.CreatedAt = now.Format(time.RFC3339)
+		evt.Metadata = copyMetadata(evt.Metadata)
+		rows[i] = memoryRow{evt: evt, ts: ts, created: now}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Events already stored are skipped, as ON CONFLICT DO NOTHING does
+	fresh := make([]memoryRow, 0, len(rows))
+	for i, row := range rows {
+		// Like postgresStore, hand the id and created_at back, or ID 0 when skipped
+		events[i].ID, events[i].CreatedAt = 0, ""
+		if row.evt.EventID != "" {
+			key := memoryEventKey{id: row.evt.EventID, ts: row.ts}
+			if _, ok := s.eventKeys[key]; ok {
+				continue
+			}
+			s.eventKeys[key] = struct{}{}
+		}
+		s.nextID++
+		row.evt.ID = s.nextID
+		events[i].ID, events[i].CreatedAt = row.evt.ID, row.evt.CreatedAt
+		fresh = append(fresh, row)
+	}
+	start := len(s.rows)
+	s.rows = append(s.rows, fresh...)
+	// Producers mostly send in order, so only re-sort when a row lands out of place
+	for i := max(start, 1); i < len(s.rows); i++ {
+		if s.rows[i].before(s.rows[i-1]) {
+			sort.SliceStable(s.rows, func(i, j int) bool {
+				return s.rows[i].before(s.rows[j])
+			})
+			break
+		}
+	}
+	return nil
+}
+
+func (r memoryRow) before(o memoryRow) bool {
+	if !r.ts.Equal(o.ts) {
+		return r.ts.Before(o.ts)
+	}
+	return r.evt.ID < o.evt.ID
+}
+
+func (s *memoryStore) Range(ctx context.Context, from, to time.Time, limit int) ([]LogEvent, error) {
+	return s.Query(ctx, LogFilter{From: from, To: to, Limit: limit})
+}
+
+func (s *memoryStore) Query(ctx context.Context, f LogFilter) ([]LogEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	logs := []LogEvent{}
+	for i := range s.rows {
+		// Walk from the requested end so the limit keeps the right events
+		row := &s.rows[len(s.rows)-1-i]
+		if f.Ascending {
+			row = &s.rows[i]
+		}
+		if !f.matches(row) {
+			continue
+		}
+		evt := row.evt
+		evt.Metadata = copyMetadata(evt.Metadata)
+		logs = append(logs, evt)
+		if f.Limit > 0 && len(logs) == f.Limit {
+			break
+		}
+	}
+	return logs, nil
+}
+
+// matches applies the filter the way the SQL WHERE clause does
+func (f LogFilter) matches(row *memoryRow) bool {
+	evt := &row.evt
+	switch {
+	case f.Service != "" && evt.Service != f.Service,
+		f.Route != "" && evt.Route != f.Route,
+		f.EventID != "" && evt.EventID != f.EventID,
+		f.TraceID != "" && evt.TraceID != f.TraceID,
+		f.RequestID != "" && evt.RequestID != f.RequestID,
+		!f.From.IsZero() && row.ts.Before(f.From),
+		!f.To.IsZero() && row.ts.After(f.To),
+		f.Cursor != nil && !f.Cursor.beyond(row, f.Ascending):
+		return false
+	}
+	for _, lf := range f.Levels {
+		if !lf.matches(evt.Severity) {
+			return false
+		}
+	}
+	for _, m := range f.Matchers {
+		if !m.matches(evt) {
+			return false
+		}
+	}
+	return f.Search == nil || f.Search.matches(evt.Message)
+}
+
+func (s *memoryStore) Count(ctx context.Context, f LogFilter, by []logField, step time.Duration) ([]logCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counter := newLogCounter(by, step)
+	for i := range s.rows {
+		if f.matches(&s.rows[i]) {
+			counter.add(&s.rows[i].evt, s.rows[i].ts)
+		}
+	}
+	return counter.result(), nil
+}
+
+func (s *memoryStore) Aggregate(ctx context.Context, since time.Time) (LogAggregate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agg := newLogAggregate()
+	for i := range s.rows {
+		if since.IsZero() || s.rows[i].ts.After(since) {
+			agg.add(s.rows[i].evt.Service, s.rows[i].evt.Severity, 1)
+		}
+	}
+	return agg, nil
+}
+
+func (s *memoryStore) RecentEventIDs(ctx context.Context, since time.Time, limit int) ([]storedEventID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []storedEventID
+	for i := range s.rows {
+		if row := s.rows[i]; row.evt.EventID != "" && row.created.After(since) {
+			ids = append(ids, storedEventID{ID: row.evt.EventID, Stored: row.created})
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool { return ids[i].Stored.After(ids[j].Stored) })
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) CountExpired(ctx context.Context, scope retentionScope) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int64
+	for i := range s.rows {
+		if scope.matches(&s.rows[i].evt, s.rows[i].ts) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) DeleteExpired(ctx context.Context, scope retentionScope, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	kept := s.rows[:0]
+	for _, row := range s.rows {
+		if (limit <= 0 || n < int64(limit)) && scope.matches(&row.evt, row.ts) {
+			delete(s.eventKeys, memoryEventKey{id: row.evt.EventID, ts: row.ts})
+			n++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	// Clear the tail so removed events can be collected
+	clear(s.rows[len(kept):])
+	s.rows = kept
+	return n, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// copyMetadata keeps callers from mutating stored events through shared maps
+func copyMetadata(metadata map[string]interface{}) map[string]interface{} {
+	if metadata == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versioned schema migrations, NNNN_name.up.sql with a matching .down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Key for pg_advisory_xact_lock, so replicas starting together apply each migration once
+const migrationLockKey = 0x4c6f67466c6f77 // "LogFlow"
+
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// appliedMigration is one row of schema_migrations
+type appliedMigration struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the embedded migrations in version order
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*migration{}
+	for _, entry := range entries {
+		file := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or .down.sql", file)
+		}
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version %q", file, num)
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + file)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func ensureMigrationsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	return err
+}
+
+// appliedMigrations returns schema_migrations by version
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int64]appliedMigration, error) {
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.Version] = a
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration and returns how many ran.
+//
+// Each migration runs in its own transaction holding a transaction-level advisory
+// lock, and re-checks schema_migrations once it has the lock: a replica that lost
+// the race finds the version applied and skips it. Transaction-level locks also
+// work through transaction-mode poolers, where session locks would not.
+func migrateUp(ctx context.Context, db *sql.DB) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return 0, fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	ran := 0
+	for _, m := range migrations {
+		applied, err := runMigration(ctx, db, m, true)
+		if err != nil {
+			return ran, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if applied {
+			log.Printf("✅ Applied migration %04d_%s", m.Version, m.Name)
+			ran++
+		}
+	}
+	return ran, nil
+}
+
+// migrateDown rolls back the last n applied migrations
+func migrateDown(ctx context.Context, db *sql.DB, n int) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	ran := 0
+	for i := len(migrations) - 1; i >= 0 && ran < n; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return ran, fmt.Errorf("migration %04d_%s has no down script", m.Version, m.Name)
+		}
+		if _, err := runMigration(ctx, db, m, false); err != nil {
+			return ran, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("↩️ Rolled back migration %04d_%s", m.Version, m.Name)
+		ran++
+	}
+	return ran, nil
+}
+
+// runMigration applies (up) or reverts (down) one migration under the lock.
+// It reports false when another process already did it.
+func runMigration(ctx context.Context, db *sql.DB, m migration, up bool) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(migrationLockKey)); err != nil {
+		return false, fmt.Errorf("error taking migration lock: %w", err)
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.Version).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists == up {
+		return false, nil
+	}
+
+	if up {
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return false, err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+	} else {
+		if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+			return false, err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// pendingMigrations lists the migrations not yet applied
+func pendingMigrations(ctx context.Context, db *sql.DB) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// prepareSchema runs at startup: with AUTO_MIGRATE (the default) it applies pending
+// migrations, otherwise it only warns about them
+func prepareSchema(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if !envBool("AUTO_MIGRATE", true) {
+		pending, err := pendingMigrations(ctx, db)
+		if err != nil {
+			return fmt.Errorf("error checking migrations: %w", err)
+		}
+		if len(pending) > 0 {
+			log.Printf("⚠️ %d schema migrations pending and AUTO_MIGRATE is off; run `server migrate up`", len(pending))
+		}
+		return nil
+	}
+
+	ran, err := migrateUp(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error applying migrations: %w", err)
+	}
+	if ran == 0 {
+		log.Println("✅ Database schema up to date")
+	}
+	return nil
+}
+
+// runMigrateCommand implements `server migrate up|down [n]|status` and returns the exit code
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: server migrate up | down [n] | status")
+		return 2
+	}
+
+	db, err := openPostgres(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		ran, err := migrateUp(ctx, db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		fmt.Printf("Applied %d migrations\n", ran)
+
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "❌ invalid migration count %q\n", args[1])
+				return 2
+			}
+		}
+		ran, err := migrateDown(ctx, db, n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		fmt.Printf("Rolled back %d migrations\n", ran)
+
+	case "status":
+		migrations, err := loadMigrations()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		applied, err := appliedMigrations(ctx, db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		for _, m := range migrations {
+			if a, ok := applied[m.Version]; ok {
+				fmt.Printf("%04d_%-28s applied %s\n", m.Version, m.Name, a.AppliedAt.Format(time.RFC3339))
+				delete(applied, m.Version)
+			} else {
+				fmt.Printf("%04d_%-28s pending\n", m.Version, m.Name)
+			}
+		}
+		// Versions recorded by a newer binary
+		for _, a := range applied {
+			fmt.Printf("%04d_%-28s applied %s (unknown to this build)\n", a.Version, a.Name, a.AppliedAt.Format(time.RFC3339))
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q (want up, down or status)\n", args[0])
+		return 2
+	}
+	return 0
+}
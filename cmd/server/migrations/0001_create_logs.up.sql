@@ -0,0 +1,13 @@
+-- Base table. IF NOT EXISTS lets databases that were set up by hand adopt the migrations.
+CREATE TABLE IF NOT EXISTS logs (
+	id BIGSERIAL PRIMARY KEY,
+	timestamp TIMESTAMPTZ NOT NULL,
+	service TEXT NOT NULL,
+	level TEXT NOT NULL,
+	route TEXT,
+	message TEXT NOT NULL,
+	metadata JSONB,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS logs_timestamp_idx ON logs (timestamp);
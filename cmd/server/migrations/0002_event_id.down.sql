@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS logs_event_id_idx;
+ALTER TABLE logs DROP COLUMN IF EXISTS event_id;
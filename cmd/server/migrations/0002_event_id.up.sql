@@ -0,0 +1,3 @@
+-- Client-supplied or server-assigned id used for idempotent ingestion
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS event_id TEXT;
+CREATE INDEX IF NOT EXISTS logs_event_id_idx ON logs (event_id) WHERE event_id IS NOT NULL;
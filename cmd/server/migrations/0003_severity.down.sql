@@ -0,0 +1,3 @@
+-- Levels stay in canonical form; the original spellings are not recoverable
+DROP INDEX IF EXISTS logs_severity_timestamp_idx;
+ALTER TABLE logs DROP COLUMN IF EXISTS severity;
@@ -0,0 +1,20 @@
+-- Canonical severity for range comparisons; older rows are backfilled from their level string
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS severity SMALLINT;
+
+UPDATE logs SET severity = CASE
+	WHEN UPPER(TRIM(level)) IN ('TRACE', 'TRC', 'FINEST', 'FINER') THEN 1
+	WHEN UPPER(TRIM(level)) IN ('DEBUG', 'DBG', 'FINE', 'VERBOSE') THEN 5
+	WHEN UPPER(TRIM(level)) IN ('INFO', 'INF', 'INFORMATION', 'INFORMATIONAL', 'NOTICE', 'LOG', 'CONFIG') THEN 9
+	WHEN UPPER(TRIM(level)) IN ('WARNING', 'WARN', 'WRN') THEN 13
+	WHEN UPPER(TRIM(level)) IN ('ERROR', 'ERR', 'SEVERE', 'EXCEPTION') THEN 17
+	WHEN UPPER(TRIM(level)) IN ('FATAL', 'CRITICAL', 'CRIT', 'ALERT', 'EMERGENCY', 'EMERG', 'PANIC') THEN 21
+	ELSE 9
+END
+WHERE severity IS NULL;
+
+UPDATE logs SET level = CASE
+	WHEN severity >= 21 THEN 'FATAL' WHEN severity >= 17 THEN 'ERROR' WHEN severity >= 13 THEN 'WARNING'
+	WHEN severity >= 9 THEN 'INFO' WHEN severity >= 5 THEN 'DEBUG' ELSE 'TRACE' END
+WHERE level NOT IN ('TRACE', 'DEBUG', 'INFO', 'WARNING', 'ERROR', 'FATAL');
+
+CREATE INDEX IF NOT EXISTS logs_severity_timestamp_idx ON logs (severity, timestamp);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS logs_request_id_idx;
+DROP INDEX IF EXISTS logs_trace_id_idx;
+ALTER TABLE logs DROP COLUMN IF EXISTS request_id;
+ALTER TABLE logs DROP COLUMN IF EXISTS span_id;
+ALTER TABLE logs DROP COLUMN IF EXISTS trace_id;
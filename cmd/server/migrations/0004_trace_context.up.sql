@@ -0,0 +1,6 @@
+-- Trace context for cross-service correlation
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS trace_id TEXT;
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS span_id TEXT;
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS request_id TEXT;
+CREATE INDEX IF NOT EXISTS logs_trace_id_idx ON logs (trace_id, timestamp) WHERE trace_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS logs_request_id_idx ON logs (request_id) WHERE request_id IS NOT NULL;
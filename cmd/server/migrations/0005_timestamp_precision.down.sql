@@ -0,0 +1,2 @@
+ALTER TABLE logs DROP COLUMN IF EXISTS received_at;
+ALTER TABLE logs DROP COLUMN IF EXISTS timestamp_nanos;
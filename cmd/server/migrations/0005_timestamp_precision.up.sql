@@ -0,0 +1,3 @@
+-- Nanosecond ordering (TIMESTAMPTZ stops at microseconds) and the server receive time
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS timestamp_nanos SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE logs ADD COLUMN IF NOT EXISTS received_at TIMESTAMPTZ;
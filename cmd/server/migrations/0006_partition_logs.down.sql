@@ -0,0 +1,23 @@
+-- Back to a plain table holding the rows of every attached partition. Partitions
+-- detached by the partition manager are left alone.
+ALTER TABLE logs RENAME TO logs_partitioned;
+CREATE TABLE logs (LIKE logs_partitioned INCLUDING DEFAULTS);
+INSERT INTO logs SELECT * FROM logs_partitioned;
+
+DO $$
+DECLARE
+	seq TEXT := pg_get_serial_sequence('logs_partitioned', 'id');
+BEGIN
+	IF seq IS NOT NULL THEN
+		EXECUTE format('ALTER SEQUENCE %s OWNED BY logs.id', seq);
+	END IF;
+END $$;
+
+DROP TABLE logs_partitioned;
+
+ALTER TABLE logs ADD PRIMARY KEY (id);
+CREATE INDEX logs_timestamp_idx ON logs (timestamp);
+CREATE INDEX logs_event_id_idx ON logs (event_id) WHERE event_id IS NOT NULL;
+CREATE INDEX logs_severity_timestamp_idx ON logs (severity, timestamp);
+CREATE INDEX logs_trace_id_idx ON logs (trace_id, timestamp) WHERE trace_id IS NOT NULL;
+CREATE INDEX logs_request_id_idx ON logs (request_id) WHERE request_id IS NOT NULL;
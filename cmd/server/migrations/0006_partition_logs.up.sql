@@ -0,0 +1,36 @@
+-- Range-partition logs by day on timestamp. The existing table becomes the first
+-- partition, covering everything up to the end of the current UTC day (or of its
+-- newest row); the partition manager creates the daily partitions that follow.
+ALTER TABLE logs RENAME TO logs_p_initial;
+ALTER INDEX IF EXISTS logs_pkey RENAME TO logs_p_initial_pkey;
+ALTER INDEX IF EXISTS logs_timestamp_idx RENAME TO logs_p_initial_timestamp_idx;
+ALTER INDEX IF EXISTS logs_event_id_idx RENAME TO logs_p_initial_event_id_idx;
+ALTER INDEX IF EXISTS logs_severity_timestamp_idx RENAME TO logs_p_initial_severity_timestamp_idx;
+ALTER INDEX IF EXISTS logs_trace_id_idx RENAME TO logs_p_initial_trace_id_idx;
+ALTER INDEX IF EXISTS logs_request_id_idx RENAME TO logs_p_initial_request_id_idx;
+
+-- A partitioned table's primary key must include the partition key
+CREATE TABLE logs (LIKE logs_p_initial INCLUDING DEFAULTS) PARTITION BY RANGE (timestamp);
+ALTER TABLE logs ADD PRIMARY KEY (id, timestamp);
+CREATE INDEX logs_timestamp_idx ON logs (timestamp);
+CREATE INDEX logs_event_id_idx ON logs (event_id) WHERE event_id IS NOT NULL;
+CREATE INDEX logs_severity_timestamp_idx ON logs (severity, timestamp);
+CREATE INDEX logs_trace_id_idx ON logs (trace_id, timestamp) WHERE trace_id IS NOT NULL;
+CREATE INDEX logs_request_id_idx ON logs (request_id) WHERE request_id IS NOT NULL;
+
+DO $$
+DECLARE
+	cutover TIMESTAMPTZ;
+	seq TEXT := pg_get_serial_sequence('logs_p_initial', 'id');
+BEGIN
+	SELECT (date_trunc('day', GREATEST(MAX(timestamp), NOW()) AT TIME ZONE 'UTC') AT TIME ZONE 'UTC') + INTERVAL '1 day'
+	INTO cutover FROM logs_p_initial;
+	EXECUTE format('ALTER TABLE logs ATTACH PARTITION logs_p_initial FOR VALUES FROM (MINVALUE) TO (%L)', cutover);
+	-- The id sequence must outlive the initial partition
+	IF seq IS NOT NULL THEN
+		EXECUTE format('ALTER SEQUENCE %s OWNED BY logs.id', seq);
+	END IF;
+END $$;
+
+-- Catches events no daily partition covers yet, such as far-future timestamps
+CREATE TABLE logs_default PARTITION OF logs DEFAULT;
@@ -0,0 +1,3 @@
+-- pg_trgm stays installed; other schemas may rely on it
+DROP INDEX IF EXISTS logs_message_trgm_idx;
+DROP INDEX IF EXISTS logs_message_fts_idx;
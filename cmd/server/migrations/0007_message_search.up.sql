@@ -0,0 +1,6 @@
+-- Full-text search over message (the `q` parameter on /logs): a GIN index on the
+-- word vector for terms, prefixes and phrases, and a trigram index for substrings.
+-- Both are declared on the partitioned table, so every partition gets them.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS logs_message_fts_idx ON logs USING GIN (to_tsvector('simple', message));
+CREATE INDEX IF NOT EXISTS logs_message_trgm_idx ON logs USING GIN (message gin_trgm_ops);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS logs_metadata_idx;
@@ -0,0 +1,5 @@
+-- metadata.<path> filters on /logs: equality and in-lists compile to containment
+-- (metadata @> ...), existence and numeric comparisons to jsonpath (metadata @? ...).
+-- The default jsonb_ops class serves both. Declared on the partitioned table, so
+-- every partition gets it.
+CREATE INDEX IF NOT EXISTS logs_metadata_idx ON logs USING GIN (metadata);
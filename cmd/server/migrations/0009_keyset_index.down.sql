@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS logs_timestamp_idx ON logs (timestamp);
+DROP INDEX IF EXISTS logs_keyset_idx;
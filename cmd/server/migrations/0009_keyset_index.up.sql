@@ -0,0 +1,5 @@
+-- Cursor pages on /logs seek by (timestamp, timestamp_nanos, id) in either
+-- direction; this index serves that row comparison and the matching ORDER BY.
+-- It covers everything logs_timestamp_idx did, which it replaces.
+CREATE INDEX IF NOT EXISTS logs_keyset_idx ON logs (timestamp, timestamp_nanos, id);
+DROP INDEX IF EXISTS logs_timestamp_idx;
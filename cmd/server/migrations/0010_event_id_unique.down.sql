@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS logs_event_id_idx ON logs (event_id) WHERE event_id IS NOT NULL;
+DROP INDEX IF EXISTS logs_event_id_key;
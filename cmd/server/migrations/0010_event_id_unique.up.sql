@@ -0,0 +1,9 @@
+-- One row per event: a batch written twice (replayed from the WAL after a lost
+-- commit marker, or re-sent after a partial flush) is skipped by ON CONFLICT.
+-- A unique index on a partitioned table must include the partition key; a
+-- replayed event keeps its timestamp, so (event_id, timestamp) identifies it.
+DELETE FROM logs a USING logs b
+WHERE a.event_id = b.event_id AND a.timestamp = b.timestamp AND a.id > b.id;
+CREATE UNIQUE INDEX IF NOT EXISTS logs_event_id_key ON logs (event_id, timestamp);
+-- Lookups by event_id use the leading column of the new index
+DROP INDEX IF EXISTS logs_event_id_idx;
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/serilevanjalines/LogFlow/internal/multiline"
+)
+
+// How long a listener stream may sit on a partial event before it is flushed anyway
+const defaultMultilineTimeout = 2 * time.Second
+
+// multilineConfig holds the rules from MULTILINE_PRESETS / MULTILINE_START /
+// MULTILINE_CONTINUE; no rules means assembly is off
+type multilineConfig struct {
+	rules    []*multiline.Rule
+	maxLines int
+}
+
+// loadMultiline reads the assembly rules from the environment
+func loadMultiline() multilineConfig {
+	rules, err := multiline.Presets(os.Getenv("MULTILINE_PRESETS"))
+	if err != nil {
+		log.Fatalf("Invalid MULTILINE_PRESETS: %v", err)
+	}
+	if cont := os.Getenv("MULTILINE_CONTINUE"); cont != "" {
+		custom, err := multiline.Custom(os.Getenv("MULTILINE_START"), cont)
+		if err != nil {
+			log.Fatalf("Invalid multiline pattern: %v", err)
+		}
+		// Custom rules go first so they can override a preset
+		rules = append([]*multiline.Rule{custom}, rules...)
+	}
+	if len(rules) == 0 {
+		return multilineConfig{}
+	}
+
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.Name
+	}
+	log.Printf("✅ Multiline assembly enabled: %v", names)
+	return multilineConfig{rules: rules, maxLines: int(envInt64("MULTILINE_MAX_LINES", multiline.DefaultMaxLines))}
+}
+
+func (c multilineConfig) enabled() bool { return len(c.rules) > 0 }
+
+func (c multilineConfig) newStream() *lineStream {
+	return &lineStream{asm: multiline.New(c.rules, c.maxLines)}
+}
+
+// multilineKey separates interleaved streams: lines only join others from the same service and host
+func multilineKey(source string, evt LogEvent) string {
+	host, _ := evt.Metadata["hostname"].(string)
+	if host == "" {
+		host, _ = evt.Metadata["host"].(string)
+	}
+	return source + "\x00" + evt.Service + "\x00" + host
+}
+
+// mergeLines folds the events behind one assembled event into the first of them.
+// The full trace becomes the message; the exception class and top frame go to metadata.
+func mergeLines(parts []LogEvent, assembled multiline.Event) LogEvent {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+
+	evt := parts[0]
+	evt.Message = assembled.Text()
+	metadata := make(map[string]interface{}, len(evt.Metadata)+3)
+	for k, v := range evt.Metadata {
+		metadata[k] = v
+	}
+	metadata["multiline_lines"] = len(parts)
+	if assembled.Rule != nil {
+		metadata["multiline_rule"] = assembled.Rule.Name
+	}
+	if class, frame := assembled.Details(); class != "" || frame != "" {
+		if class != "" {
+			metadata["exception_class"] = class
+		}
+		if frame != "" {
+			metadata["top_frame"] = frame
+		}
+	}
+	evt.Metadata = metadata
+	return evt
+}
+
+// lineStream is the partial event of one stream
+type lineStream struct {
+	asm   *multiline.Assembler
+	parts []LogEvent
+	last  time.Time
+}
+
+// add feeds one event and returns the one it completed, if any
+func (s *lineStream) add(evt LogEvent) (LogEvent, bool) {
+	s.last = time.Now()
+	assembled, done := s.asm.Add(evt.Message)
+	if !done {
+		s.parts = append(s.parts, evt)
+		return LogEvent{}, false
+	}
+	merged := mergeLines(s.parts, assembled)
+	s.parts = []LogEvent{evt}
+	return merged, true
+}
+
+func (s *lineStream) flush() (LogEvent, bool) {
+	assembled, ok := s.asm.Flush()
+	if !ok {
+		return LogEvent{}, false
+	}
+	merged := mergeLines(s.parts, assembled)
+	s.parts = nil
+	return merged, true
+}
+
+// assemble joins the lines of one request. Streams are tracked separately
+// and each event lands where its first line was.
+func (c multilineConfig) assemble(events []LogEvent) []LogEvent {
+	out, _ := c.assembleIndexed(events)
+	return out
+}
+
+// assembleIndexed is assemble that also reports, for every input line, the
+// index of the output event it ended up in
+func (c multilineConfig) assembleIndexed(events []LogEvent) ([]LogEvent, []int) {
+	origin := make([]int, len(events))
+	if !c.enabled() || len(events) < 2 {
+		for i := range origin {
+			origin[i] = i
+		}
+		return events, origin
+	}
+
+	streams := map[string]*lineStream{}
+	slots := map[string]int{} // output index reserved for each stream's partial event
+	out := make([]LogEvent, 0, len(events))
+
+	for i, evt := range events {
+		key := multilineKey("", evt)
+		s, ok := streams[key]
+		if !ok {
+			s = c.newStream()
+			streams[key] = s
+		}
+		if merged, done := s.add(evt); done {
+			out[slots[key]] = merged
+		}
+		if len(s.parts) == 1 {
+			slots[key] = len(out)
+			out = append(out, LogEvent{})
+		}
+		origin[i] = slots[key]
+	}
+	for key, s := range streams {
+		if merged, ok := s.flush(); ok {
+			out[slots[key]] = merged
+		}
+	}
+	return out, origin
+}
+
+// streamAssembler joins lines arriving over the syslog and GELF listeners,
+// where a trace spans many datagrams or frames. Completed events go to offer.
+type streamAssembler struct {
+	mu      sync.Mutex
+	streams map[string]*lineStream
+	config  multilineConfig
+	timeout time.Duration
+	offer   func([]LogEvent)
+}
+
+func newStreamAssembler(config multilineConfig, timeout time.Duration, offer func([]LogEvent)) *streamAssembler {
+	a := &streamAssembler{streams: map[string]*lineStream{}, config: config, timeout: timeout, offer: offer}
+	go a.expireLoop()
+	return a
+}
+
+// offerLine queues a listener event, holding it back while it may still be
+// followed by continuation lines
+func (s *server) offerLine(source string, evt LogEvent) {
+	if s.lineStreams == nil {
+		s.pipeline.Offer([]LogEvent{evt})
+		return
+	}
+
+	if merged, done := s.lineStreams.add(multilineKey(source, evt), evt); done {
+		s.pipeline.Offer([]LogEvent{merged})
+	}
+}
+
+func (a *streamAssembler) add(key string, evt LogEvent) (LogEvent, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.streams[key]
+	if !ok {
+		s = a.config.newStream()
+		a.streams[key] = s
+	}
+	// A stream left half-updated by a panic would fail again on its next line
+	defer func() {
+		if r := recover(); r != nil {
+			delete(a.streams, key)
+			panic(r)
+		}
+	}()
+	return s.add(evt)
+}
+
+// expireLoop flushes streams that have gone quiet, since nothing else would complete their last event
+func (a *streamAssembler) expireLoop() {
+	// Floored so a nanosecond timeout cannot make a zero interval
+	ticker := time.NewTicker(max(a.timeout/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if ready := a.expire(); len(ready) > 0 {
+			a.offer(ready)
+		}
+	}
+}
+
+// expire flushes and forgets the streams idle for longer than the timeout
+func (a *streamAssembler) expire() (ready []LogEvent) {
+	defer recoverListener("multiline expiry")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, s := range a.streams {
+		if time.Since(s.last) < a.timeout {
+			continue
+		}
+		// Forgotten first, so a stream that cannot be flushed is not retried forever
+		delete(a.streams, key)
+		if merged, ok := s.flush(); ok {
+			ready = append(ready, merged)
+		}
+	}
+	return ready
+}
+
+// recoverListener keeps a listener or background loop running when handling
+// one message panics; deferred, it logs the panic instead of ending the process
+func recoverListener(what string) {
+	if r := recover(); r != nil {
+		log.Printf("❌ Panic in %s: %v\n%s", what, r, debug.Stack())
+	}
+}
+
+// flush queues every partial event, e.g. on shutdown
+func (a *streamAssembler) flush() {
+	a.mu.Lock()
+	var ready []LogEvent
+	for key, s := range a.streams {
+		if merged, ok := s.flush(); ok {
+			ready = append(ready, merged)
+		}
+		delete(a.streams, key)
+	}
+	a.mu.Unlock()
+
+	if len(ready) > 0 {
+		a.offer(ready)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/serilevanjalines/LogFlow/internal/multiline"
+)
+
+// withMultiline builds an assembly config from rules
+func withMultiline(rules ...*multiline.Rule) multilineConfig {
+	return multilineConfig{rules: rules, maxLines: multiline.DefaultMaxLines}
+}
+
+func TestAssembleEventsIndexed(t *testing.T) {
+	config := withMultiline(multiline.Go)
+	line := func(service, msg string) LogEvent {
+		return LogEvent{Service: service, Level: "ERROR", Message: msg}
+	}
+	events := []LogEvent{
+		line("api", "panic: boom"),
+		line("worker", "started"),
+		line("api", "main.foo()"),
+		line("api", "\t"),
+		line("api", "exit status 2"),
+		line("worker", "stopped"),
+	}
+
+	out, origin := config.assembleIndexed(events)
+	if len(out) != 3 {
+		t.Fatalf("got %d events, want 3: %+v", len(out), out)
+	}
+	if want := []int{0, 1, 0, 0, 0, 2}; !slices.Equal(origin, want) {
+		t.Errorf("origin = %v, want %v", origin, want)
+	}
+	trace := out[0]
+	if trace.Message != "panic: boom\nmain.foo()\n\t\nexit status 2" {
+		t.Errorf("merged message = %q", trace.Message)
+	}
+	if trace.Metadata["multiline_lines"] != 4 || trace.Metadata["exception_class"] != "panic" || trace.Metadata["top_frame"] != "main.foo()" {
+		t.Errorf("merged metadata = %v", trace.Metadata)
+	}
+	if out[1].Message != "started" || out[2].Message != "stopped" {
+		t.Errorf("other stream = %q, %q", out[1].Message, out[2].Message)
+	}
+}
+
+func TestAssembleEventsDisabled(t *testing.T) {
+	events := []LogEvent{{Message: "panic: boom"}, {Message: "main.foo()"}}
+	out, origin := withMultiline().assembleIndexed(events)
+	if len(out) != 2 || !slices.Equal(origin, []int{0, 1}) {
+		t.Errorf("got %d events, origin %v", len(out), origin)
+	}
+}
+
+func TestStreamAssemblerExpire(t *testing.T) {
+	a := &streamAssembler{streams: map[string]*lineStream{}, config: withMultiline(multiline.Go)}
+	for _, msg := range []string{"panic: boom", "main.foo()", "\t", "exit status 2"} {
+		if _, done := a.add("k", LogEvent{Service: "api", Message: msg}); done {
+			t.Fatalf("%q completed an event", msg)
+		}
+	}
+	ready := a.expire()
+	if len(ready) != 1 || ready[0].Metadata["top_frame"] != "main.foo()" || len(a.streams) != 0 {
+		t.Fatalf("expire returned %+v, %d streams left", ready, len(a.streams))
+	}
+}
+
+func TestStreamAssemblerDropsPanickingStream(t *testing.T) {
+	explode := &multiline.Rule{
+		Name:     "explode",
+		Start:    multiline.Go.Start,
+		Continue: multiline.Go.Continue,
+		Describe: func([]string) (string, string) { panic("describe failed") },
+	}
+	a := &streamAssembler{streams: map[string]*lineStream{}, config: withMultiline(explode)}
+	a.add("k", LogEvent{Message: "panic: boom"})
+	a.add("k", LogEvent{Message: "main.foo()"})
+
+	func() {
+		defer recoverListener("test")
+		a.add("k", LogEvent{Message: "next line"})
+		t.Error("completing the event did not panic")
+	}()
+	if _, ok := a.streams["k"]; ok {
+		t.Error("stream kept after a panic")
+	}
+	// The lock was released, so the assembler still works
+	if _, done := a.add("k", LogEvent{Message: "after"}); done {
+		t.Error("fresh stream completed an event")
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Deepest nesting of array and kvlist values we accept. Real attributes rarely
+// nest more than a few levels, and the decoders recurse once per level.
+const maxOTLPDepth = 64
+
+var errOTLPTooDeep = fmt.Errorf("values nested deeper than %d levels", maxOTLPDepth)
+
+// OTLP/HTTP logs data model (opentelemetry/proto/logs/v1). The json tags follow the
+// OTLP/JSON mapping; the protobuf decoder below fills the same structs.
+type otlpExportRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpUint64     `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpUint64     `json:"observedTimeUnixNano"`
+	SeverityNumber       otlpSeverity   `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 *otlpAnyValue  `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"` // hex encoded
+	SpanID               string         `json:"spanId"`  // hex encoded
+	EventName            string         `json:"eventName"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string        `json:"stringValue,omitempty"`
+	BoolValue   *bool          `json:"boolValue,omitempty"`
+	IntValue    *otlpUint64    `json:"intValue,omitempty"`
+	DoubleValue *float64       `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArray     `json:"arrayValue,omitempty"`
+	KvlistValue *otlpKeyValues `json:"kvlistValue,omitempty"`
+	BytesValue  *string        `json:"bytesValue,omitempty"` // base64 encoded
+}
+
+type otlpArray struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValues struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+// otlpUint64 accepts both JSON numbers and the decimal strings OTLP/JSON uses for 64-bit ints
+type otlpUint64 uint64
+
+func (u *otlpUint64) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+		*u = otlpUint64(v)
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", b)
+	}
+	*u = otlpUint64(v)
+	return nil
+}
+
+// otlpSeverity accepts the numeric enum value or its SEVERITY_NUMBER_* name
+type otlpSeverity int32
+
+var otlpSeverityNames = map[string]int32{
+	"TRACE": 1, "TRACE2": 2, "TRACE3": 3, "TRACE4": 4,
+	"DEBUG": 5, "DEBUG2": 6, "DEBUG3": 7, "DEBUG4": 8,
+	"INFO": 9, "INFO2": 10, "INFO3": 11, "INFO4": 12,
+	"WARN": 13, "WARN2": 14, "WARN3": 15, "WARN4": 16,
+	"ERROR": 17, "ERROR2": 18, "ERROR3": 19, "ERROR4": 20,
+	"FATAL": 21, "FATAL2": 22, "FATAL3": 23, "FATAL4": 24,
+}
+
+func (s *otlpSeverity) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*s = otlpSeverity(otlpSeverityNames[strings.TrimPrefix(name, "SEVERITY_NUMBER_")])
+		return nil
+	}
+	var n int32
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("invalid severityNumber %s", b)
+	}
+	*s = otlpSeverity(n)
+	return nil
+}
+
+// level maps the OTLP severity ranges onto LogFlow level names
+func (s otlpSeverity) level() string {
+	if s < 1 {
+		return ""
+	}
+	return severityName(int(s))
+}
+
+// value converts an AnyValue into a plain Go value suitable for JSONB metadata
+func (v *otlpAnyValue) value() interface{} {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			values[i] = v.ArrayValue.Values[i].value()
+		}
+		return values
+	case v.KvlistValue != nil:
+		return otlpAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	}
+	return nil
+}
+
+// text renders a log body as a message string; structured bodies become JSON
+func (v *otlpAnyValue) text() string {
+	val := v.value()
+	if s, ok := val.(string); ok {
+		return s
+	}
+	if val == nil {
+		return ""
+	}
+	b, _ := json.Marshal(val)
+	return string(b)
+}
+
+// depth is how many array and kvlist levels the value nests
+func (v *otlpAnyValue) depth() int {
+	d := 0
+	switch {
+	case v == nil:
+	case v.ArrayValue != nil:
+		for i := range v.ArrayValue.Values {
+			d = max(d, v.ArrayValue.Values[i].depth())
+		}
+		d++
+	case v.KvlistValue != nil:
+		for i := range v.KvlistValue.Values {
+			d = max(d, v.KvlistValue.Values[i].Value.depth())
+		}
+		d++
+	}
+	return d
+}
+
+// checkDepth applies maxOTLPDepth to a JSON request, which encoding/json only
+// bounds at a far deeper level
+func (req *otlpExportRequest) checkDepth() error {
+	tooDeep := func(kvs []otlpKeyValue) bool {
+		for i := range kvs {
+			if kvs[i].Value.depth() > maxOTLPDepth {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rl := range req.ResourceLogs {
+		if tooDeep(rl.Resource.Attributes) {
+			return errOTLPTooDeep
+		}
+		for _, sl := range rl.ScopeLogs {
+			for _, rec := range sl.LogRecords {
+				if rec.Body.depth() > maxOTLPDepth || tooDeep(rec.Attributes) {
+					return errOTLPTooDeep
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func otlpAttributes(kvs []otlpKeyValue) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(kvs))
+	for i := range kvs {
+		attrs[kvs[i].Key] = kvs[i].Value.value()
+	}
+	return attrs
+}
+
+// otlpToEvents flattens an export request into LogEvents
+func otlpToEvents(req *otlpExportRequest) []LogEvent {
+	var events []LogEvent
+	for _, rl := range req.ResourceLogs {
+		resourceAttrs := otlpAttributes(rl.Resource.Attributes)
+
+		service, _ := resourceAttrs["service.name"].(string)
+		if service == "" {
+			service = "unknown_service"
+		}
+		delete(resourceAttrs, "service.name")
+
+		for _, sl := range rl.ScopeLogs {
+			for _, rec := range sl.LogRecords {
+				metadata := make(map[string]interface{}, len(resourceAttrs)+len(rec.Attributes)+3)
+				for k, v := range resourceAttrs {
+					metadata[k] = v
+				}
+				for k, v := range otlpAttributes(rec.Attributes) {
+					metadata[k] = v
+				}
+				if sl.Scope.Name != "" {
+					metadata["otel.scope.name"] = sl.Scope.Name
+				}
+				if rec.EventName != "" {
+					metadata["event.name"] = rec.EventName
+				}
+
+				// http.route is a first-class column, so lift it out of metadata
+				route, _ := metadata["http.route"].(string)
+				delete(metadata, "http.route")
+
+				level := rec.SeverityNumber.level()
+				if level == "" {
+					level = rec.SeverityText
+				}
+
+				ts := uint64(rec.TimeUnixNano)
+				if ts == 0 {
+					ts = uint64(rec.ObservedTimeUnixNano)
+				}
+				timestamp := ""
+				if ts != 0 {
+					timestamp = formatEventTime(time.Unix(0, int64(ts)))
+				}
+
+				evt := LogEvent{
+					Service:   service,
+					Level:     level,
+					Message:   rec.Body.text(),
+					Timestamp: timestamp,
+					Route:     route,
+					TraceID:   rec.TraceID,
+					SpanID:    rec.SpanID,
+					Metadata:  metadata,
+				}
+				foreignLevel(&evt)
+				events = append(events, evt)
+			}
+		}
+	}
+	return events
+}
+
+// decodeOTLPProto parses a protobuf ExportLogsServiceRequest
+func decodeOTLPProto(b []byte) (*otlpExportRequest, error) {
+	req := &otlpExportRequest{}
+	err := walkProto(b, func(f protoField) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		var rl otlpResourceLogs
+		if err := decodeOTLPResourceLogs(f.Bytes, &rl); err != nil {
+			return err
+		}
+		req.ResourceLogs = append(req.ResourceLogs, rl)
+		return nil
+	})
+	return req, err
+}
+
+func decodeOTLPResourceLogs(b []byte, rl *otlpResourceLogs) error {
+	return walkProto(b, func(f protoField) error {
+		if f.Type != protowire.BytesType {
+			return nil
+		}
+		switch f.Num {
+		case 1: // resource
+			return walkProto(f.Bytes, func(rf protoField) error {
+				if rf.Num != 1 || rf.Type != protowire.BytesType {
+					return nil
+				}
+				kv, err := decodeOTLPKeyValue(rf.Bytes, 0)
+				rl.Resource.Attributes = append(rl.Resource.Attributes, kv)
+				return err
+			})
+		case 2: // scope_logs
+			var sl otlpScopeLogs
+			if err := decodeOTLPScopeLogs(f.Bytes, &sl); err != nil {
+				return err
+			}
+			rl.ScopeLogs = append(rl.ScopeLogs, sl)
+		}
+		return nil
+	})
+}
+
+func decodeOTLPScopeLogs(b []byte, sl *otlpScopeLogs) error {
+	return walkProto(b, func(f protoField) error {
+		if f.Type != protowire.BytesType {
+			return nil
+		}
+		switch f.Num {
+		case 1: // scope
+			return walkProto(f.Bytes, func(sf protoField) error {
+				switch sf.Num {
+				case 1:
+					sl.Scope.Name = string(sf.Bytes)
+				case 2:
+					sl.Scope.Version = string(sf.Bytes)
+				}
+				return nil
+			})
+		case 2: // log_records
+			var rec otlpLogRecord
+			if err := decodeOTLPLogRecord(f.Bytes, &rec); err != nil {
+				return err
+			}
+			sl.LogRecords = append(sl.LogRecords, rec)
+		}
+		return nil
+	})
+}
+
+func decodeOTLPLogRecord(b []byte, rec *otlpLogRecord) error {
+	return walkProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			rec.TimeUnixNano = otlpUint64(f.Varint)
+		case 11:
+			rec.ObservedTimeUnixNano = otlpUint64(f.Varint)
+		case 2:
+			rec.SeverityNumber = otlpSeverity(f.Varint)
+		case 3:
+			rec.SeverityText = string(f.Bytes)
+		case 5:
+			body, err := decodeOTLPAnyValue(f.Bytes, 0)
+			if err != nil {
+				return err
+			}
+			rec.Body = &body
+		case 6:
+			kv, err := decodeOTLPKeyValue(f.Bytes, 0)
+			if err != nil {
+				return err
+			}
+			rec.Attributes = append(rec.Attributes, kv)
+		case 9:
+			rec.TraceID = hex.EncodeToString(f.Bytes)
+		case 10:
+			rec.SpanID = hex.EncodeToString(f.Bytes)
+		case 12:
+			rec.EventName = string(f.Bytes)
+		}
+		return nil
+	})
+}
+
+// decodeOTLPKeyValue and decodeOTLPAnyValue recurse into nested values; depth
+// counts the array and kvlist levels above b
+func decodeOTLPKeyValue(b []byte, depth int) (otlpKeyValue, error) {
+	var kv otlpKeyValue
+	err := walkProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			kv.Key = string(f.Bytes)
+		case 2:
+			v, err := decodeOTLPAnyValue(f.Bytes, depth)
+			kv.Value = v
+			return err
+		}
+		return nil
+	})
+	return kv, err
+}
+
+func decodeOTLPAnyValue(b []byte, depth int) (otlpAnyValue, error) {
+	var v otlpAnyValue
+	err := walkProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			s := string(f.Bytes)
+			v.StringValue = &s
+		case 2:
+			bv := f.Varint != 0
+			v.BoolValue = &bv
+		case 3:
+			iv := otlpUint64(f.Varint)
+			v.IntValue = &iv
+		case 4:
+			dv := f.Double()
+			v.DoubleValue = &dv
+		case 5, 6:
+			if depth >= maxOTLPDepth {
+				return errOTLPTooDeep
+			}
+			var values []otlpAnyValue
+			var kvs []otlpKeyValue
+			err := walkProto(f.Bytes, func(af protoField) error {
+				if af.Num != 1 {
+					return nil
+				}
+				if f.Num == 5 {
+					item, err := decodeOTLPAnyValue(af.Bytes, depth+1)
+					values = append(values, item)
+					return err
+				}
+				kv, err := decodeOTLPKeyValue(af.Bytes, depth+1)
+				kvs = append(kvs, kv)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if f.Num == 5 {
+				v.ArrayValue = &otlpArray{Values: values}
+			} else {
+				v.KvlistValue = &otlpKeyValues{Values: kvs}
+			}
+		case 7:
+			s := base64.StdEncoding.EncodeToString(f.Bytes)
+			v.BytesValue = &s
+		}
+		return nil
+	})
+	return v, err
+}
+
+// encodeOTLPResponse builds an ExportLogsServiceResponse; partial_success is only set when something was rejected
+func encodeOTLPResponse(rejected int, errMsg string) []byte {
+	if rejected == 0 {
+		return nil
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, errMsg)
+
+	var resp []byte
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+	return protowire.AppendBytes(resp, partial)
+}
+
+// POST /v1/logs - OTLP/HTTP logs receiver (protobuf and JSON encodings)
+func (s *server) otlpLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isProto := mediaType == "application/x-protobuf" || mediaType == "application/protobuf"
+
+	var req *otlpExportRequest
+	var err error
+	if isProto {
+		req, err = decodeOTLPProto(body)
+	} else {
+		req = &otlpExportRequest{}
+		if err = json.NewDecoder(bytes.NewReader(body)).Decode(req); err == nil {
+			err = req.checkDepth()
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid OTLP payload: "+err.Error())
+		return
+	}
+
+	// Validate each record individually and report the rest as a partial success
+	var accepted []LogEvent
+	rejected := 0
+	errMsg := ""
+	for _, evt := range otlpToEvents(req) {
+		if err := validateEvent(&evt); err != nil {
+			rejected++
+			errMsg = err.Error()
+			continue
+		}
+		accepted = append(accepted, evt)
+	}
+
+	accepted = s.multiline.assemble(accepted)
+
+	// 429 with Retry-After tells OTLP exporters to back off and retry
+	if err := s.pipeline.Enqueue(accepted, nil); err != nil {
+		s.pipeline.writeQueueFull(w, err)
+		return
+	}
+
+	log.Printf("✅ QUEUED OTLP: accepted=%d, rejected=%d", len(accepted), rejected)
+
+	if isProto {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		w.Write(encodeOTLPResponse(rejected, errMsg))
+		return
+	}
+
+	resp := map[string]interface{}{}
+	if rejected > 0 {
+		resp["partialSuccess"] = map[string]interface{}{
+			"rejectedLogRecords": strconv.Itoa(rejected),
+			"errorMessage":       errMsg,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
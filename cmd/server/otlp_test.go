@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Builders for the protobuf messages the decoder reads
+func pbBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func pbVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbString(s string) []byte { return pbBytes(nil, 1, []byte(s)) }
+
+func pbKeyValue(key string, value []byte) []byte {
+	return pbBytes(pbBytes(nil, 1, []byte(key)), 2, value)
+}
+
+// pbNestedArray is an AnyValue holding levels arrays, one inside the other, around
+// a string. Wrapping from the inside out would copy the payload once per level,
+// so the lengths are worked out first and the headers written outermost first.
+func pbNestedArray(levels int) []byte {
+	leaf := pbString("leaf")
+	// sizes[i] is the length of the i-th message from the inside: AnyValue, ArrayValue, AnyValue...
+	sizes := make([]int, 2*levels+1)
+	sizes[0] = len(leaf)
+	for i := 1; i < len(sizes); i++ {
+		sizes[i] = sizes[i-1] + 1 + protowire.SizeVarint(uint64(sizes[i-1]))
+	}
+	out := make([]byte, 0, sizes[len(sizes)-1])
+	for i := len(sizes) - 2; i >= 0; i-- {
+		num := protowire.Number(1) // ArrayValue.values
+		if i%2 == 1 {
+			num = 5 // AnyValue.array_value
+		}
+		out = protowire.AppendTag(out, num, protowire.BytesType)
+		out = protowire.AppendVarint(out, uint64(sizes[i]))
+	}
+	return append(out, leaf...)
+}
+
+func pbRequest(record []byte, resourceAttrs ...[]byte) []byte {
+	var resource []byte
+	for _, kv := range resourceAttrs {
+		resource = pbBytes(resource, 1, kv)
+	}
+	scope := pbBytes(pbBytes(nil, 1, []byte("io.acme")), 2, []byte("1.0"))
+	scopeLogs := pbBytes(pbBytes(nil, 1, scope), 2, record)
+	resourceLogs := pbBytes(pbBytes(nil, 1, resource), 2, scopeLogs)
+	return pbBytes(nil, 1, resourceLogs)
+}
+
+func TestDecodeOTLPProto(t *testing.T) {
+	var record []byte
+	record = protowire.AppendTag(record, 1, protowire.Fixed64Type)
+	record = protowire.AppendFixed64(record, 1700000000123456789)
+	record = pbVarint(record, 2, 17)
+	record = pbBytes(record, 3, []byte("Error"))
+	record = pbBytes(record, 5, pbString("payment failed"))
+	record = pbBytes(record, 6, pbKeyValue("http.route", pbString("/pay")))
+	record = pbBytes(record, 6, pbKeyValue("retry", pbVarint(nil, 3, 3)))
+	record = pbBytes(record, 6, pbKeyValue("tags", pbBytes(nil, 5, pbBytes(pbBytes(nil, 1, pbString("a")), 1, pbVarint(nil, 2, 1)))))
+	record = pbBytes(record, 9, []byte{0xab, 0xcd})
+	record = pbBytes(record, 10, []byte{0x01})
+	record = pbVarint(record, 99, 1) // unknown fields are skipped
+
+	req, err := decodeOTLPProto(pbRequest(record, pbKeyValue("service.name", pbString("checkout"))))
+	if err != nil {
+		t.Fatalf("decodeOTLPProto: %v", err)
+	}
+	events := otlpToEvents(req)
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	evt := events[0]
+	if evt.Service != "checkout" || evt.Level != "ERROR" || evt.Message != "payment failed" || evt.Route != "/pay" {
+		t.Errorf("event = %+v", evt)
+	}
+	if evt.Timestamp != "2023-11-14T22:13:20.123456789Z" || evt.TraceID != "abcd" || evt.SpanID != "01" {
+		t.Errorf("timestamp %q, trace %q, span %q", evt.Timestamp, evt.TraceID, evt.SpanID)
+	}
+	if evt.Metadata["retry"] != int64(3) || evt.Metadata["otel.scope.name"] != "io.acme" {
+		t.Errorf("metadata = %v", evt.Metadata)
+	}
+	tags, _ := evt.Metadata["tags"].([]interface{})
+	if len(tags) != 2 || tags[0] != "a" || tags[1] != true {
+		t.Errorf("tags = %v", evt.Metadata["tags"])
+	}
+	if _, ok := evt.Metadata["http.route"]; ok {
+		t.Error("http.route left in metadata")
+	}
+}
+
+func TestDecodeOTLPProtoErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"truncated tag", []byte{0x80}},
+		{"length past the end", []byte{0x0a, 0x10, 0x01}},
+		{"bad nested record", pbRequest([]byte{0x2a, 0x05, 0x0a})},
+	}
+	for _, tt := range tests {
+		if _, err := decodeOTLPProto(tt.body); err == nil {
+			t.Errorf("%s: decoded without error", tt.name)
+		}
+	}
+}
+
+func TestDecodeOTLPProtoDepth(t *testing.T) {
+	ok := pbRequest(pbBytes(nil, 5, pbNestedArray(maxOTLPDepth)))
+	if _, err := decodeOTLPProto(ok); err != nil {
+		t.Errorf("%d levels: %v", maxOTLPDepth, err)
+	}
+
+	deep := pbRequest(pbBytes(nil, 5, pbNestedArray(maxOTLPDepth+1)))
+	if _, err := decodeOTLPProto(deep); !errors.Is(err, errOTLPTooDeep) {
+		t.Errorf("%d levels: got %v, want errOTLPTooDeep", maxOTLPDepth+1, err)
+	}
+
+	// Far deeper than the stack would survive without the limit
+	attr := pbKeyValue("k", pbNestedArray(1_000_000))
+	if _, err := decodeOTLPProto(pbRequest(pbBytes(nil, 6, attr))); !errors.Is(err, errOTLPTooDeep) {
+		t.Errorf("a million levels: got %v, want errOTLPTooDeep", err)
+	}
+
+	kvlist := pbString("leaf")
+	for range maxOTLPDepth + 1 {
+		kvlist = pbBytes(nil, 6, pbBytes(nil, 1, pbKeyValue("k", kvlist)))
+	}
+	if _, err := decodeOTLPProto(pbRequest(nil, pbKeyValue("nested", kvlist))); !errors.Is(err, errOTLPTooDeep) {
+		t.Errorf("nested kvlist resource attribute: got %v, want errOTLPTooDeep", err)
+	}
+}
+
+func TestDecodeOTLPJSON(t *testing.T) {
+	body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+		"scopeLogs":[{"logRecords":[{"timeUnixNano":"1700000000000000000","severityNumber":"SEVERITY_NUMBER_WARN",
+		"body":{"kvlistValue":{"values":[{"key":"msg","value":{"stringValue":"slow"}}]}},
+		"attributes":[{"key":"count","value":{"intValue":"7"}}],"traceId":"0af7651916cd43dd8448eb211c80319c"}]}]}]}`
+
+	var req otlpExportRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.checkDepth(); err != nil {
+		t.Fatal(err)
+	}
+	events := otlpToEvents(&req)
+	if len(events) != 1 {
+		t.Fatalf("got %d events", len(events))
+	}
+	evt := events[0]
+	if evt.Service != "api" || evt.Level != "WARNING" || evt.Message != `{"msg":"slow"}` || evt.Metadata["count"] != int64(7) {
+		t.Errorf("event = %+v", evt)
+	}
+}
+
+func TestOTLPJSONDepth(t *testing.T) {
+	nested := func(levels int) string {
+		return strings.Repeat(`{"arrayValue":{"values":[`, levels) + `{"stringValue":"x"}` + strings.Repeat(`]}}`, levels)
+	}
+	for _, tt := range []struct {
+		levels int
+		ok     bool
+	}{{maxOTLPDepth, true}, {maxOTLPDepth + 1, false}} {
+		body := `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"attributes":[{"key":"k","value":` + nested(tt.levels) + `}]}]}]}]}`
+		var req otlpExportRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatal(err)
+		}
+		if err := req.checkDepth(); (err == nil) != tt.ok {
+			t.Errorf("%d levels: checkDepth = %v", tt.levels, err)
+		}
+	}
+}
+
+func TestOTLPSeverity(t *testing.T) {
+	for _, tt := range []struct {
+		json  string
+		level string
+	}{{`"SEVERITY_NUMBER_DEBUG2"`, "DEBUG"}, {`"FATAL"`, "FATAL"}, {`9`, "INFO"}, {`0`, ""}, {`"bogus"`, ""}} {
+		var s otlpSeverity
+		if err := json.Unmarshal([]byte(tt.json), &s); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if got := s.level(); got != tt.level {
+			t.Errorf("%s: level %q, want %q", tt.json, got, tt.level)
+		}
+	}
+	var s otlpSeverity
+	if err := json.Unmarshal([]byte(`true`), &s); err == nil {
+		t.Error("boolean severity accepted")
+	}
+}
+
+func TestEncodeOTLPResponse(t *testing.T) {
+	if resp := encodeOTLPResponse(0, ""); resp != nil {
+		t.Errorf("full success encoded %x", resp)
+	}
+	var rejected uint64
+	var msg string
+	err := walkProto(encodeOTLPResponse(2, "bad level"), func(f protoField) error {
+		return walkProto(f.Bytes, func(pf protoField) error {
+			switch pf.Num {
+			case 1:
+				rejected = pf.Varint
+			case 2:
+				msg = string(pf.Bytes)
+			}
+			return nil
+		})
+	})
+	if err != nil || rejected != 2 || msg != "bad level" {
+		t.Errorf("partial success = %d %q, %v", rejected, msg, err)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Partition manager defaults, overridable via PARTITION_* environment variables
+const (
+	defaultPartitionPremakeDays   = 7
+	defaultPartitionCheckInterval = time.Hour
+
+	// pg_advisory_xact_lock key, so replicas don't race to create the same partition
+	partitionLockKey = migrationLockKey + 1
+
+	defaultPartition = "logs_default"
+)
+
+// logPartition is one partition of logs and its [From, To) range. A zero From
+// means MINVALUE; the default partition has neither bound.
+type logPartition struct {
+	Name     string
+	From, To time.Time
+	Default  bool
+	// Detached from logs but not dropped yet
+	Detached bool
+}
+
+var partitionBoundRe = regexp.MustCompile(`FROM \((.+?)\) TO \((.+?)\)`)
+
+// partitionManager keeps daily partitions of logs ahead of the clock and, when
+// PARTITION_DETACH_AFTER is set, detaches partitions that have aged out. Detached
+// partitions stay in the database as plain tables until the archiver or the
+// retention catch-all rule picks them up.
+type partitionManager struct {
+	db          *sql.DB
+	premakeDays int
+	detachAfter time.Duration
+	interval    time.Duration
+	stop        chan struct{}
+}
+
+// startPartitionManager runs one pass right away, so today's partition exists
+// before the writers start, then repeats every interval. It returns nil when
+// logs is not partitioned (migration 0006 not applied).
+func startPartitionManager(db *sql.DB) *partitionManager {
+	var kind string
+	if err := db.QueryRow(`SELECT relkind FROM pg_class WHERE oid = 'logs'::regclass`).Scan(&kind); err != nil || kind != "p" {
+		log.Println("⚠️ logs is not partitioned, partition manager disabled")
+		return nil
+	}
+
+	m := &partitionManager{
+		db:          db,
+		premakeDays: int(envInt64("PARTITION_PREMAKE_DAYS", defaultPartitionPremakeDays)),
+		detachAfter: envDuration("PARTITION_DETACH_AFTER", 0),
+		interval:    envDuration("PARTITION_CHECK_INTERVAL", defaultPartitionCheckInterval),
+		stop:        make(chan struct{}),
+	}
+	m.maintain()
+	go m.loop()
+
+	if m.detachAfter > 0 {
+		log.Printf("✅ Partition manager started (premake=%dd, detach after %s)", m.premakeDays, m.detachAfter)
+	} else {
+		log.Printf("✅ Partition manager started (premake=%dd)", m.premakeDays)
+	}
+	return m
+}
+
+func (m *partitionManager) loop() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.maintain()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *partitionManager) Close() {
+	close(m.stop)
+}
+
+// maintain creates missing partitions for today and the premake window, then detaches expired ones
+func (m *partitionManager) maintain() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := 0; i <= m.premakeDays; i++ {
+		day := today.AddDate(0, 0, i)
+		created, err := m.createPartition(ctx, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			log.Printf("❌ Error creating partition for %s: %v", day.Format("2006-01-02"), err)
+			return
+		}
+		if created {
+			log.Printf("🗂️ Created partition %s", partitionName(day))
+		}
+	}
+
+	if m.detachAfter <= 0 {
+		return
+	}
+	partitions, err := m.partitions(ctx)
+	if err != nil {
+		log.Printf("❌ Error listing partitions: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-m.detachAfter)
+	for _, p := range partitions {
+		// The default partition has no upper bound, and To == cutoff still holds unexpired rows
+		if p.Default || p.To.IsZero() || !p.To.Before(cutoff) {
+			continue
+		}
+		detached, err := detachPartition(ctx, m.db, p, detachedComment)
+		if err != nil {
+			log.Printf("❌ Error detaching partition %s: %v", p.Name, err)
+			continue
+		}
+		if detached {
+			log.Printf("📦 Detached partition %s (rows before %s are kept in table %s)", p.Name, p.To.Format(time.RFC3339), p.Name)
+		}
+	}
+}
+
+func (m *partitionManager) partitions(ctx context.Context) ([]logPartition, error) {
+	tx, err := m.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return listPartitions(ctx, tx)
+}
+
+// createPartition attaches a partition for [from, to) unless an existing one
+// already covers any of it. Rows that landed in the default partition for the
+// range are moved into the new partition first, which Postgres requires.
+func (m *partitionManager) createPartition(ctx context.Context, from, to time.Time) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(partitionLockKey)); err != nil {
+		return false, err
+	}
+	partitions, err := listPartitions(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range partitions {
+		if !p.Default && p.overlaps(from, to) {
+			return false, nil
+		}
+	}
+
+	name := quoteIdent(partitionName(from))
+	lo, hi := from.Format(time.RFC3339), to.Format(time.RFC3339)
+	for _, stmt := range []string{
+		fmt.Sprintf(`CREATE TABLE %s (LIKE logs INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, name),
+		fmt.Sprintf(`WITH moved AS (DELETE FROM %s WHERE timestamp >= '%s' AND timestamp < '%s' RETURNING *) INSERT INTO %s SELECT * FROM moved`,
+			defaultPartition, lo, hi, name),
+		fmt.Sprintf(`ALTER TABLE logs ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`, name, lo, hi),
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// AttachedPartitions lists the partitions of logs, which reads of logs cover
+func (s *postgresStore) AttachedPartitions(ctx context.Context) ([]logPartition, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return listPartitions(ctx, tx)
+}
+
+// ExpiredPartitions lists the daily (or initial) partitions whose range ends at or
+// before before. The default partition is never included.
+func (s *postgresStore) ExpiredPartitions(ctx context.Context, before time.Time) ([]logPartition, error) {
+	partitions, err := s.AttachedPartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var expired []logPartition
+	for _, p := range partitions {
+		if !p.Default && !p.To.IsZero() && !p.To.After(before) {
+			expired = append(expired, p)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].To.Before(expired[j].To) })
+	return expired, nil
+}
+
+// DropPartition detaches and drops a partition under the partition lock. DETACH
+// briefly needs an exclusive lock on logs, so lock_timeout makes it give up
+// (and retry next pass) rather than stall every query queued behind it.
+func (s *postgresStore) DropPartition(ctx context.Context, p logPartition) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(partitionLockKey)); err != nil {
+		return false, err
+	}
+	// Another replica, or PARTITION_DETACH_AFTER, may have got there first
+	attached, err := partitionAttached(ctx, tx, p.Name)
+	if err != nil || !attached {
+		return false, err
+	}
+
+	name := quoteIdent(p.Name)
+	for _, stmt := range []string{
+		`SET LOCAL lock_timeout = '5s'`,
+		fmt.Sprintf(`ALTER TABLE logs DETACH PARTITION %s`, name),
+		fmt.Sprintf(`DROP TABLE %s`, name),
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// Comments on a detached partition, followed by its bounds: one the archiver
+// detached once its archive was recorded, and one PARTITION_DETACH_AFTER
+// detached. They let later passes find the table and its range again.
+const (
+	archivingComment = "logflow:archiving"
+	detachedComment  = "logflow:detached"
+)
+
+// dailyPartitionRe matches the partitions the partition manager creates, which a
+// build without the comments above may have detached
+var dailyPartitionRe = regexp.MustCompile(`^logs_p([0-9]{8})$`)
+
+// detachPartition detaches a partition under the partition lock and marks it
+// with kind and its bounds. DETACH briefly needs an exclusive lock on logs, so
+// lock_timeout makes it give up rather than stall every query queued behind
+// it. False means it was no longer attached.
+func detachPartition(ctx context.Context, db *sql.DB, p logPartition, kind string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(partitionLockKey)); err != nil {
+		return false, err
+	}
+	attached, err := partitionAttached(ctx, tx, p.Name)
+	if err != nil || !attached {
+		return false, err
+	}
+
+	from := "MINVALUE"
+	if !p.From.IsZero() {
+		from = p.From.Format(time.RFC3339Nano)
+	}
+	comment := fmt.Sprintf("%s %s %s", kind, from, p.To.Format(time.RFC3339Nano))
+	name := quoteIdent(p.Name)
+	for _, stmt := range []string{
+		`SET LOCAL lock_timeout = '5s'`,
+		fmt.Sprintf(`ALTER TABLE logs DETACH PARTITION %s`, name),
+		// COMMENT takes no parameters; the text is generated from two timestamps
+		fmt.Sprintf(`COMMENT ON TABLE %s IS '%s'`, name, comment),
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// DetachForArchive detaches a partition whose archive is recorded, so it can be
+// recounted against the archive and dropped. False means it was no longer attached.
+func (s *postgresStore) DetachForArchive(ctx context.Context, p logPartition) (bool, error) {
+	return detachPartition(ctx, s.db, p, archivingComment)
+}
+
+// DetachedPartitions lists the partitions detached from logs and not dropped yet:
+// by the archiver, by PARTITION_DETACH_AFTER, or by name for daily partitions
+// detached before they were marked
+func (s *postgresStore) DetachedPartitions(ctx context.Context) ([]logPartition, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT c.relname, COALESCE(obj_description(c.oid, 'pg_class'), '')
+		FROM pg_class c
+		WHERE c.relkind = 'r' AND pg_table_is_visible(c.oid)
+			AND NOT EXISTS (SELECT 1 FROM pg_inherits i WHERE i.inhrelid = c.oid)
+			AND (obj_description(c.oid, 'pg_class') LIKE 'logflow:%' OR c.relname ~ '^logs_p[0-9]{8}$')
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []logPartition
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, err
+		}
+		p, err := detachedPartition(name, comment)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", name, err)
+		}
+		partitions = append(partitions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].To.Before(partitions[j].To) })
+	return partitions, nil
+}
+
+// detachedPartition reads a detached partition's bounds from its comment or, for
+// an unmarked daily partition, from its name
+func detachedPartition(name, comment string) (logPartition, error) {
+	p := logPartition{Name: name, Detached: true}
+	fields := strings.Fields(comment)
+	if len(fields) == 0 {
+		m := dailyPartitionRe.FindStringSubmatch(name)
+		if m == nil {
+			return p, fmt.Errorf("no bounds for table %s", name)
+		}
+		day, err := time.Parse("20060102", m[1])
+		if err != nil {
+			return p, err
+		}
+		p.From, p.To = day, day.AddDate(0, 0, 1)
+		return p, nil
+	}
+	if len(fields) != 3 || (fields[0] != archivingComment && fields[0] != detachedComment) {
+		return p, fmt.Errorf("unexpected comment %q", comment)
+	}
+	var err error
+	if fields[1] != "MINVALUE" {
+		if p.From, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			return p, err
+		}
+	}
+	if p.To, err = time.Parse(time.RFC3339Nano, fields[2]); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// CountPartition counts a partition's rows, to check an archive against
+func (s *postgresStore) CountPartition(ctx context.Context, p logPartition) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM `+quoteIdent(p.Name)).Scan(&n)
+	return n, err
+}
+
+// DropDetached drops a detached partition, once it is archived or expired. It
+// refuses a table that is attached to logs again.
+func (s *postgresStore) DropDetached(ctx context.Context, p logPartition) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	attached, err := partitionAttached(ctx, tx, p.Name)
+	if err != nil {
+		return err
+	}
+	if attached {
+		return fmt.Errorf("partition %s is attached to logs", p.Name)
+	}
+	if _, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS `+quoteIdent(p.Name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// partitionAttached reports whether the named table is currently a partition of logs
+func partitionAttached(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
+	var attached bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_inherits WHERE inhrelid = to_regclass($1) AND inhparent = 'logs'::regclass)
+	`, quoteIdent(name)).Scan(&attached)
+	return attached, err
+}
+
+// ExportPartition streams one partition oldest first, for the archiver. It reads
+// the table by name, so it works on attached and detached partitions alike.
+func (s *postgresStore) ExportPartition(ctx context.Context, p logPartition, fn func(LogEvent) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+logColumns+` FROM `+quoteIdent(p.Name)+` ORDER BY timestamp, timestamp_nanos, id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		evt, err := scanLogEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(evt); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LockArchive holds a transaction-level advisory lock until unlock, so replicas
+// never archive the same partition or race on the manifest
+func (s *postgresStore) LockArchive(ctx context.Context) (func(), bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, int64(archiveLockKey)).Scan(&ok); err != nil || !ok {
+		tx.Rollback()
+		return nil, false, err
+	}
+	return func() { tx.Rollback() }, true, nil
+}
+
+func (p logPartition) overlaps(from, to time.Time) bool {
+	startsBefore := p.From.IsZero() || p.From.Before(to)
+	endsAfter := p.To.IsZero() || p.To.After(from)
+	return startsBefore && endsAfter
+}
+
+// partitionName is logs_pYYYYMMDD for the day starting at day
+func partitionName(day time.Time) string {
+	return "logs_p" + day.UTC().Format("20060102")
+}
+
+// listPartitions reads the attached partitions of logs and their bounds from the catalog
+func listPartitions(ctx context.Context, tx *sql.Tx) ([]logPartition, error) {
+	// Bounds are rendered in the session time zone; UTC keeps them parseable
+	if _, err := tx.ExecContext(ctx, `SET LOCAL TimeZone = 'UTC'`); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+		FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'logs'::regclass
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []logPartition
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		p := logPartition{Name: name}
+		if bound == "DEFAULT" {
+			p.Default = true
+		} else {
+			m := partitionBoundRe.FindStringSubmatch(bound)
+			if m == nil {
+				return nil, fmt.Errorf("partition %s: unexpected bound %q", name, bound)
+			}
+			if p.From, err = parsePartitionBound(m[1]); err != nil {
+				return nil, fmt.Errorf("partition %s: %w", name, err)
+			}
+			if p.To, err = parsePartitionBound(m[2]); err != nil {
+				return nil, fmt.Errorf("partition %s: %w", name, err)
+			}
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// parsePartitionBound reads one bound value; MINVALUE and MAXVALUE are the zero time
+func parsePartitionBound(v string) (time.Time, error) {
+	if v == "MINVALUE" || v == "MAXVALUE" {
+		return time.Time{}, nil
+	}
+	v = strings.Trim(v, "'")
+	for _, layout := range []string{"2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999-07:00", "2006-01-02 15:04:05.999999-07:00:00"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unexpected bound value %q", v)
+}
+
+// quoteIdent quotes a generated table name for DDL, which takes no parameters
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
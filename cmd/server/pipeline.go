@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Write pipeline defaults, overridable via INGEST_* environment variables
+const (
+	defaultQueueSize     = 50000
+	defaultWriters       = 4
+	defaultBatchSize     = 1000
+	defaultFlushInterval = 500 * time.Millisecond
+	defaultRetryAfter    = 1 * time.Second
+
+	// Attempts per flush before the batch is split to find bad rows, or given up on
+	maxFlushAttempts = 3
+)
+
+var (
+	errQueueFull      = errors.New("ingest queue is full")
+	errPipelineClosed = errors.New("ingest pipeline is shutting down")
+	errWALUnavailable = errors.New("write-ahead log is unavailable")
+)
+
+// commitTracker calls fn once every event of one enqueue call has been flushed,
+// with the first error if any of them could not be written
+type commitTracker struct {
+	remaining atomic.Int64
+	err       atomic.Pointer[error]
+	fn        func(error)
+	// Set when the batch is in the WAL, so a failed flush defers it instead of losing it
+	walBacked bool
+}
+
+func (t *commitTracker) done(err error) {
+	var dl *deadLetterError
+	switch {
+	case err == nil:
+	case errors.As(err, &dl):
+		t.err.CompareAndSwap(nil, &err)
+	default:
+		// A retryable error wins over dead-lettered rows, so the batch is not committed
+		t.err.Store(&err)
+	}
+	if t.remaining.Add(-1) == 0 {
+		var first error
+		if p := t.err.Load(); p != nil {
+			first = *p
+		}
+		t.fn(first)
+	}
+}
+
+// queuedEvent is an event waiting for a writer, plus who to tell when it lands
+type queuedEvent struct {
+	evt     LogEvent
+	tracker *commitTracker
+}
+
+// writePipeline decouples ingest handlers from the store: handlers enqueue into a
+// bounded queue and a pool of writers flushes batches by size or time
+type writePipeline struct {
+	mu     sync.Mutex
+	closed bool
+	queue  chan queuedEvent
+	wg     sync.WaitGroup
+
+	batchSize     int
+	flushInterval time.Duration
+	retryAfter    time.Duration
+
+	store LogStore
+	// Optional write-ahead log; nil when WAL_DIR=off
+	wal *writeAheadLog
+	// Optional file for events the database refuses; nil when DEAD_LETTER_PATH=off
+	deadLetters *deadLetterLog
+	// Live tail broker that sees every batch once it is written
+	tail *tailBroker
+	// Event ids seen within the dedup horizon
+	dedup *dedupCache
+
+	// Counters exposed on /metrics/pipeline
+	enqueued      atomic.Int64
+	written       atomic.Int64
+	rejected      atomic.Int64 // refused with 429 because the queue was full
+	dropped       atomic.Int64 // lost after failed flushes or by listeners on a full queue
+	deadLettered  atomic.Int64 // refused by the database row by row, or given up on after WAL replays
+	deferred      atomic.Int64 // failed flushes kept in the WAL for the replayer
+	duplicates    atomic.Int64 // acknowledged without writing because the event_id was already seen
+	replayed      atomic.Int64
+	flushes       atomic.Int64
+	flushErrors   atomic.Int64
+	flushNanos    atomic.Int64
+	lastFlushNano atomic.Int64
+	maxFlushNano  atomic.Int64
+}
+
+// newWritePipeline starts the writer pool
+func newWritePipeline(queueSize, writers, batchSize int, flushInterval, retryAfter time.Duration, wal *writeAheadLog, deadLetters *deadLetterLog, dedup *dedupCache, store LogStore, tail *tailBroker) *writePipeline {
+	p := &writePipeline{
+		queue:         make(chan queuedEvent, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		retryAfter:    retryAfter,
+		wal:           wal,
+		deadLetters:   deadLetters,
+		dedup:         dedup,
+		store:         store,
+		tail:          tail,
+	}
+	for i := 0; i < writers; i++ {
+		p.wg.Add(1)
+		go p.writer()
+	}
+	log.Printf("✅ Write pipeline started (queue=%d, writers=%d, batch=%d, flush=%s)", queueSize, writers, batchSize, flushInterval)
+	return p
+}
+
+// Enqueue accepts all events or none, so a batch is never half-queued. onCommit,
+// if set, runs once all of the events have been written (or given up on).
+// EventID is filled in on every element of events; duplicates within the dedup
+// horizon get the original id and are not queued again.
+func (p *writePipeline) Enqueue(events []LogEvent, onCommit func(error)) error {
+	err := p.push(events, onCommit)
+	if err != nil {
+		p.rejected.Add(int64(len(events)))
+	}
+	return err
+}
+
+// Offer enqueues for sources that cannot push back (UDP/TCP listeners); a full
+// queue drops the events and counts them
+func (p *writePipeline) Offer(events []LogEvent) {
+	if err := p.push(events, nil); err != nil {
+		p.dropped.Add(int64(len(events)))
+	}
+}
+
+func (p *writePipeline) push(events []LogEvent, onCommit func(error)) error {
+	if len(events) == 0 {
+		if onCommit != nil {
+			onCommit(nil)
+		}
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errPipelineClosed
+	}
+
+	dup := p.dedup.claim(events)
+	fresh := make([]LogEvent, 0, len(events))
+	for i, evt := range events {
+		if !dup[i] {
+			fresh = append(fresh, evt)
+		}
+	}
+	if len(fresh) < len(events) {
+		p.duplicates.Add(int64(len(events) - len(fresh)))
+	}
+	if len(fresh) == 0 {
+		if onCommit != nil {
+			onCommit(nil)
+		}
+		return nil
+	}
+
+	if len(p.queue)+len(fresh) > cap(p.queue) {
+		p.dedup.release(fresh)
+		return errQueueFull
+	}
+
+	// Appending under mu keeps the capacity check valid, so a batch that made it
+	// into the WAL is always queued as well
+	var ref *walRef
+	if p.wal != nil {
+		r, err := p.wal.Append(fresh)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			p.dedup.release(fresh)
+			return errWALUnavailable
+		}
+		ref = &r
+	}
+
+	p.enqueue(fresh, p.newTracker(len(fresh), ref, onCommit))
+	return nil
+}
+
+// Replay queues a batch read back from the WAL, waiting for queue space rather than
+// failing. It returns false once the pipeline is shutting down.
+func (p *writePipeline) Replay(events []LogEvent, ref walRef) bool {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return false
+		}
+		if len(p.queue)+len(events) <= cap(p.queue) {
+			p.enqueue(events, p.newTracker(len(events), &ref, nil))
+			p.mu.Unlock()
+			p.replayed.Add(int64(len(events)))
+			return true
+		}
+		p.mu.Unlock()
+		time.Sleep(p.flushInterval)
+	}
+}
+
+// enqueue hands events to the writers; callers hold mu and have checked capacity
+func (p *writePipeline) enqueue(events []LogEvent, tracker *commitTracker) {
+	// Only writers drain the queue, so the capacity check guarantees these never block
+	for _, evt := range events {
+		p.queue <- queuedEvent{evt: evt, tracker: tracker}
+	}
+	p.enqueued.Add(int64(len(events)))
+}
+
+// newTracker wires onCommit and, for WAL-backed batches, the WAL commit or retry
+func (p *writePipeline) newTracker(n int, ref *walRef, onCommit func(error)) *commitTracker {
+	if ref == nil && onCommit == nil {
+		return nil
+	}
+	tracker := &commitTracker{walBacked: ref != nil}
+	tracker.remaining.Store(int64(n))
+	tracker.fn = func(err error) {
+		if ref != nil {
+			// Dead-lettered rows are settled too; only a retryable error leaves the batch to the replayer
+			var dl *deadLetterError
+			if err == nil || errors.As(err, &dl) {
+				p.wal.Commit(*ref)
+			} else {
+				p.wal.Failed(*ref)
+			}
+		}
+		if onCommit != nil {
+			onCommit(err)
+		}
+	}
+	return tracker
+}
+
+// Close stops accepting events and waits for the writers to flush what is queued
+func (p *writePipeline) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *writePipeline) writer() {
+	defer p.wg.Done()
+
+	batch := make([]queuedEvent, 0, p.batchSize)
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case item, ok := <-p.queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= p.batchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes one batch, retrying with backoff before giving up on it
+func (p *writePipeline) flush(batch []queuedEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	events := make([]LogEvent, len(batch))
+	for i := range batch {
+		events[i] = batch[i].evt
+	}
+
+	start := time.Now()
+	var err error
+	for attempt := 1; attempt <= maxFlushAttempts; attempt++ {
+		if err = p.insert(events); err == nil {
+			break
+		}
+		p.flushErrors.Add(1)
+		log.Printf("❌ Flush of %d events failed (attempt %d/%d): %v", len(batch), attempt, maxFlushAttempts, err)
+		if attempt < maxFlushAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	latency := time.Since(start).Nanoseconds()
+	p.flushes.Add(1)
+	p.flushNanos.Add(latency)
+	p.lastFlushNano.Store(latency)
+	for {
+		max := p.maxFlushNano.Load()
+		if latency <= max || p.maxFlushNano.CompareAndSwap(max, latency) {
+			break
+		}
+	}
+
+	// One bad row fails the whole COPY. While the database is reachable, find the
+	// rows that fail on their own so the rest of the batch is still written.
+	errs := make([]error, len(batch))
+	if err != nil {
+		if p.ping() == nil {
+			p.isolate(events, errs)
+		} else {
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+	}
+
+	written := make([]LogEvent, 0, len(events))
+	var lost []LogEvent
+	for i, item := range batch {
+		var dl *deadLetterError
+		switch {
+		case errs[i] == nil:
+			// Duplicates the store skipped were written before and already published
+			if events[i].ID != 0 {
+				written = append(written, events[i])
+			}
+		case errors.As(errs[i], &dl):
+			// Counted by deadLetter
+		case item.tracker != nil && item.tracker.walBacked:
+			p.deferred.Add(1)
+		default:
+			p.dropped.Add(1)
+			lost = append(lost, events[i])
+		}
+	}
+	// Nothing will write these again, so a client retry must not count as a duplicate
+	if len(lost) > 0 {
+		p.dedup.release(lost)
+	}
+	if len(written) > 0 {
+		p.written.Add(int64(len(written)))
+		p.tail.publish(written)
+	}
+
+	for i, item := range batch {
+		if item.tracker != nil {
+			item.tracker.done(errs[i])
+		}
+	}
+}
+
+// isolate writes the two halves of a batch that failed as a whole, splitting
+// failing halves down to single rows. A row that still fails alone while the
+// database is reachable is dead-lettered. errs receives each row's outcome.
+func (p *writePipeline) isolate(events []LogEvent, errs []error) {
+	mid := len(events) / 2
+	for _, half := range [][2]int{{0, mid}, {mid, len(events)}} {
+		rows, rowErrs := events[half[0]:half[1]], errs[half[0]:half[1]]
+		if len(rows) == 0 {
+			continue
+		}
+		err := p.insert(rows)
+		switch {
+		case err == nil:
+		case p.ping() != nil:
+			// The database went away; the rows are not to blame
+			for i := range rowErrs {
+				rowErrs[i] = err
+			}
+		case len(rows) == 1:
+			rowErrs[0] = &deadLetterError{err: err}
+			p.deadLetter(rows, err.Error())
+		default:
+			p.isolate(rows, rowErrs)
+		}
+	}
+}
+
+func (p *writePipeline) insert(events []LogEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return p.store.Insert(ctx, events)
+}
+
+func (p *writePipeline) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return p.store.Ping(ctx)
+}
+
+// deadLetter gives up on events for good, keeping them in the dead-letter file when one is configured
+func (p *writePipeline) deadLetter(events []LogEvent, reason string) {
+	p.deadLettered.Add(int64(len(events)))
+	log.Printf("❌ Dead-lettered %d events: %s", len(events), reason)
+	if p.deadLetters == nil {
+		return
+	}
+	if err := p.deadLetters.Write(events, reason); err != nil {
+		log.Printf("❌ %v", err)
+	}
+}
+
+// writeQueueFull answers 429 with Retry-After so producers back off instead of timing
+// out; errors other than a full queue (shutdown, WAL failure) answer 503
+func (p *writePipeline) writeQueueFull(w http.ResponseWriter, err error) {
+	p.setRetryAfter(w)
+	code := http.StatusTooManyRequests
+	if !errors.Is(err, errQueueFull) {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSONError(w, code, err.Error()+", retry later")
+}
+
+func (p *writePipeline) setRetryAfter(w http.ResponseWriter) {
+	secs := int(p.retryAfter.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+// GET /metrics/pipeline - write pipeline queue depth, flush latency and drop counts
+func (s *server) pipelineMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := s.pipeline
+	flushes := p.flushes.Load()
+	avgFlushMs := 0.0
+	if flushes > 0 {
+		avgFlushMs = float64(p.flushNanos.Load()) / float64(flushes) / 1e6
+	}
+
+	resp := map[string]interface{}{
+		"queue_depth":         len(p.queue),
+		"queue_capacity":      cap(p.queue),
+		"enqueued_total":      p.enqueued.Load(),
+		"written_total":       p.written.Load(),
+		"rejected_total":      p.rejected.Load(),
+		"dropped_total":       p.dropped.Load(),
+		"dead_lettered_total": p.deadLettered.Load(),
+		"deferred_total":      p.deferred.Load(),
+		"duplicates_total":    p.duplicates.Load(),
+		"replayed_total":      p.replayed.Load(),
+		"flushes_total":       flushes,
+		"flush_errors_total":  p.flushErrors.Load(),
+		"last_flush_ms":       float64(p.lastFlushNano.Load()) / 1e6,
+		"avg_flush_ms":        avgFlushMs,
+		"max_flush_ms":        float64(p.maxFlushNano.Load()) / 1e6,
+		"timestamp":           time.Now().Format(time.RFC3339),
+	}
+	if p.wal != nil {
+		resp["wal"] = p.wal.Stats()
+	}
+	resp["tail"] = p.tail.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
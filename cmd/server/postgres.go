@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Columns written by COPY, in row order
+var copyColumns = []string{"timestamp", "service", "level", "severity", "route", "message", "metadata", "event_id", "trace_id", "span_id", "request_id", "timestamp_nanos", "received_at"}
+
+// Inserts COPY into a session-local staging table and move the rows over with
+// ON CONFLICT, so events already stored (same event_id and timestamp) are skipped
+// instead of written twice. The staging table takes the id default from logs, so
+// ids are drawn from the logs sequence as rows are copied; ord is the row's
+// position in the batch, so the ids and created_at of the rows actually written
+// can be handed back to the caller.
+const createStagingSQL = `CREATE TEMP TABLE IF NOT EXISTS logs_staging (LIKE logs INCLUDING DEFAULTS, ord INTEGER) ON COMMIT DELETE ROWS`
+
+var insertStagedSQL = `WITH inserted AS (
+		INSERT INTO logs (id, ` + strings.Join(copyColumns, ", ") + `)
+		SELECT id, ` + strings.Join(copyColumns, ", ") + ` FROM logs_staging
+		ON CONFLICT (event_id, timestamp) DO NOTHING
+		RETURNING id, created_at
+	)
+	SELECT s.ord, i.id, i.created_at FROM inserted i JOIN logs_staging s USING (id)`
+
+// Columns read back into a LogEvent, in scanLogEvent order
+const logColumns = `id, event_id, timestamp, timestamp_nanos, service, level, severity, route, message, metadata, trace_id, span_id, request_id, received_at, created_at`
+
+// postgresStore keeps logs in the Postgres logs table
+type postgresStore struct {
+	db *sql.DB
+	// nil when logs is not partitioned
+	partitions *partitionManager
+}
+
+// openPostgresStore connects and brings the schema up to date
+func openPostgresStore(dbURL string) (*postgresStore, error) {
+	db, err := openPostgres(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &postgresStore{db: db, partitions: startPartitionManager(db)}, nil
+}
+
+// openPostgres connects and tunes the connection pool
+func openPostgres(dbURL string) (*sql.DB, error) {
+	if dbURL == "" {
+		return nil, fmt.Errorf("DATABASE_URL environment variable not set")
+	}
+
+	// Ensure simple protocol for pooled Postgres (transaction mode compatibility)
+	if parsedURL, err := url.Parse(dbURL); err == nil {
+		query := parsedURL.Query()
+		// pgx uses default_query_exec_mode instead of simple_protocol
+		if query.Get("default_query_exec_mode") == "" {
+			query.Set("default_query_exec_mode", "simple_protocol")
+			parsedURL.RawQuery = query.Encode()
+			dbURL = parsedURL.String()
+		}
+	}
+
+	// Use "pgx" driver
+	db, err := sql.Open("pgx", dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	// Test connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to database: %w", err)
+	}
+
+	// Set connection pool settings
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	log.Println("✅ Connected to Supabase PostgreSQL!")
+	return db, nil
+}
+
+// Insert writes events with COPY on a pgx connection and sets ID and CreatedAt
+// on the events written; skipped duplicates are left with ID 0
+func (s *postgresStore) Insert(ctx context.Context, events []LogEvent) error {
+	rows := make([][]interface{}, len(events))
+	for i, evt := range events {
+		ts, err := parseEventTime(evt.Timestamp)
+		if err != nil {
+			return fmt.Errorf("event %d: invalid timestamp: %w", i, err)
+		}
+		// TIMESTAMPTZ keeps microseconds; the rest goes in timestamp_nanos
+		subMicro := ts.Nanosecond() % 1000
+		var received interface{}
+		if t, err := parseEventTime(evt.ReceivedAt); err == nil {
+			received = t
+		}
+		rows[i] = []interface{}{ts, evt.Service, evt.Level, int16(evt.Severity), nullString(evt.Route), evt.Message, metadataValue(evt.Metadata), nullString(evt.EventID),
+			nullString(evt.TraceID), nullString(evt.SpanID), nullString(evt.RequestID), int16(subMicro), received, int32(i)}
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring connection: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		tx, err := pgxConn.Conn().Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		if _, err := tx.Exec(ctx, createStagingSQL); err != nil {
+			return fmt.Errorf("error creating staging table: %w", err)
+		}
+		stagingColumns := append(copyColumns[:len(copyColumns):len(copyColumns)], "ord")
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"logs_staging"}, stagingColumns, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+		ids := make([]int64, len(events))
+		created := make([]time.Time, len(events))
+		inserted, err := tx.Query(ctx, insertStagedSQL)
+		if err != nil {
+			return err
+		}
+		for inserted.Next() {
+			var ord int32
+			var id int64
+			var createdAt time.Time
+			if err := inserted.Scan(&ord, &id, &createdAt); err != nil {
+				inserted.Close()
+				return err
+			}
+			ids[ord], created[ord] = id, createdAt
+		}
+		if err := inserted.Err(); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		// Only once committed, so a failed batch leaves the events untouched for a retry
+		for i := range events {
+			events[i].ID, events[i].CreatedAt = ids[i], ""
+			if ids[i] != 0 {
+				events[i].CreatedAt = created[i].UTC().Format(time.RFC3339)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *postgresStore) Range(ctx context.Context, from, to time.Time, limit int) ([]LogEvent, error) {
+	return s.Query(ctx, LogFilter{From: from, To: to, Limit: limit})
+}
+
+// Query compares the bare timestamp column against the bounds, so Postgres prunes
+// the daily partitions outside them
+func (s *postgresStore) Query(ctx context.Context, f LogFilter) ([]LogEvent, error) {
+	where, args, argCount := filterWhere(f)
+	query := `SELECT ` + logColumns + ` FROM logs WHERE ` + where
+
+	// timestamp_nanos and id break ties between events logged in the same microsecond
+	if f.Ascending {
+		query += " ORDER BY timestamp ASC, timestamp_nanos ASC, id ASC"
+	} else {
+		query += " ORDER BY timestamp DESC, timestamp_nanos DESC, id DESC"
+	}
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", argCount)
+		args = append(args, f.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []LogEvent{}
+	for rows.Next() {
+		evt, err := scanLogEvent(rows)
+		if err != nil {
+			log.Printf("❌ Error scanning row: %v", err)
+			continue
+		}
+		logs = append(logs, evt)
+	}
+	return logs, rows.Err()
+}
+
+// filterWhere renders a filter as the condition of a WHERE clause and returns
+// the next free parameter number
+func filterWhere(f LogFilter) (string, []interface{}, int) {
+	where := "1=1"
+	args := []interface{}{}
+	argCount := 1
+
+	for _, cond := range []struct {
+		column, value string
+	}{
+		{"service", f.Service},
+		{"route", f.Route},
+		{"event_id", f.EventID},
+		{"trace_id", f.TraceID},
+		{"request_id", f.RequestID},
+	} {
+		if cond.value != "" {
+			where += fmt.Sprintf(" AND %s = $%d", cond.column, argCount)
+			args = append(args, cond.value)
+			argCount++
+		}
+	}
+	where, args, argCount = sqlLevelFilters(f.Levels, where, args, argCount)
+	for _, m := range f.Matchers {
+		var cond string
+		cond, args, argCount = m.sql(args, argCount)
+		where += " AND " + cond
+	}
+	if f.Search != nil {
+		var cond string
+		cond, args, argCount = f.Search.sql(args, argCount)
+		where += " AND " + cond
+	}
+	if !f.From.IsZero() {
+		where += fmt.Sprintf(" AND timestamp >= $%d", argCount)
+		args = append(args, f.From)
+		argCount++
+	}
+	if !f.To.IsZero() {
+		where += fmt.Sprintf(" AND timestamp <= $%d", argCount)
+		args = append(args, f.To)
+		argCount++
+	}
+	if f.Cursor != nil {
+		var cond string
+		cond, args, argCount = f.Cursor.sql(f.Ascending, args, argCount)
+		where += " AND " + cond
+	}
+	return where, args, argCount
+}
+
+// scanLogEvent reads one row selected with logColumns
+func scanLogEvent(rows *sql.Rows) (LogEvent, error) {
+	var evt LogEvent
+	var timestamp, createdAt time.Time
+	var receivedAt sql.NullTime
+	var nanos, severity sql.NullInt64
+	var metadataJSON []byte
+	var route, eventID, traceID, spanID, requestID sql.NullString
+
+	err := rows.Scan(
+		&evt.ID,
+		&eventID,
+		&timestamp,
+		&nanos,
+		&evt.Service,
+		&evt.Level,
+		&severity,
+		&route,
+		&evt.Message,
+		&metadataJSON,
+		&traceID,
+		&spanID,
+		&requestID,
+		&receivedAt,
+		&createdAt,
+	)
+	if err != nil {
+		return evt, err
+	}
+
+	evt.Timestamp = storedEventTime(timestamp, nanos)
+	evt.CreatedAt = createdAt.Format(time.RFC3339)
+	if receivedAt.Valid {
+		evt.ReceivedAt = formatEventTime(receivedAt.Time)
+	}
+	evt.Severity = int(severity.Int64)
+	evt.Route = route.String
+	evt.EventID = eventID.String
+	evt.TraceID = traceID.String
+	evt.SpanID = spanID.String
+	evt.RequestID = requestID.String
+	if len(metadataJSON) > 0 {
+		json.Unmarshal(metadataJSON, &evt.Metadata)
+	}
+	return evt, nil
+}
+
+func (s *postgresStore) Count(ctx context.Context, f LogFilter, by []logField, step time.Duration) ([]logCount, error) {
+	where, args, argCount := filterWhere(f)
+	var exprs []string
+	for _, field := range by {
+		var expr string
+		expr, args, argCount = field.sql(args, argCount)
+		exprs = append(exprs, expr)
+	}
+	if step > 0 {
+		exprs = append(exprs, fmt.Sprintf("to_timestamp(floor(extract(epoch FROM timestamp) / $%d) * $%d)", argCount, argCount))
+		args = append(args, step.Seconds())
+		argCount++
+	}
+
+	query := `SELECT `
+	groupBy := make([]string, len(exprs))
+	for i, expr := range exprs {
+		query += expr + ", "
+		groupBy[i] = strconv.Itoa(i + 1)
+	}
+	query += `COUNT(*) FROM logs WHERE ` + where
+	if len(exprs) > 0 {
+		query += ` GROUP BY ` + strings.Join(groupBy, ", ")
+	}
+	if step > 0 {
+		query += fmt.Sprintf(` ORDER BY %d, COUNT(*) DESC`, len(exprs))
+	} else {
+		query += ` ORDER BY COUNT(*) DESC`
+	}
+	query += fmt.Sprintf(` LIMIT $%d`, argCount)
+	args = append(args, maxCountGroups)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []logCount{}
+	for rows.Next() {
+		labels := make([]sql.NullString, len(by))
+		var bucket sql.NullTime
+		var lc logCount
+		dest := make([]interface{}, 0, len(by)+2)
+		for i := range labels {
+			dest = append(dest, &labels[i])
+		}
+		if step > 0 {
+			dest = append(dest, &bucket)
+		}
+		if err := rows.Scan(append(dest, &lc.Count)...); err != nil {
+			return nil, err
+		}
+		lc.Labels = make(map[string]string, len(by))
+		for i, field := range by {
+			lc.Labels[field.String()] = labels[i].String
+		}
+		if bucket.Valid {
+			lc.Bucket = bucket.Time.UTC()
+		}
+		counts = append(counts, lc)
+	}
+	// Ties on count come back in any order; settle them like the other stores
+	sortLogCounts(counts, by)
+	return counts, rows.Err()
+}
+
+func (s *postgresStore) Aggregate(ctx context.Context, since time.Time) (LogAggregate, error) {
+	agg := newLogAggregate()
+	query := `SELECT service, severity, COUNT(*) FROM logs`
+	var args []interface{}
+	if !since.IsZero() {
+		query += ` WHERE timestamp > $1`
+		args = append(args, since)
+	}
+	query += ` GROUP BY service, severity`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return agg, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var service string
+		var severity sql.NullInt64
+		var count int
+		if err := rows.Scan(&service, &severity, &count); err != nil {
+			return agg, err
+		}
+		agg.add(service, int(severity.Int64), count)
+	}
+	return agg, rows.Err()
+}
+
+func (s *postgresStore) RecentEventIDs(ctx context.Context, since time.Time, limit int) ([]storedEventID, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT event_id, created_at FROM logs
+		WHERE event_id IS NOT NULL AND created_at > $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []storedEventID
+	for rows.Next() {
+		var id storedEventID
+		if err := rows.Scan(&id.ID, &id.Stored); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *postgresStore) CountExpired(ctx context.Context, scope retentionScope) (int64, error) {
+	where, args := retentionWhere(scope)
+	var n int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM logs WHERE `+where, args...).Scan(&n)
+	return n, err
+}
+
+// DeleteExpired removes one bounded batch, so each statement holds its row locks briefly
+func (s *postgresStore) DeleteExpired(ctx context.Context, scope retentionScope, limit int) (int64, error) {
+	where, args := retentionWhere(scope)
+	query := `DELETE FROM logs WHERE (id, timestamp) IN (SELECT id, timestamp FROM logs WHERE ` + where
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+		args = append(args, limit)
+	}
+	res, err := s.db.ExecContext(ctx, query+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// retentionWhere renders a retention scope as a WHERE clause. The bare timestamp
+// bounds let Postgres skip partitions that hold nothing expired.
+func retentionWhere(scope retentionScope) (string, []interface{}) {
+	where := "timestamp < $1"
+	args := []interface{}{scope.Before}
+	argCount := 2
+	if !scope.NotBefore.IsZero() {
+		where += fmt.Sprintf(" AND timestamp >= $%d", argCount)
+		args = append(args, scope.NotBefore)
+		argCount++
+	}
+
+	var cond string
+	cond, args, argCount = retentionRuleSQL(scope.Rule, args, argCount)
+	where += " AND " + cond
+	// Events an earlier rule matches follow that rule instead
+	for _, earlier := range scope.Earlier {
+		cond, args, argCount = retentionRuleSQL(earlier, args, argCount)
+		where += " AND NOT " + cond
+	}
+	return where, args
+}
+
+func retentionRuleSQL(rule retentionRule, args []interface{}, argCount int) (string, []interface{}, int) {
+	cond := "TRUE"
+	if rule.Service != "" {
+		cond += fmt.Sprintf(" AND service = $%d", argCount)
+		args = append(args, rule.Service)
+		argCount++
+	}
+	cond, args, argCount = sqlLevelFilters(rule.Levels, cond, args, argCount)
+	return "(" + cond + ")", args, argCount
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *postgresStore) Close() error {
+	if s.partitions != nil {
+		s.partitions.Close()
+	}
+	return s.db.Close()
+}
+
+// nullString stores empty optional fields as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is one decoded field of a protobuf message. Scalars land in Varint
+// (varint, fixed32 and fixed64 wire types); length-delimited fields land in Bytes.
+type protoField struct {
+	Num    protowire.Number
+	Type   protowire.Type
+	Varint uint64
+	Bytes  []byte
+}
+
+// Double reinterprets a fixed64 field as a float64
+func (f protoField) Double() float64 {
+	return math.Float64frombits(f.Varint)
+}
+
+// walkProto calls fn for every field in a serialized protobuf message. The receivers
+// only need a handful of well-known messages (OTLP, Loki), so we decode them by hand
+// instead of pulling in generated code for each schema.
+func walkProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := protoField{Num: num, Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.Varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.Varint, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.Varint = uint64(v)
+		case protowire.BytesType:
+			f.Bytes, n = protowire.ConsumeBytes(b)
+		default:
+			// Deprecated groups: skip over them
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Query language limits and defaults
+const (
+	maxQueryLen        = 4096
+	defaultQueryLimit  = 100
+	maxQueryLimit      = 10000
+	defaultCountWindow = time.Hour // count queries without a from
+	maxCountBuckets    = 10000
+)
+
+// A log query selects events and optionally pipes them into stages:
+//
+//	service=~"pay.*" level>=ERROR metadata.user_id="user_3" "timeout" | count by service [5m]
+//
+// Selectors are ANDed. `field op value` compares a field (service, level, route,
+// message, event_id, trace_id, span_id, request_id or metadata.<path>) using
+// = != =~ !~; level and metadata fields also take > >= < <=, numeric for
+// metadata. Regular expressions must match the whole value and keep to the
+// syntax Go and Postgres share (see portableRegex). A bare string is a
+// full-text search for that phrase.
+//
+// Stages: `| count [by field, ...] [step]`, `| limit n`, `| sort asc|desc`.
+
+// queryAST is a parsed query; positions are byte offsets into the query text
+type queryAST struct {
+	Selectors []querySelector
+	Stages    []queryStage
+}
+
+type querySelector struct {
+	Pos      int
+	Field    string // empty for a bare search string
+	Op       string
+	OpPos    int
+	Value    string
+	ValuePos int
+}
+
+type queryStage struct {
+	Pos     int
+	Kind    string // count, limit, sort
+	By      []string
+	ByPos   []int
+	Step    time.Duration
+	N       int
+	Ascend  bool
+	ArgsPos int
+}
+
+// queryError is a syntax or semantic error at a byte offset of the query
+type queryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+func queryErrorf(pos int, format string, args ...interface{}) *queryError {
+	return &queryError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type queryToken struct {
+	kind string // word, string, op, |, [, ], ",", eof
+	text string
+	pos  int
+}
+
+// Characters that end a bare word
+const queryDelimiters = " \t\r\n=!~<>\"`|[],()"
+
+func lexQuery(q string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '|' || c == '[' || c == ']' || c == ',':
+			tokens = append(tokens, queryToken{kind: string(c), text: string(c), pos: i})
+			i++
+		case c == '"' || c == '`':
+			end, text, err := lexQueryString(q, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{kind: "string", text: text, pos: i})
+			i = end
+		case strings.IndexByte("=!~<>", c) >= 0:
+			op := ""
+			for _, candidate := range []string{"=~", "!~", "!=", ">=", "<=", "=", ">", "<"} {
+				if strings.HasPrefix(q[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, queryErrorf(i, "unexpected %q", c)
+			}
+			tokens = append(tokens, queryToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		case c == '(' || c == ')':
+			return nil, queryErrorf(i, "unexpected %q; selectors are ANDed and need no grouping", c)
+		default:
+			end := strings.IndexAny(q[i:], queryDelimiters)
+			if end < 0 {
+				end = len(q) - i
+			}
+			tokens = append(tokens, queryToken{kind: "word", text: q[i : i+end], pos: i})
+			i += end
+		}
+	}
+	return append(tokens, queryToken{kind: "eof", pos: len(q)}), nil
+}
+
+// lexQueryString reads a "double-quoted" string with Go escapes or a `raw` one
+func lexQueryString(q string, start int) (int, string, error) {
+	quote := q[start]
+	for i := start + 1; i < len(q); i++ {
+		switch q[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			text, err := strconv.Unquote(q[start : i+1])
+			if err != nil {
+				return 0, "", queryErrorf(start, "invalid string literal")
+			}
+			return i + 1, text, nil
+		}
+	}
+	return 0, "", queryErrorf(start, "unterminated string")
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+// describe names a token for error messages
+func (t queryToken) describe() string {
+	switch t.kind {
+	case "eof":
+		return "end of query"
+	case "string":
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// parseQuery parses the query text into an AST; errors are *queryError
+func parseQuery(q string) (*queryAST, error) {
+	if len(q) > maxQueryLen {
+		return nil, queryErrorf(maxQueryLen, "query longer than %d bytes", maxQueryLen)
+	}
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	ast := &queryAST{}
+
+	for t := p.peek(); t.kind != "eof" && t.kind != "|"; t = p.peek() {
+		sel, err := p.parseSelector()
+		if err != nil {
+			return nil, err
+		}
+		ast.Selectors = append(ast.Selectors, sel)
+	}
+	for p.peek().kind == "|" {
+		p.next()
+		stage, err := p.parseStage()
+		if err != nil {
+			return nil, err
+		}
+		ast.Stages = append(ast.Stages, stage)
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, queryErrorf(t.pos, "unexpected %s", t.describe())
+	}
+	return ast, nil
+}
+
+func (p *queryParser) parseSelector() (querySelector, error) {
+	t := p.next()
+	switch t.kind {
+	case "string":
+		return querySelector{Pos: t.pos, Value: t.text, ValuePos: t.pos}, nil
+	case "word":
+	default:
+		return querySelector{}, queryErrorf(t.pos, "expected a selector, found %s", t.describe())
+	}
+
+	sel := querySelector{Pos: t.pos, Field: t.text}
+	op := p.next()
+	if op.kind != "op" {
+		return sel, queryErrorf(op.pos, "expected an operator after %q, found %s", t.text, op.describe())
+	}
+	sel.Op, sel.OpPos = op.text, op.pos
+	value := p.next()
+	if value.kind != "word" && value.kind != "string" {
+		return sel, queryErrorf(value.pos, "expected a value after %s, found %s", op.text, value.describe())
+	}
+	sel.Value, sel.ValuePos = value.text, value.pos
+	return sel, nil
+}
+
+func (p *queryParser) parseStage() (queryStage, error) {
+	t := p.next()
+	stage := queryStage{Pos: t.pos, Kind: t.text}
+	if t.kind != "word" {
+		return stage, queryErrorf(t.pos, "expected a stage (count, limit, sort) after |, found %s", t.describe())
+	}
+
+	switch t.text {
+	case "count":
+		if next := p.peek(); next.kind == "word" && next.text == "by" {
+			p.next()
+			for {
+				field := p.next()
+				if field.kind != "word" {
+					return stage, queryErrorf(field.pos, "expected a field after by, found %s", field.describe())
+				}
+				stage.By = append(stage.By, field.text)
+				stage.ByPos = append(stage.ByPos, field.pos)
+				if p.peek().kind != "," {
+					break
+				}
+				p.next()
+			}
+		}
+		if p.peek().kind == "[" {
+			p.next()
+			step := p.next()
+			d, err := parseLongDuration(step.text)
+			if step.kind != "word" || err != nil {
+				return stage, queryErrorf(step.pos, "expected a duration such as 5m, found %s", step.describe())
+			}
+			stage.Step, stage.ArgsPos = d, step.pos
+			if end := p.next(); end.kind != "]" {
+				return stage, queryErrorf(end.pos, "expected ], found %s", end.describe())
+			}
+		}
+	case "limit":
+		n := p.next()
+		v, err := strconv.Atoi(n.text)
+		if n.kind != "word" || err != nil || v <= 0 {
+			return stage, queryErrorf(n.pos, "expected a positive number after limit, found %s", n.describe())
+		}
+		stage.N, stage.ArgsPos = v, n.pos
+	case "sort":
+		dir := p.next()
+		if dir.kind != "word" || (dir.text != "asc" && dir.text != "desc") {
+			return stage, queryErrorf(dir.pos, "expected asc or desc after sort, found %s", dir.describe())
+		}
+		stage.Ascend, stage.ArgsPos = dir.text == "asc", dir.pos
+	default:
+		return stage, queryErrorf(t.pos, "unknown stage %q (want count, limit or sort)", t.text)
+	}
+	return stage, nil
+}
+
+// compiledQuery is a query resolved against the store: a filter, plus the
+// count stage when there is one
+type compiledQuery struct {
+	Filter LogFilter
+	Count  bool
+	By     []logField
+	Step   time.Duration
+}
+
+// compile checks fields, levels and regular expressions and builds the store filter
+func (ast *queryAST) compile() (*compiledQuery, error) {
+	cq := &compiledQuery{Filter: LogFilter{Limit: defaultQueryLimit}}
+	var phrases []string
+
+	for _, sel := range ast.Selectors {
+		if sel.Field == "" {
+			if len(searchWords(sel.Value)) == 0 {
+				return nil, queryErrorf(sel.ValuePos, "search string has no searchable words")
+			}
+			if len(phrases) == maxSearchTerms {
+				return nil, queryErrorf(sel.Pos, "more than %d search strings", maxSearchTerms)
+			}
+			phrases = append(phrases, sel.Value)
+			continue
+		}
+
+		field, err := parseLogField(sel.Field)
+		if err != nil {
+			return nil, queryErrorf(sel.Pos, "%v", err)
+		}
+		// Level compares on the canonical severity, so aliases and ranges work
+		if field.Column == "level" && sel.Op != "=~" && sel.Op != "!~" {
+			sev, err := parseLevel(sel.Value)
+			if err != nil {
+				return nil, queryErrorf(sel.ValuePos, "%v", err)
+			}
+			cq.Filter.Levels = append(cq.Filter.Levels, levelFilter{Op: sel.Op, Severity: sev})
+			continue
+		}
+		if !field.allows(sel.Op) {
+			return nil, queryErrorf(sel.OpPos, "operator %s does not apply to %s", sel.Op, field)
+		}
+		m, err := newFieldMatcher(field, sel.Op, sel.Value)
+		if err != nil {
+			return nil, queryErrorf(sel.ValuePos, "%v", err)
+		}
+		cq.Filter.Matchers = append(cq.Filter.Matchers, m)
+	}
+	if len(phrases) > 0 {
+		cq.Filter.Search = phraseSearch(phrases)
+	}
+
+	for i, stage := range ast.Stages {
+		if cq.Count {
+			return nil, queryErrorf(stage.Pos, "count must be the last stage")
+		}
+		switch stage.Kind {
+		case "count":
+			if i > 0 {
+				return nil, queryErrorf(stage.Pos, "count cannot follow limit or sort")
+			}
+			cq.Count, cq.Step = true, stage.Step
+			for j, name := range stage.By {
+				field, err := parseLogField(name)
+				if err != nil {
+					return nil, queryErrorf(stage.ByPos[j], "%v", err)
+				}
+				cq.By = append(cq.By, field)
+			}
+		case "limit":
+			if stage.N > maxQueryLimit {
+				return nil, queryErrorf(stage.ArgsPos, "limit above %d", maxQueryLimit)
+			}
+			cq.Filter.Limit = stage.N
+		case "sort":
+			cq.Filter.Ascending = stage.Ascend
+		}
+	}
+	if cq.Count {
+		cq.Filter.Limit = 0
+	}
+	return cq, nil
+}
+
+// QueryRequest is the body of POST /query
+type QueryRequest struct {
+	Query string `json:"query"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// POST /query - Run a log query: matching events, or grouped counts with | count
+func (s *server) queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req QueryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxQueryLen)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	ast, err := parseQuery(req.Query)
+	if err == nil {
+		var cq *compiledQuery
+		if cq, err = ast.compile(); err == nil {
+			s.runQuery(w, r, req, cq)
+			return
+		}
+	}
+	writeQueryError(w, req.Query, err)
+}
+
+func (s *server) runQuery(w http.ResponseWriter, r *http.Request, req QueryRequest, cq *compiledQuery) {
+	for _, bound := range []struct {
+		raw  string
+		dest *time.Time
+	}{{req.From, &cq.Filter.From}, {req.To, &cq.Filter.To}} {
+		if bound.raw == "" {
+			continue
+		}
+		t, err := parseEventTime(bound.raw)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid time %q", bound.raw))
+			return
+		}
+		*bound.dest = t
+	}
+
+	if !cq.Count {
+		logs, err := s.store.Query(r.Context(), cq.Filter)
+		if err != nil {
+			log.Printf("❌ Error running query: %v", err)
+			http.Error(w, "Error running query", http.StatusInternalServerError)
+			return
+		}
+		for i := range logs {
+			logs[i].Message = scrubPII(logs[i].Message)
+			if cq.Filter.Search != nil {
+				logs[i].Highlights = cq.Filter.Search.highlight(logs[i].Message)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":  "logs",
+			"count": len(logs),
+			"logs":  logs,
+		})
+		return
+	}
+
+	s.writeCounts(w, r, cq.Filter, cq.By, cq.Step)
+}
+
+// writeCounts runs a grouped count and answers with its groups; POST /query and
+// GET /logs/aggregate share it
+func (s *server) writeCounts(w http.ResponseWriter, r *http.Request, f LogFilter, byFields []logField, step time.Duration) {
+	// Counting everything ever stored is rarely meant; default to the last hour
+	end := f.To
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if f.From.IsZero() {
+		f.From = end.Add(-defaultCountWindow)
+	}
+	if step > 0 && end.Sub(f.From)/step > maxCountBuckets {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Step %s gives more than %d buckets over the time range", step, maxCountBuckets))
+		return
+	}
+	f.Limit = 0
+
+	counts, err := s.store.Count(r.Context(), f, byFields, step)
+	if err != nil {
+		log.Printf("❌ Error counting logs: %v", err)
+		http.Error(w, "Error counting logs", http.StatusInternalServerError)
+		return
+	}
+	by := make([]string, len(byFields))
+	for i, field := range byFields {
+		by[i] = field.String()
+	}
+	resp := map[string]interface{}{
+		"type":      "count",
+		"by":        by,
+		"from":      formatEventTime(f.From),
+		"groups":    counts,
+		"truncated": len(counts) == maxCountGroups,
+	}
+	if step > 0 {
+		resp["step"] = step.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeQueryError answers 400 with the message and where in the query it applies
+func writeQueryError(w http.ResponseWriter, query string, err error) {
+	qe, ok := err.(*queryError)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Line and column are 1-based and count characters, for editors
+	line, col := 1, 1
+	for _, r := range query[:min(qe.Pos, len(query))] {
+		if r == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    qe.Msg,
+		"position": utf8.RuneCountInString(query[:min(qe.Pos, len(query))]),
+		"line":     line,
+		"column":   col,
+	})
+}
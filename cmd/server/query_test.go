@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	ast, err := parseQuery(`service=~"pay.*" level>=ERROR metadata.user_id="user_3" "timeout" | count by service, level [5m]`)
+	if err != nil {
+		t.Fatalf("parseQuery: %v", err)
+	}
+	if len(ast.Selectors) != 4 {
+		t.Fatalf("got %d selectors, want 4", len(ast.Selectors))
+	}
+	sel := ast.Selectors[0]
+	if sel.Field != "service" || sel.Op != "=~" || sel.Value != "pay.*" || sel.OpPos != 7 || sel.ValuePos != 9 {
+		t.Errorf("first selector = %+v", sel)
+	}
+	if search := ast.Selectors[3]; search.Field != "" || search.Value != "timeout" {
+		t.Errorf("search selector = %+v", search)
+	}
+	if len(ast.Stages) != 1 || ast.Stages[0].Kind != "count" || strings.Join(ast.Stages[0].By, ",") != "service,level" {
+		t.Fatalf("stages = %+v", ast.Stages)
+	}
+	if ast.Stages[0].Step.String() != "5m0s" {
+		t.Errorf("step = %s, want 5m", ast.Stages[0].Step)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{`service=`, 8, "expected a value after ="},
+		{`service "x"`, 8, "expected an operator"},
+		{`service="x`, 8, "unterminated string"},
+		{`service="\q"`, 8, "invalid string literal"},
+		{`service!"x"`, 7, "unexpected"},
+		{`(service="x")`, 0, "need no grouping"},
+		{`service="x" | `, 14, "expected a stage"},
+		{`service="x" | frobnicate`, 14, "unknown stage"},
+		{`service="x" | limit 0`, 20, "positive number"},
+		{`service="x" | sort up`, 19, "asc or desc"},
+		{`service="x" | count by`, 22, "expected a field after by"},
+		{`service="x" | count [5x]`, 21, "expected a duration"},
+		{`service="x" | count [5m`, 23, "expected ]"},
+		{`| limit 5 service="x"`, 10, "unexpected"},
+		{strings.Repeat("a", maxQueryLen+1), maxQueryLen, "longer than"},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.query)
+		checkQueryError(t, tt.query, err, tt.pos, tt.msg)
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	ast, err := parseQuery("service=api level>=WARN message=~`time\\d+` metadata.attempt>2 \"disk full\" | limit 5 | sort asc")
+	if err != nil {
+		t.Fatalf("parseQuery: %v", err)
+	}
+	cq, err := ast.compile()
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	f := cq.Filter
+	if f.Limit != 5 || !f.Ascending || cq.Count {
+		t.Errorf("limit=%d ascending=%t count=%t", f.Limit, f.Ascending, cq.Count)
+	}
+	if len(f.Levels) != 1 || f.Levels[0].Op != ">=" || f.Levels[0].Severity != sevWarning {
+		t.Errorf("levels = %+v", f.Levels)
+	}
+	if len(f.Matchers) != 3 || f.Search == nil {
+		t.Fatalf("matchers = %+v, search = %v", f.Matchers, f.Search)
+	}
+	if got := f.Matchers[1].pattern; got != `^(?:time[0-9]+)$` {
+		t.Errorf("regex pattern = %q", got)
+	}
+
+	ast, _ = parseQuery(`service=api | count by service [1h]`)
+	cq, err = ast.compile()
+	if err != nil {
+		t.Fatalf("compile count: %v", err)
+	}
+	if !cq.Count || len(cq.By) != 1 || cq.Filter.Limit != 0 {
+		t.Errorf("count query = %+v", cq)
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{`colour=red`, 0, "colour"},
+		{`service>api`, 7, "operator > does not apply to service"},
+		{`level=LOUD`, 6, "LOUD"},
+		{`service=~"pay("`, 9, "invalid regular expression"},
+		{"service=~`\\bpay`", 9, `\b is not supported`},
+		{`service=~"(?i)pay"`, 9, "only (?: groups"},
+		{`service=~"[[:alpha:]]+"`, 9, "[: in a character class"},
+		{`service=~"a{300}"`, 9, "exceeds 255"},
+		{`metadata.attempt>many`, 17, "needs a number"},
+		{`"  "`, 0, "no searchable words"},
+		{`service=api | limit 20000`, 20, "limit above"},
+		{`service=api | limit 5 | count`, 24, "count cannot follow"},
+		{`service=api | count | limit 5`, 22, "count must be the last stage"},
+		{`service=api | sort asc | count`, 25, "count cannot follow"},
+		{`service=api | count by colour`, 23, "colour"},
+	}
+	for _, tt := range tests {
+		ast, err := parseQuery(tt.query)
+		if err != nil {
+			t.Errorf("%s: parseQuery: %v", tt.query, err)
+			continue
+		}
+		_, err = ast.compile()
+		checkQueryError(t, tt.query, err, tt.pos, tt.msg)
+	}
+}
+
+func TestPortableRegex(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`pay.*`, `pay.*`},
+		{`\d+-\w+\s\D\W\S`, `[0-9]+-[0-9A-Za-z_]+[\t\n\f\r ][^0-9][^0-9A-Za-z_][^\t\n\f\r ]`},
+		{`[\d.]+`, `[0-9.]+`},
+		{`[]a]`, `[]a]`},
+		{`[^]\w]`, `[^]0-9A-Za-z_]`},
+		{`(?:a|b){2,3}x{4}y{1,}`, `(?:a|b){2,3}x{4}y{1,}`},
+		{`\.\*\{\}\(\)\[\]\\\t`, `\.\*\{\}\(\)\[\]\\\t`},
+		{`café`, `café`},
+	}
+	for _, tt := range tests {
+		got, err := portableRegex(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("portableRegex(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{`\bword`, `\Astart`, `end\z`, `\pL`, `\x41`, `\1`, `\Qa.b\E`, `(?P<n>a)`, `(?s).`, `(?=a)`, `[\D]`, `[[.a.]]`, `[[=a=]]`, `a{,3}`, `a{`, `a{256}`} {
+		if got, err := portableRegex(in); err == nil {
+			t.Errorf("portableRegex(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestRegexMatcherNewlines(t *testing.T) {
+	field, _ := parseLogField("message")
+	m, err := newFieldMatcher(field, "=~", `panic:.*main\.go`)
+	if err != nil {
+		t.Fatalf("newFieldMatcher: %v", err)
+	}
+	// Postgres lets . cross lines, so the memory store must too
+	evt := LogEvent{Message: "panic: boom\n\tmain.go"}
+	if !m.matches(&evt) {
+		t.Errorf("%q did not match a multi-line message", m.Value)
+	}
+}
+
+func checkQueryError(t *testing.T, query string, err error, pos int, msg string) {
+	t.Helper()
+	var qe *queryError
+	if !errors.As(err, &qe) {
+		t.Errorf("%q: got error %v, want a queryError", query, err)
+		return
+	}
+	if qe.Pos != pos || !strings.Contains(qe.Msg, msg) {
+		t.Errorf("%q: got %q at %d, want %q at %d", query, qe.Msg, qe.Pos, msg, pos)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Retention enforcer defaults, overridable via RETENTION_* environment variables
+const (
+	defaultRetentionInterval   = time.Hour
+	defaultRetentionBatchSize  = 5000
+	defaultRetentionBatchPause = 100 * time.Millisecond
+)
+
+// retentionRule keeps the events it matches for MaxAge. An empty Service and no
+// Levels match every event.
+type retentionRule struct {
+	Service string
+	Levels  []levelFilter
+	MaxAge  time.Duration
+	// As configured, for logs and reports
+	Spec string
+}
+
+// retentionScope is what one rule removes in a pass: events it matches that no
+// earlier rule claims, with a timestamp before Before. Events before NotBefore
+// are left alone because their whole partition is being dropped.
+type retentionScope struct {
+	Rule      retentionRule
+	Earlier   []retentionRule
+	Before    time.Time
+	NotBefore time.Time
+}
+
+// partitionDropper is implemented by stores that can remove a whole time range at
+// once, which is far cheaper than deleting its rows
+type partitionDropper interface {
+	// ExpiredPartitions lists attached partitions that end at or before before
+	ExpiredPartitions(ctx context.Context, before time.Time) ([]logPartition, error)
+	// DropPartition detaches and drops one partition; false means it was already gone
+	DropPartition(ctx context.Context, p logPartition) (bool, error)
+	// DetachedPartitions lists partitions detached from the store and not dropped yet
+	DetachedPartitions(ctx context.Context) ([]logPartition, error)
+	// DropDetached drops a detached partition
+	DropDetached(ctx context.Context, p logPartition) error
+}
+
+// parseRetentionRules reads RETENTION_RULES: comma-separated `selectors:age` rules
+// where selectors are `*` or `&`-joined `service=NAME` and `level<op>LEVEL`, e.g.
+//
+//	service=payment-service:365d, level>=ERROR:90d, level=DEBUG:3d, *:30d
+//
+// The first matching rule decides how long an event is kept; events no rule
+// matches are kept forever.
+func parseRetentionRules(raw string) ([]retentionRule, error) {
+	var rules []retentionRule
+	for _, spec := range strings.Split(raw, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.LastIndex(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("retention rule %q: want selectors:age", spec)
+		}
+		age, err := parseLongDuration(strings.TrimSpace(spec[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %q: %w", spec, err)
+		}
+		rule := retentionRule{MaxAge: age, Spec: spec}
+
+		if selectors := strings.TrimSpace(spec[:i]); selectors != "*" {
+			for _, sel := range strings.Split(selectors, "&") {
+				if err := rule.addSelector(strings.TrimSpace(sel)); err != nil {
+					return nil, fmt.Errorf("retention rule %q: %w", spec, err)
+				}
+			}
+		}
+
+		if n := len(rules); n > 0 && rules[n-1].catchAll() {
+			return nil, fmt.Errorf("retention rule %q: unreachable after catch-all rule %q", spec, rules[n-1].Spec)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *retentionRule) addSelector(sel string) error {
+	// The key runs up to the first operator character
+	end := strings.IndexAny(sel, "<>=")
+	if end < 0 {
+		return fmt.Errorf("invalid selector %q (want service=NAME or level<op>LEVEL)", sel)
+	}
+	key, rest := strings.TrimSpace(sel[:end]), sel[end:]
+	var op string
+	for _, candidate := range []string{">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	value := strings.TrimSpace(rest[len(op):])
+
+	switch {
+	case key == "service" && op == "=" && value != "":
+		if r.Service != "" {
+			return fmt.Errorf("more than one service selector")
+		}
+		r.Service = value
+	case key == "level":
+		sev, err := parseLevel(value)
+		if err != nil {
+			return err
+		}
+		r.Levels = append(r.Levels, levelFilter{Op: op, Severity: sev})
+	default:
+		return fmt.Errorf("invalid selector %q (want service=NAME or level<op>LEVEL)", sel)
+	}
+	return nil
+}
+
+func (r retentionRule) catchAll() bool {
+	return r.Service == "" && len(r.Levels) == 0
+}
+
+func (r retentionRule) matches(evt *LogEvent) bool {
+	if r.Service != "" && evt.Service != r.Service {
+		return false
+	}
+	for _, lf := range r.Levels {
+		if !lf.matches(evt.Severity) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether the scope removes an event stored at ts
+func (sc retentionScope) matches(evt *LogEvent, ts time.Time) bool {
+	if !ts.Before(sc.Before) || ts.Before(sc.NotBefore) || !sc.Rule.matches(evt) {
+		return false
+	}
+	for _, earlier := range sc.Earlier {
+		if earlier.matches(evt) {
+			return false
+		}
+	}
+	return true
+}
+
+// retentionEnforcer applies the rules in the background. Rows are deleted in
+// bounded batches with a pause in between, so a large backlog never holds locks
+// for long; partitions whose whole range has expired under every rule are
+// dropped instead, and so are archived files past the same age.
+type retentionEnforcer struct {
+	store LogStore
+	// Set when partitions are archived, so expired archive files go too
+	archive   *archiver
+	rules     []retentionRule
+	interval  time.Duration
+	batchSize int
+	pause     time.Duration
+}
+
+// retentionReport describes one pass, or what a pass would do in a dry run
+type retentionReport struct {
+	DryRun     bool                       `json:"dry_run"`
+	Events     int64                      `json:"events"`
+	Rules      []retentionRuleReport      `json:"rules"`
+	Partitions []retentionPartitionReport `json:"partitions"`
+	// Archived files removed whole, named by the partition they hold
+	Archives []retentionPartitionReport `json:"archives"`
+}
+
+type retentionRuleReport struct {
+	Rule   string `json:"rule"`
+	MaxAge string `json:"max_age"`
+	Cutoff string `json:"cutoff"`
+	Events int64  `json:"events"`
+}
+
+type retentionPartitionReport struct {
+	Name string `json:"name"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+}
+
+// newRetentionEnforcer reads RETENTION_* settings; invalid rules are fatal,
+// since guessing at a deletion policy is worse than not starting
+func newRetentionEnforcer(store LogStore) *retentionEnforcer {
+	rules, err := parseRetentionRules(os.Getenv("RETENTION_RULES"))
+	if err != nil {
+		log.Fatalf("Invalid RETENTION_RULES: %v", err)
+	}
+	return &retentionEnforcer{
+		store:     store,
+		rules:     rules,
+		interval:  envDuration("RETENTION_INTERVAL", defaultRetentionInterval),
+		batchSize: envPositiveInt("RETENTION_BATCH_SIZE", defaultRetentionBatchSize),
+		pause:     envDuration("RETENTION_BATCH_PAUSE", defaultRetentionBatchPause),
+	}
+}
+
+// start runs a pass every interval; without rules nothing is ever deleted
+func (e *retentionEnforcer) start() {
+	if len(e.rules) == 0 {
+		log.Println("⚠️ No RETENTION_RULES set, logs are kept forever")
+		return
+	}
+	specs := make([]string, len(e.rules))
+	for i, rule := range e.rules {
+		specs[i] = rule.Spec
+	}
+	log.Printf("✅ Retention enforcer started (%s, every %s)", strings.Join(specs, ", "), e.interval)
+
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+			report, err := e.run(ctx, e.rules, false)
+			cancel()
+			if err != nil {
+				log.Printf("❌ Retention pass failed: %v", err)
+			}
+			if report.Events > 0 || len(report.Partitions) > 0 || len(report.Archives) > 0 {
+				log.Printf("🧹 Retention removed %d events, %d partitions and %d archived files", report.Events, len(report.Partitions), len(report.Archives))
+			}
+		}
+	}()
+}
+
+// run enforces rules once. In a dry run nothing is removed and the report
+// counts what would be. A failed pass reports what it removed before the error.
+func (e *retentionEnforcer) run(ctx context.Context, rules []retentionRule, dryRun bool) (retentionReport, error) {
+	report := retentionReport{DryRun: dryRun, Rules: []retentionRuleReport{}, Partitions: []retentionPartitionReport{}, Archives: []retentionPartitionReport{}}
+	now := time.Now().UTC()
+
+	// A partition can only go whole once every rule has expired it, which
+	// needs a catch-all rule and the longest age of all
+	var notBefore time.Time
+	dropper, ok := e.store.(partitionDropper)
+	if n := len(rules); ok && n > 0 && rules[n-1].catchAll() {
+		var longest time.Duration
+		for _, rule := range rules {
+			longest = max(longest, rule.MaxAge)
+		}
+		partitions, err := dropper.ExpiredPartitions(ctx, now.Add(-longest))
+		if err != nil {
+			return report, fmt.Errorf("error listing partitions: %w", err)
+		}
+		// Detached partitions (PARTITION_DETACH_AFTER, or one the archiver has not
+		// finished) are out of reach of row deletes, so they go whole once expired
+		detached, err := dropper.DetachedPartitions(ctx)
+		if err != nil {
+			return report, fmt.Errorf("error listing detached partitions: %w", err)
+		}
+		for _, p := range detached {
+			if !p.To.After(now.Add(-longest)) {
+				partitions = append(partitions, p)
+			}
+		}
+		for _, p := range partitions {
+			if !dryRun {
+				if p.Detached {
+					if err := dropper.DropDetached(ctx, p); err != nil {
+						return report, fmt.Errorf("error dropping detached partition %s: %w", p.Name, err)
+					}
+				} else {
+					dropped, err := dropper.DropPartition(ctx, p)
+					if err != nil {
+						return report, fmt.Errorf("error dropping partition %s: %w", p.Name, err)
+					}
+					if !dropped {
+						continue
+					}
+				}
+				log.Printf("🧹 Dropped partition %s (events before %s)", p.Name, p.To.Format(time.RFC3339))
+			}
+			pr := retentionPartitionReport{Name: p.Name, To: p.To.Format(time.RFC3339)}
+			if !p.From.IsZero() {
+				pr.From = p.From.Format(time.RFC3339)
+			}
+			report.Partitions = append(report.Partitions, pr)
+			// Dropped rows are already gone; a dry run must not count them twice
+			if dryRun && p.To.After(notBefore) {
+				notBefore = p.To
+			}
+		}
+
+		if e.archive != nil {
+			expired, err := e.archive.expire(ctx, now.Add(-longest), dryRun)
+			if err != nil {
+				return report, fmt.Errorf("error expiring archived files: %w", err)
+			}
+			for _, entry := range expired {
+				if !dryRun {
+					log.Printf("🧹 Deleted archived file %s (events before %s)", entry.Key, entry.To.Format(time.RFC3339))
+				}
+				ar := retentionPartitionReport{Name: entry.Partition, To: entry.To.Format(time.RFC3339)}
+				if !entry.From.IsZero() {
+					ar.From = entry.From.Format(time.RFC3339)
+				}
+				report.Archives = append(report.Archives, ar)
+			}
+		}
+	}
+
+	for i, rule := range rules {
+		scope := retentionScope{Rule: rule, Earlier: rules[:i], Before: now.Add(-rule.MaxAge), NotBefore: notBefore}
+		rr := retentionRuleReport{Rule: rule.Spec, MaxAge: rule.MaxAge.String(), Cutoff: formatEventTime(scope.Before)}
+
+		if dryRun {
+			n, err := e.store.CountExpired(ctx, scope)
+			if err != nil {
+				return report, fmt.Errorf("rule %q: %w", rule.Spec, err)
+			}
+			rr.Events = n
+			report.Events += n
+		} else {
+			for {
+				n, err := e.store.DeleteExpired(ctx, scope, e.batchSize)
+				rr.Events += n
+				report.Events += n
+				if err != nil {
+					report.Rules = append(report.Rules, rr)
+					return report, fmt.Errorf("rule %q: %w", rule.Spec, err)
+				}
+				// A short (or empty) batch means nothing expired is left
+				if n == 0 || n < int64(e.batchSize) {
+					break
+				}
+				select {
+				case <-time.After(e.pause):
+				case <-ctx.Done():
+					report.Rules = append(report.Rules, rr)
+					return report, ctx.Err()
+				}
+			}
+		}
+		report.Rules = append(report.Rules, rr)
+	}
+	return report, nil
+}
+
+// GET /retention/dry-run - Report what the retention rules would remove now.
+// ?rules= previews a candidate RETENTION_RULES value instead of the configured one.
+func (s *server) retentionDryRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules := s.retention.rules
+	if raw := r.URL.Query().Get("rules"); raw != "" {
+		var err error
+		if rules, err = parseRetentionRules(raw); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	report, err := s.retention.run(r.Context(), rules, true)
+	if err != nil {
+		log.Printf("❌ Error in retention dry run: %v", err)
+		http.Error(w, "Error evaluating retention rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search query limits, so one request can't build an arbitrarily expensive query
+const (
+	maxSearchQueryLen = 1024
+	maxSearchTerms    = 32
+	minSubstringLen   = 3 // shortest substring the trigram index can serve
+
+	maxHighlightFragments = 3
+	highlightContext      = 40 // bytes of message kept on each side of a match
+)
+
+// searchQuery is a parsed `q` parameter. The grammar, loosest binding first:
+//
+//	a OR b          either side matches
+//	a AND b, a b    both sides match
+//	NOT a, -a       a does not match
+//	(a OR b) c      grouping
+//	"disk full"     the words as a phrase
+//	time*           a word starting with time
+//	*EOUT*          eout anywhere in the message, in any case
+//	TIMEOUT         the word timeout in any case
+//
+// Words match whole tokens of the message the way Postgres full-text search
+// splits it; hyphenated ids such as ORD-5012 match as a whole and by their parts.
+type searchQuery struct {
+	root *searchNode
+}
+
+type searchNode struct {
+	kind     string // and, or, not, word, prefix, phrase, substring
+	text     string
+	children []*searchNode
+}
+
+// parseSearchQuery parses q; an error describes what is wrong with the query
+func parseSearchQuery(q string) (*searchQuery, error) {
+	if len(q) > maxSearchQueryLen {
+		return nil, fmt.Errorf("search query longer than %d bytes", maxSearchQueryLen)
+	}
+	tokens, err := lexSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+
+	p := &searchParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in search query", p.tokens[p.pos].text)
+	}
+	if p.terms > maxSearchTerms {
+		return nil, fmt.Errorf("search query has more than %d terms", maxSearchTerms)
+	}
+	return &searchQuery{root: root}, nil
+}
+
+// phraseSearch requires every phrase in the message, as a query of quoted phrases ANDed together would
+func phraseSearch(phrases []string) *searchQuery {
+	var root *searchNode
+	for _, phrase := range phrases {
+		node := &searchNode{kind: "phrase", text: phrase}
+		if root != nil {
+			node = &searchNode{kind: "and", children: []*searchNode{root, node}}
+		}
+		root = node
+	}
+	return &searchQuery{root: root}
+}
+
+type searchToken struct {
+	kind string // term, phrase, (, ), -
+	text string
+}
+
+func lexSearchQuery(q string) ([]searchToken, error) {
+	var tokens []searchToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, searchToken{kind: string(c)})
+			i++
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated phrase in search query")
+			}
+			tokens = append(tokens, searchToken{kind: "phrase", text: q[i+1 : i+1+end]})
+			i += end + 2
+		case c == '-' && i+1 < len(q) && !strings.ContainsRune(" \t\n\r)", rune(q[i+1])):
+			tokens = append(tokens, searchToken{kind: "-"})
+			i++
+		default:
+			end := strings.IndexAny(q[i:], " \t\n\r()\"")
+			if end < 0 {
+				end = len(q) - i
+			}
+			tokens = append(tokens, searchToken{kind: "term", text: q[i : i+end]})
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+	terms  int
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword reports whether the next token is the operator word (upper case only,
+// so "and" and "not" can still be searched for)
+func (p *searchParser) keyword(word string) bool {
+	t, ok := p.peek()
+	return ok && t.kind == "term" && t.text == word
+}
+
+func (p *searchParser) parseOr() (*searchNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &searchNode{kind: "or", children: []*searchNode{left, right}}
+	}
+	return left, nil
+}
+
+func (p *searchParser) parseAnd() (*searchNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == ")" || p.keyword("OR") {
+			return left, nil
+		}
+		if p.keyword("AND") {
+			p.pos++
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &searchNode{kind: "and", children: []*searchNode{left, right}}
+	}
+}
+
+func (p *searchParser) parseUnary() (*searchNode, error) {
+	t, ok := p.peek()
+	if ok && (t.kind == "-" || p.keyword("NOT")) {
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &searchNode{kind: "not", children: []*searchNode{child}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (*searchNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("search query ends where a term was expected")
+	}
+	p.pos++
+
+	switch t.kind {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next, ok := p.peek(); !ok || next.kind != ")" {
+			return nil, fmt.Errorf("missing ) in search query")
+		}
+		p.pos++
+		return node, nil
+	case "phrase":
+		p.terms++
+		if len(searchWords(t.text)) == 0 {
+			return nil, fmt.Errorf("phrase %q has no searchable words", t.text)
+		}
+		return &searchNode{kind: "phrase", text: t.text}, nil
+	case "term":
+		if t.text == "AND" || t.text == "OR" {
+			return nil, fmt.Errorf("%s needs a term on both sides", t.text)
+		}
+		p.terms++
+		return parseSearchTerm(t.text)
+	default:
+		return nil, fmt.Errorf("unexpected %q in search query", t.kind)
+	}
+}
+
+func parseSearchTerm(term string) (*searchNode, error) {
+	switch {
+	case strings.HasPrefix(term, "*"):
+		text := strings.Trim(term, "*")
+		if utf8.RuneCountInString(text) < minSubstringLen {
+			return nil, fmt.Errorf("substring %q needs at least %d characters", term, minSubstringLen)
+		}
+		return &searchNode{kind: "substring", text: text}, nil
+	case strings.HasSuffix(term, "*"):
+		text := strings.TrimRight(term, "*")
+		if len(searchTokens(text)) == 0 {
+			return nil, fmt.Errorf("prefix %q has no searchable characters", term)
+		}
+		return &searchNode{kind: "prefix", text: text}, nil
+	default:
+		if len(searchTokens(term)) == 0 {
+			return nil, fmt.Errorf("term %q has no searchable characters", term)
+		}
+		return &searchNode{kind: "word", text: term}, nil
+	}
+}
+
+// The expression of the logs_message_fts_idx index; queries must repeat it exactly
+const messageTSVector = `to_tsvector('simple', message)`
+
+// sql renders the query as a boolean condition for a WHERE clause that already has argCount-1 args
+func (q *searchQuery) sql(args []interface{}, argCount int) (string, []interface{}, int) {
+	return q.root.sql(args, argCount)
+}
+
+func (n *searchNode) sql(args []interface{}, argCount int) (string, []interface{}, int) {
+	var cond, left, right string
+	switch n.kind {
+	case "and", "or":
+		left, args, argCount = n.children[0].sql(args, argCount)
+		right, args, argCount = n.children[1].sql(args, argCount)
+		return fmt.Sprintf("(%s %s %s)", left, strings.ToUpper(n.kind), right), args, argCount
+	case "not":
+		left, args, argCount = n.children[0].sql(args, argCount)
+		return "NOT " + left, args, argCount
+	case "word":
+		cond = fmt.Sprintf("%s @@ plainto_tsquery('simple', $%d)", messageTSVector, argCount)
+		args = append(args, n.text)
+	case "prefix":
+		// quote_literal keeps tsquery syntax in the term from being interpreted
+		cond = fmt.Sprintf("%s @@ to_tsquery('simple', quote_literal($%d) || ':*')", messageTSVector, argCount)
+		args = append(args, n.text)
+	case "phrase":
+		cond = fmt.Sprintf("%s @@ phraseto_tsquery('simple', $%d)", messageTSVector, argCount)
+		args = append(args, n.text)
+	case "substring":
+		cond = fmt.Sprintf("message ILIKE $%d", argCount)
+		args = append(args, "%"+likeEscaper.Replace(n.text)+"%")
+	}
+	return "(" + cond + ")", args, argCount + 1
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// searchDoc is a message split the way the matcher and highlighter need it
+type searchDoc struct {
+	message string
+	lower   string
+	words   []searchSpan // letter/digit runs in order
+	tokens  map[string]bool
+}
+
+type searchSpan struct {
+	start, end int
+	word       string // lower-cased
+}
+
+func newSearchDoc(message string) *searchDoc {
+	d := &searchDoc{message: message, lower: strings.ToLower(message), tokens: map[string]bool{}}
+	d.words = wordSpans(message)
+	for _, w := range d.words {
+		d.tokens[w.word] = true
+	}
+	for _, compound := range hyphenatedWords(message, d.words) {
+		d.tokens[compound] = true
+	}
+	return d
+}
+
+// wordSpans finds the runs of letters and digits, which is how the Postgres
+// parser splits ordinary text
+func wordSpans(s string) []searchSpan {
+	var spans []searchSpan
+	start := -1
+	for i, r := range s {
+		alnum := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if alnum && start < 0 {
+			start = i
+		} else if !alnum && start >= 0 {
+			spans = append(spans, searchSpan{start, i, strings.ToLower(s[start:i])})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, searchSpan{start, len(s), strings.ToLower(s[start:])})
+	}
+	return spans
+}
+
+// hyphenatedWords returns words joined by single hyphens (ORD-5012), which Postgres
+// indexes whole as well as by part
+func hyphenatedWords(s string, words []searchSpan) []string {
+	var compounds []string
+	for i := 0; i < len(words); {
+		j := i
+		for j+1 < len(words) && words[j].end+1 == words[j+1].start && s[words[j].end] == '-' {
+			j++
+		}
+		if j > i {
+			compounds = append(compounds, strings.ToLower(s[words[i].start:words[j].end]))
+		}
+		i = j + 1
+	}
+	return compounds
+}
+
+func searchWords(s string) []string {
+	spans := wordSpans(s)
+	words := make([]string, len(spans))
+	for i, span := range spans {
+		words[i] = span.word
+	}
+	return words
+}
+
+// searchTokens is what plainto_tsquery looks for: each word, plus hyphenated compounds
+func searchTokens(s string) []string {
+	spans := wordSpans(s)
+	return append(searchWords(s), hyphenatedWords(s, spans)...)
+}
+
+// matches evaluates the query against a message the way the SQL condition does
+func (q *searchQuery) matches(message string) bool {
+	return q.root.matches(newSearchDoc(message))
+}
+
+func (n *searchNode) matches(d *searchDoc) bool {
+	switch n.kind {
+	case "and":
+		return n.children[0].matches(d) && n.children[1].matches(d)
+	case "or":
+		return n.children[0].matches(d) || n.children[1].matches(d)
+	case "not":
+		return !n.children[0].matches(d)
+	case "word":
+		for _, t := range searchTokens(n.text) {
+			if !d.tokens[t] {
+				return false
+			}
+		}
+		return true
+	case "prefix":
+		for _, t := range searchTokens(n.text) {
+			found := false
+			for token := range d.tokens {
+				if strings.HasPrefix(token, t) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case "phrase":
+		return len(n.phraseSpans(d)) > 0
+	case "substring":
+		return strings.Contains(d.lower, strings.ToLower(n.text))
+	}
+	return false
+}
+
+// phraseSpans finds where the phrase's words appear consecutively
+func (n *searchNode) phraseSpans(d *searchDoc) [][2]int {
+	want := searchWords(n.text)
+	var spans [][2]int
+	for i := 0; i+len(want) <= len(d.words); i++ {
+		match := true
+		for j, w := range want {
+			if d.words[i+j].word != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			spans = append(spans, [2]int{d.words[i].start, d.words[i+len(want)-1].end})
+		}
+	}
+	return spans
+}
+
+// spans collects the byte ranges the positive terms match; terms under NOT are
+// never highlighted
+func (n *searchNode) spans(d *searchDoc, out [][2]int) [][2]int {
+	switch n.kind {
+	case "and", "or":
+		for _, child := range n.children {
+			out = child.spans(d, out)
+		}
+	case "word", "prefix":
+		tokens := searchTokens(n.text)
+		for _, w := range d.words {
+			for _, t := range tokens {
+				if w.word == t || (n.kind == "prefix" && strings.HasPrefix(w.word, t)) {
+					out = append(out, [2]int{w.start, w.end})
+					break
+				}
+			}
+		}
+	case "phrase":
+		out = append(out, n.phraseSpans(d)...)
+	case "substring":
+		// Offsets in the lower-cased copy only line up when lowering kept the length
+		if len(d.lower) != len(d.message) {
+			break
+		}
+		needle := strings.ToLower(n.text)
+		for i := 0; ; {
+			j := strings.Index(d.lower[i:], needle)
+			if j < 0 {
+				break
+			}
+			out = append(out, [2]int{i + j, i + j + len(needle)})
+			i += j + len(needle)
+		}
+	}
+	return out
+}
+
+// highlight returns up to maxHighlightFragments excerpts of message with the
+// matches wrapped in <mark></mark>. The text is HTML-escaped, so the fragments
+// are safe to render as markup.
+func (q *searchQuery) highlight(message string) []string {
+	spans := q.root.spans(newSearchDoc(message), nil)
+	if len(spans) == 0 {
+		return nil
+	}
+
+	// Merge overlapping matches
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if s[0] <= last[1] {
+			last[1] = max(last[1], s[1])
+		} else {
+			merged = append(merged, s)
+		}
+	}
+
+	// Group matches close enough to share a fragment
+	var fragments []string
+	for i := 0; i < len(merged) && len(fragments) < maxHighlightFragments; {
+		j := i
+		for j+1 < len(merged) && merged[j+1][0]-merged[j][1] <= 2*highlightContext {
+			j++
+		}
+		start := runeBoundary(message, max(merged[i][0]-highlightContext, 0))
+		end := runeBoundary(message, min(merged[j][1]+highlightContext, len(message)))
+
+		var b strings.Builder
+		if start > 0 {
+			b.WriteString("…")
+		}
+		pos := start
+		for _, s := range merged[i : j+1] {
+			b.WriteString(html.EscapeString(message[pos:s[0]]))
+			b.WriteString("<mark>")
+			b.WriteString(html.EscapeString(message[s[0]:s[1]]))
+			b.WriteString("</mark>")
+			pos = s[1]
+		}
+		b.WriteString(html.EscapeString(message[pos:end]))
+		if end < len(message) {
+			b.WriteString("…")
+		}
+		fragments = append(fragments, b.String())
+		i = j + 1
+	}
+	return fragments
+}
+
+// runeBoundary moves i back to the start of the rune it falls in
+func runeBoundary(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
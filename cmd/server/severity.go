@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Canonical severities. The numbers follow the OpenTelemetry severity ranges so
+// OTLP records map straight across, and they are stored in the severity column
+// so queries can compare ranges (severity >= WARNING) instead of level strings.
+const (
+	sevTrace   = 1
+	sevDebug   = 5
+	sevInfo    = 9
+	sevWarning = 13
+	sevError   = 17
+	sevFatal   = 21
+)
+
+var severityNames = map[int]string{
+	sevTrace:   "TRACE",
+	sevDebug:   "DEBUG",
+	sevInfo:    "INFO",
+	sevWarning: "WARNING",
+	sevError:   "ERROR",
+	sevFatal:   "FATAL",
+}
+
+// levelAliases maps the spellings producers use onto canonical severities
+var levelAliases = map[string]int{
+	"TRACE": sevTrace, "TRC": sevTrace, "FINEST": sevTrace, "FINER": sevTrace,
+	"DEBUG": sevDebug, "DBG": sevDebug, "FINE": sevDebug, "VERBOSE": sevDebug,
+	"INFO": sevInfo, "INF": sevInfo, "INFORMATION": sevInfo, "INFORMATIONAL": sevInfo, "NOTICE": sevInfo, "LOG": sevInfo, "CONFIG": sevInfo,
+	"WARNING": sevWarning, "WARN": sevWarning, "WRN": sevWarning,
+	"ERROR": sevError, "ERR": sevError, "SEVERE": sevError, "EXCEPTION": sevError,
+	"FATAL": sevFatal, "CRITICAL": sevFatal, "CRIT": sevFatal, "ALERT": sevFatal, "EMERGENCY": sevFatal, "EMERG": sevFatal, "PANIC": sevFatal,
+}
+
+// Field limits enforced at ingest
+const (
+	maxServiceLen    = 255
+	maxRouteLen      = 2048
+	maxEventIDLen    = 256
+	maxMessageBytes  = 256 << 10
+	maxMetadataBytes = 64 << 10
+)
+
+// severityName returns the canonical level for a severity number
+func severityName(sev int) string {
+	return severityNames[canonicalSeverity(sev)]
+}
+
+// canonicalSeverity rounds an OpenTelemetry-style number (1-24) down to its canonical severity
+func canonicalSeverity(sev int) int {
+	switch {
+	case sev >= sevFatal:
+		return sevFatal
+	case sev >= sevError:
+		return sevError
+	case sev >= sevWarning:
+		return sevWarning
+	case sev >= sevInfo:
+		return sevInfo
+	case sev >= sevDebug:
+		return sevDebug
+	default:
+		return sevTrace
+	}
+}
+
+// parseLevel maps a level name, alias or syslog severity number (0-7) to a canonical severity
+func parseLevel(raw string) (int, error) {
+	level := strings.ToUpper(strings.TrimSpace(raw))
+	if sev, ok := levelAliases[level]; ok {
+		return sev, nil
+	}
+	if n, err := strconv.Atoi(level); err == nil && n >= 0 && n <= 7 {
+		return levelAliases[syslogSeverityLevel(n)], nil
+	}
+	return 0, fmt.Errorf("unknown level %q", raw)
+}
+
+// foreignLevel canonicalizes a level from a third-party protocol. Unknown values
+// are kept in metadata as original_level and become INFO, rather than failing a
+// whole push over one odd label.
+func foreignLevel(evt *LogEvent) {
+	if evt.Level == "" {
+		return
+	}
+	if sev, err := parseLevel(evt.Level); err == nil {
+		evt.Level = severityNames[sev]
+		return
+	}
+	if evt.Metadata == nil {
+		evt.Metadata = map[string]interface{}{}
+	}
+	evt.Metadata["original_level"] = evt.Level
+	evt.Level = ""
+}
+
+// levelFilter is one severity comparison from a query string
+type levelFilter struct {
+	Op       string // =, !=, >=, <=, >, <
+	Severity int
+}
+
+// parseLevelFilters reads level constraints from a query string. It accepts
+// level=ERROR, level=>=WARNING, the literal level>=WARNING (which a URL parses as
+// key "level>"), and min_level / max_level.
+func parseLevelFilters(q url.Values) ([]levelFilter, error) {
+	var filters []levelFilter
+	add := func(op, raw string) error {
+		sev, err := parseLevel(raw)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, levelFilter{Op: op, Severity: sev})
+		return nil
+	}
+
+	for _, v := range q["level"] {
+		op := "="
+		for _, prefix := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(v, prefix) {
+				op, v = prefix, v[len(prefix):]
+				break
+			}
+		}
+		if err := add(op, v); err != nil {
+			return nil, err
+		}
+	}
+	for key, op := range map[string]string{"level>": ">=", "min_level": ">=", "level<": "<=", "max_level": "<="} {
+		for _, v := range q[key] {
+			if err := add(op, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return filters, nil
+}
+
+// matches compares a stored severity the way the SQL comparison does
+func (f levelFilter) matches(severity int) bool {
+	switch f.Op {
+	case ">=":
+		return severity >= f.Severity
+	case "<=":
+		return severity <= f.Severity
+	case ">":
+		return severity > f.Severity
+	case "<":
+		return severity < f.Severity
+	case "!=":
+		return severity != f.Severity
+	default:
+		return severity == f.Severity
+	}
+}
+
+// sqlLevelFilters appends severity comparisons to a WHERE clause that already has argCount-1 args
+func sqlLevelFilters(filters []levelFilter, query string, args []interface{}, argCount int) (string, []interface{}, int) {
+	for _, f := range filters {
+		query += fmt.Sprintf(" AND severity %s $%d", f.Op, argCount)
+		args = append(args, f.Severity)
+		argCount++
+	}
+	return query, args, argCount
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Acknowledgement ids remembered per channel before the oldest are forgotten
+	maxHECAcksPerChannel = 10000
+	// Channels tracked at once; past this the least recently used is forgotten
+	maxHECChannels = 10000
+	// Default HEC_ACK_TTL: how long an unused channel keeps its ack ids
+	defaultHECAckTTL = 10 * time.Minute
+)
+
+// hecResponse is the body shape of every HEC reply
+type hecResponse struct {
+	Text               string `json:"text"`
+	Code               int    `json:"code"`
+	AckID              *int64 `json:"ackId,omitempty"`
+	InvalidEventNumber *int   `json:"invalid-event-number,omitempty"`
+}
+
+func writeHEC(w http.ResponseWriter, status int, resp hecResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeHECInvalid(w http.ResponseWriter, text string, code, eventNumber int) {
+	writeHEC(w, http.StatusBadRequest, hecResponse{Text: text, Code: code, InvalidEventNumber: &eventNumber})
+}
+
+// hecEvent is one event posted to /services/collector/event
+type hecEvent struct {
+	Time       json.RawMessage        `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	Sourcetype string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      json.RawMessage        `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// hecAckTracker hands out per-channel acknowledgement ids and remembers which
+// ones the write pipeline has committed, so indexer-acknowledgement clients can poll for them.
+// Channel names come from clients, so channels unused for ttl are forgotten and
+// at most maxHECChannels are kept.
+type hecAckTracker struct {
+	mu        sync.Mutex
+	channels  map[string]*hecChannel
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+type hecChannel struct {
+	next      int64
+	committed map[int64]bool
+	order     []int64
+	lastUsed  time.Time
+}
+
+func newHECAckTracker(ttl time.Duration) *hecAckTracker {
+	return &hecAckTracker{channels: map[string]*hecChannel{}, ttl: ttl, lastSweep: time.Now()}
+}
+
+// expire forgets idle channels, and the least recently used ones while there are
+// still too many; callers hold mu
+func (t *hecAckTracker) expire(now time.Time) {
+	if now.Sub(t.lastSweep) >= t.ttl/2 || len(t.channels) >= maxHECChannels {
+		t.lastSweep = now
+		for name, ch := range t.channels {
+			if now.Sub(ch.lastUsed) > t.ttl {
+				delete(t.channels, name)
+			}
+		}
+	}
+	for len(t.channels) >= maxHECChannels {
+		var oldest string
+		for name, ch := range t.channels {
+			if oldest == "" || ch.lastUsed.Before(t.channels[oldest].lastUsed) {
+				oldest = name
+			}
+		}
+		delete(t.channels, oldest)
+	}
+}
+
+// reserve allocates the next ack id on the channel; it reads false until committed
+func (t *hecAckTracker) reserve(channel string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	ch, ok := t.channels[channel]
+	if !ok {
+		t.expire(now)
+		ch = &hecChannel{committed: map[int64]bool{}}
+		t.channels[channel] = ch
+	}
+	ch.lastUsed = now
+	id := ch.next
+	ch.next++
+	ch.committed[id] = false
+	ch.order = append(ch.order, id)
+	if len(ch.order) > maxHECAcksPerChannel {
+		delete(ch.committed, ch.order[0])
+		ch.order = ch.order[1:]
+	}
+	return id
+}
+
+// commit marks an ack id as written to the database
+func (t *hecAckTracker) commit(channel string, id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ch, ok := t.channels[channel]; ok {
+		if _, pending := ch.committed[id]; pending {
+			ch.committed[id] = true
+		}
+	}
+}
+
+// release forgets an ack id whose events were never queued, so it does not
+// hold a slot on the channel or read pending forever
+func (t *hecAckTracker) release(channel string, id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch, ok := t.channels[channel]
+	if !ok {
+		return
+	}
+	delete(ch.committed, id)
+	if i := slices.Index(ch.order, id); i >= 0 {
+		ch.order = slices.Delete(ch.order, i, i+1)
+	}
+}
+
+// query reports the status of each ack id; committed ids are forgotten once reported
+func (t *hecAckTracker) query(channel string, ids []int64) map[string]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]bool, len(ids))
+	ch := t.channels[channel]
+	if ch != nil {
+		ch.lastUsed = time.Now()
+	}
+	for _, id := range ids {
+		done := ch != nil && ch.committed[id]
+		if done {
+			delete(ch.committed, id)
+		}
+		result[strconv.FormatInt(id, 10)] = done
+	}
+	return result
+}
+
+// hecAuthorized checks "Authorization: Splunk <token>" against HEC_TOKENS.
+// With no tokens configured the collector accepts any caller.
+func hecAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	configured := os.Getenv("HEC_TOKENS")
+	if configured == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		writeHEC(w, http.StatusUnauthorized, hecResponse{Text: "Token is required", Code: 2})
+		return false
+	}
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Splunk") || token == "" {
+		writeHEC(w, http.StatusUnauthorized, hecResponse{Text: "Invalid authorization", Code: 3})
+		return false
+	}
+	// Constant-time so response timing does not reveal how much of a token matched
+	match := 0
+	for _, valid := range strings.Split(configured, ",") {
+		match |= subtle.ConstantTimeCompare([]byte(strings.TrimSpace(valid)), []byte(token))
+	}
+	if match == 1 {
+		return true
+	}
+	writeHEC(w, http.StatusForbidden, hecResponse{Text: "Invalid token", Code: 4})
+	return false
+}
+
+// hecChannelID reads the request channel from the header or query string
+func hecChannelID(r *http.Request) string {
+	if ch := r.Header.Get("X-Splunk-Request-Channel"); ch != "" {
+		return ch
+	}
+	return r.URL.Query().Get("channel")
+}
+
+// parseHECTime accepts epoch seconds with optional fraction, as a number or string
+func parseHECTime(raw json.RawMessage) (string, error) {
+	s := strings.Trim(string(raw), `"`)
+	if s == "" || s == "null" {
+		return "", nil
+	}
+	t, err := parseEpochSeconds(s)
+	if err != nil {
+		return "", errors.New("invalid time")
+	}
+	return formatEventTime(t), nil
+}
+
+// hecMetadata collects host/source/sourcetype/index and indexed fields
+func hecMetadata(host, source, sourcetype, index string, fields map[string]interface{}) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		metadata[k] = v
+	}
+	for k, v := range map[string]string{"host": host, "source": source, "sourcetype": sourcetype, "index": index} {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// hecToEvent maps a HEC event onto LogEvent. String events become the message;
+// object events contribute message/level/service fields and keep the rest as metadata.
+func hecToEvent(he hecEvent) (LogEvent, error) {
+	ts, err := parseHECTime(he.Time)
+	if err != nil {
+		return LogEvent{}, err
+	}
+
+	metadata := hecMetadata(he.Host, he.Source, he.Sourcetype, he.Index, he.Fields)
+	evt := LogEvent{Timestamp: ts, Metadata: metadata}
+
+	var text string
+	if err := json.Unmarshal(he.Event, &text); err == nil {
+		evt.Message = text
+	} else {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(he.Event, &obj); err != nil {
+			evt.Message = string(he.Event)
+		} else {
+			evt.Message = popString(obj, "message", "msg")
+			evt.Level = popString(obj, "level", "severity")
+			evt.Service = popString(obj, "service")
+			evt.Route = popString(obj, "route")
+			for k, v := range obj {
+				metadata[k] = v
+			}
+			if evt.Message == "" {
+				evt.Message = string(he.Event)
+			}
+		}
+	}
+
+	// Indexed fields may also name the service or level
+	if evt.Service == "" {
+		evt.Service = popString(metadata, "service")
+	}
+	if evt.Level == "" {
+		evt.Level = popString(metadata, "level")
+	}
+	if evt.Service == "" {
+		evt.Service = "unknown_service"
+	}
+	foreignLevel(&evt)
+	return evt, nil
+}
+
+// storeHEC queues events and replies with Success plus an ack id when a channel is
+// in use; the ack flips to true once the write pipeline has committed the events
+func (s *server) storeHEC(w http.ResponseWriter, r *http.Request, events []LogEvent) {
+	events = s.multiline.assemble(events)
+	resp := hecResponse{Text: "Success", Code: 0}
+
+	var onCommit func(error)
+	var release func()
+	if channel := hecChannelID(r); channel != "" {
+		id := s.hecAcks.reserve(channel)
+		release = func() { s.hecAcks.release(channel, id) }
+		resp.AckID = &id
+		onCommit = func(err error) {
+			if err == nil {
+				s.hecAcks.commit(channel, id)
+			}
+		}
+	}
+
+	if err := s.pipeline.Enqueue(events, onCommit); err != nil {
+		// Nothing was queued, so the ack id will never commit
+		if release != nil {
+			release()
+		}
+		s.pipeline.setRetryAfter(w)
+		writeHEC(w, http.StatusServiceUnavailable, hecResponse{Text: "Server is busy", Code: 9})
+		return
+	}
+	log.Printf("✅ QUEUED HEC: events=%d", len(events))
+	writeHEC(w, http.StatusOK, resp)
+}
+
+// POST /services/collector/event - concatenated JSON events
+func (s *server) hecEventHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hecAuthorized(w, r) {
+		return
+	}
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Events are concatenated objects, optionally separated by whitespace
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var events []LogEvent
+	for n := 0; ; n++ {
+		var he hecEvent
+		err := dec.Decode(&he)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeHECInvalid(w, "Invalid data format", 6, n)
+			return
+		}
+		if len(he.Event) == 0 {
+			writeHECInvalid(w, "Event field is required", 12, n)
+			return
+		}
+		if string(he.Event) == `""` || string(he.Event) == "null" {
+			writeHECInvalid(w, "Event field cannot be blank", 13, n)
+			return
+		}
+
+		evt, err := hecToEvent(he)
+		if err == nil {
+			err = validateEvent(&evt)
+		}
+		if err != nil {
+			writeHECInvalid(w, "Invalid data format", 6, n)
+			return
+		}
+		events = append(events, evt)
+	}
+
+	if len(events) == 0 {
+		writeHEC(w, http.StatusBadRequest, hecResponse{Text: "No data", Code: 5})
+		return
+	}
+	s.storeHEC(w, r, events)
+}
+
+// POST /services/collector/raw - one event per line, metadata from the query string
+func (s *server) hecRawHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hecAuthorized(w, r) {
+		return
+	}
+	body, ok := s.readIngestBody(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	ts, err := parseHECTime(json.RawMessage(q.Get("time")))
+	if err != nil {
+		writeHEC(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6})
+		return
+	}
+
+	var events []LogEvent
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		evt := LogEvent{
+			Service:   q.Get("service"),
+			Level:     "INFO",
+			Message:   line,
+			Timestamp: ts,
+			Metadata:  hecMetadata(q.Get("host"), q.Get("source"), q.Get("sourcetype"), q.Get("index"), nil),
+		}
+		if evt.Service == "" {
+			evt.Service = "unknown_service"
+		}
+		if err := validateEvent(&evt); err != nil {
+			writeHEC(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6})
+			return
+		}
+		events = append(events, evt)
+	}
+
+	if len(events) == 0 {
+		writeHEC(w, http.StatusBadRequest, hecResponse{Text: "No data", Code: 5})
+		return
+	}
+	s.storeHEC(w, r, events)
+}
+
+// POST /services/collector/ack - indexer acknowledgement status
+func (s *server) hecAckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hecAuthorized(w, r) {
+		return
+	}
+	channel := hecChannelID(r)
+	if channel == "" {
+		writeHEC(w, http.StatusBadRequest, hecResponse{Text: "Data channel is missing", Code: 10})
+		return
+	}
+
+	var req struct {
+		Acks []int64 `json:"acks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeHEC(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"acks": s.hecAcks.query(channel, req.Acks),
+	})
+}
+
+// GET /services/collector/health
+func hecHealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHEC(w, http.StatusOK, hecResponse{Text: "HEC is healthy", Code: 17})
+}
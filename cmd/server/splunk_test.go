@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHECToEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		message string
+		level   string
+		service string
+	}{
+		{"string event", `{"event":"disk full","time":1700000000,"host":"db-1"}`, "disk full", "", "unknown_service"},
+		{"object event", `{"event":{"message":"slow","level":"warn","service":"api","user":"u1"}}`, "slow", "WARNING", "api"},
+		{"object without message", `{"event":{"user":"u1"},"fields":{"service":"billing"}}`, `{"user":"u1"}`, "", "billing"},
+	}
+	for _, tt := range tests {
+		var he hecEvent
+		if err := json.Unmarshal([]byte(tt.body), &he); err != nil {
+			t.Fatal(err)
+		}
+		evt, err := hecToEvent(he)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if evt.Message != tt.message || evt.Level != tt.level || evt.Service != tt.service {
+			t.Errorf("%s: got %q %q %q", tt.name, evt.Message, evt.Level, evt.Service)
+		}
+	}
+
+	var he hecEvent
+	json.Unmarshal([]byte(`{"event":"x","time":1700000000.5,"host":"h","sourcetype":"st"}`), &he)
+	evt, _ := hecToEvent(he)
+	if evt.Timestamp != "2023-11-14T22:13:20.5Z" || evt.Metadata["host"] != "h" || evt.Metadata["sourcetype"] != "st" {
+		t.Errorf("event = %+v", evt)
+	}
+	if _, err := hecToEvent(hecEvent{Event: json.RawMessage(`"x"`), Time: json.RawMessage(`"noon"`)}); err == nil {
+		t.Error("invalid time accepted")
+	}
+}
+
+func TestHECAuthorized(t *testing.T) {
+	t.Setenv("HEC_TOKENS", "alpha, beta")
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Splunk alpha", http.StatusOK},
+		{"splunk beta", http.StatusOK},
+		{"Splunk alph", http.StatusForbidden},
+		{"Splunk alphabet", http.StatusForbidden},
+		{"Bearer alpha", http.StatusUnauthorized},
+		{"Splunk", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/services/collector/event", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		if ok := hecAuthorized(w, r); ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+			t.Errorf("%q: authorized %t, status %d, want %d", tt.header, ok, w.Code, tt.status)
+		}
+	}
+}
+
+func TestHECAckTracker(t *testing.T) {
+	acks := newHECAckTracker(time.Minute)
+	first := acks.reserve("ch")
+	second := acks.reserve("ch")
+	acks.commit("ch", first)
+	acks.commit("other", second)
+
+	got := acks.query("ch", []int64{first, second, 99})
+	if !got[fmt.Sprint(first)] || got[fmt.Sprint(second)] || got["99"] {
+		t.Errorf("query = %v", got)
+	}
+	// Committed ids are reported once
+	if got := acks.query("ch", []int64{first}); got[fmt.Sprint(first)] {
+		t.Error("committed ack reported twice")
+	}
+
+	acks.release("ch", second)
+	acks.commit("ch", second)
+	if got := acks.query("ch", []int64{second}); got[fmt.Sprint(second)] {
+		t.Error("released ack committed")
+	}
+
+	for range maxHECAcksPerChannel + 1 {
+		acks.reserve("busy")
+	}
+	if ch := acks.channels["busy"]; len(ch.order) != maxHECAcksPerChannel || len(ch.committed) != maxHECAcksPerChannel {
+		t.Errorf("channel holds %d ids", len(ch.order))
+	}
+}
+
+func TestHECAckTrackerExpiresIdleChannels(t *testing.T) {
+	acks := newHECAckTracker(time.Minute)
+	acks.reserve("idle")
+	acks.reserve("polling")
+	acks.channels["idle"].lastUsed = time.Now().Add(-2 * time.Minute)
+	acks.lastSweep = time.Now().Add(-time.Minute)
+
+	acks.reserve("new")
+	if _, ok := acks.channels["idle"]; ok {
+		t.Error("idle channel kept")
+	}
+	if len(acks.channels) != 2 {
+		t.Errorf("%d channels, want polling and new", len(acks.channels))
+	}
+}
+
+func TestHECAckTrackerCapsChannels(t *testing.T) {
+	acks := newHECAckTracker(time.Hour)
+	start := time.Now().Add(-time.Minute)
+	for i := range maxHECChannels {
+		name := fmt.Sprintf("ch%d", i)
+		acks.reserve(name)
+		acks.channels[name].lastUsed = start.Add(time.Duration(i) * time.Millisecond)
+	}
+	// Polling keeps the oldest channel in use
+	acks.query("ch0", nil)
+
+	acks.reserve("latest")
+	if len(acks.channels) != maxHECChannels {
+		t.Errorf("%d channels, want %d", len(acks.channels), maxHECChannels)
+	}
+	if _, ok := acks.channels["ch0"]; !ok {
+		t.Error("recently polled channel evicted")
+	}
+	if _, ok := acks.channels["ch1"]; ok {
+		t.Error("least recently used channel kept")
+	}
+}
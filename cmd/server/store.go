@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LogStore is where events are written and read back. Handlers only talk to the
+// store, so the server runs against Postgres in production and against the
+// in-memory store in development and tests (LOG_STORE=memory).
+type LogStore interface {
+	// Insert writes validated events in one batch: all of them or none. Events
+	// already stored under the same event_id and timestamp are skipped. On
+	// success it sets ID and CreatedAt on each event written; skipped ones get ID 0.
+	Insert(ctx context.Context, events []LogEvent) error
+	// Range returns events with from <= timestamp <= to, newest first
+	Range(ctx context.Context, from, to time.Time, limit int) ([]LogEvent, error)
+	// Query returns events matching every set field of the filter
+	Query(ctx context.Context, f LogFilter) ([]LogEvent, error)
+	// Count groups the events matching f by the fields and, when step is set, by
+	// step-wide time buckets aligned to the Unix epoch
+	Count(ctx context.Context, f LogFilter, by []logField, step time.Duration) ([]logCount, error)
+	// Aggregate counts events with a timestamp after since, by service and severity
+	Aggregate(ctx context.Context, since time.Time) (LogAggregate, error)
+	// RecentEventIDs returns the event ids stored after since, newest first
+	RecentEventIDs(ctx context.Context, since time.Time, limit int) ([]storedEventID, error)
+	// CountExpired counts the events a retention rule would remove
+	CountExpired(ctx context.Context, scope retentionScope) (int64, error)
+	// DeleteExpired removes up to limit of those events and returns how many went
+	DeleteExpired(ctx context.Context, scope retentionScope, limit int) (int64, error)
+	// Ping reports whether the store can take reads and writes
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// LogFilter selects events. Zero values match everything.
+type LogFilter struct {
+	Service   string
+	Route     string
+	EventID   string
+	TraceID   string
+	RequestID string
+	Levels    []levelFilter
+	Matchers  []fieldMatcher
+	Search    *searchQuery // full-text condition on the message
+	Cursor    *logCursor   // only events past this position in the listing order
+	From, To  time.Time
+	Limit     int
+	// Oldest first instead of newest first
+	Ascending bool
+}
+
+// LogAggregate holds event counts per service and canonical severity
+type LogAggregate struct {
+	Total      int
+	BySeverity map[int]int
+	ByService  map[string]int
+	// Events at ERROR or above, per service
+	ErrorsByService map[string]int
+}
+
+// Count returns at most this many groups
+const maxCountGroups = 10000
+
+// logCount is one group of a Count: the field values by name, the bucket start
+// (zero without a step) and the number of events
+type logCount struct {
+	Labels map[string]string `json:"labels"`
+	Bucket time.Time         `json:"bucket,omitzero"`
+	Count  int64             `json:"count"`
+}
+
+// logCounter groups events the way Count's GROUP BY does, for stores that count in Go
+type logCounter struct {
+	by     []logField
+	step   time.Duration
+	groups map[string]*logCount
+}
+
+func newLogCounter(by []logField, step time.Duration) *logCounter {
+	return &logCounter{by: by, step: step, groups: map[string]*logCount{}}
+}
+
+func (c *logCounter) add(evt *LogEvent, ts time.Time) {
+	labels := make(map[string]string, len(c.by))
+	for _, field := range c.by {
+		labels[field.String()], _ = field.value(evt)
+	}
+	var bucket time.Time
+	if c.step > 0 {
+		nanos := ts.UnixNano()
+		bucket = time.Unix(0, nanos-nanos%int64(c.step)).UTC()
+	}
+	c.addCount(logCount{Labels: labels, Bucket: bucket, Count: 1})
+}
+
+// addCount folds in a group counted elsewhere
+func (c *logCounter) addCount(lc logCount) {
+	key := lc.Bucket.Format(time.RFC3339Nano)
+	for _, field := range c.by {
+		key += "\x00" + lc.Labels[field.String()]
+	}
+	if g, ok := c.groups[key]; ok {
+		g.Count += lc.Count
+		return
+	}
+	c.groups[key] = &lc
+}
+
+// result orders groups like the SQL does: by bucket, then largest first
+func (c *logCounter) result() []logCount {
+	counts := make([]logCount, 0, len(c.groups))
+	for _, g := range c.groups {
+		counts = append(counts, *g)
+	}
+	sortLogCounts(counts, c.by)
+	if len(counts) > maxCountGroups {
+		counts = counts[:maxCountGroups]
+	}
+	return counts
+}
+
+func sortLogCounts(counts []logCount, by []logField) {
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if !a.Bucket.Equal(b.Bucket) {
+			return a.Bucket.Before(b.Bucket)
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		for _, field := range by {
+			if la, lb := a.Labels[field.String()], b.Labels[field.String()]; la != lb {
+				return la < lb
+			}
+		}
+		return false
+	})
+}
+
+// storedEventID is an event id and when it was stored, for warming the dedup cache
+type storedEventID struct {
+	ID     string
+	Stored time.Time
+}
+
+func newLogAggregate() LogAggregate {
+	return LogAggregate{BySeverity: map[int]int{}, ByService: map[string]int{}, ErrorsByService: map[string]int{}}
+}
+
+// add counts n events of one service at one severity
+func (a *LogAggregate) add(service string, severity, n int) {
+	sev := canonicalSeverity(severity)
+	a.Total += n
+	a.BySeverity[sev] += n
+	a.ByService[service] += n
+	if sev >= sevError {
+		a.ErrorsByService[service] += n
+	}
+}
+
+// Count returns the number of events at or above severity
+func (a LogAggregate) Count(minSeverity int) int {
+	n := 0
+	for sev, count := range a.BySeverity {
+		if sev >= minSeverity {
+			n += count
+		}
+	}
+	return n
+}
+
+// serviceCount is one entry of a ranked service list
+type serviceCount struct {
+	Service string
+	Count   int
+}
+
+// rankServices ranks services by count, breaking ties by name, and keeps the first n (n <= 0 keeps all)
+func rankServices(counts map[string]int, n int) []serviceCount {
+	ranked := make([]serviceCount, 0, len(counts))
+	for service, count := range counts {
+		ranked = append(ranked, serviceCount{service, count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Service < ranked[j].Service
+	})
+	if n > 0 && len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// openStore picks the backend from LOG_STORE: postgres (default) or memory
+func openStore() (LogStore, error) {
+	switch kind := strings.ToLower(os.Getenv("LOG_STORE")); kind {
+	case "", "postgres":
+		return openPostgresStore(os.Getenv("DATABASE_URL"))
+	case "memory":
+		log.Println("⚠️ Using the in-memory log store, logs are lost when the server stops")
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown LOG_STORE %q (want postgres or memory)", kind)
+	}
+}
+
+// server carries the dependencies of the HTTP handlers and the listeners
+type server struct {
+	store     LogStore
+	retention *retentionEnforcer
+	tail      *tailBroker
+
+	// Shared by the ingest handlers and the syslog / GELF listeners
+	pipeline             *writePipeline
+	hecAcks              *hecAckTracker
+	multiline            multilineConfig
+	lineStreams          *streamAssembler // nil when multiline assembly is off
+	maxDecompressedBytes int64
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest syslog frame we accept (RFC 5425 recommends supporting at least 8 KiB)
+const maxSyslogFrame = 64 * 1024
+
+// Digits allowed in an octet-counted frame length; maxSyslogFrame needs far fewer
+const maxOctetCountDigits = 10
+
+// Defaults for SYSLOG_TCP_MAX_CONNS and SYSLOG_TCP_IDLE_TIMEOUT
+const (
+	defaultTCPMaxConns    = 1000
+	defaultTCPIdleTimeout = 5 * time.Minute
+)
+
+// syslogSeverityLevel maps a syslog severity (0-7) onto LogFlow level names
+func syslogSeverityLevel(severity int) string {
+	switch {
+	case severity <= 2: // emerg, alert, crit
+		return "FATAL"
+	case severity == 3:
+		return "ERROR"
+	case severity == 4:
+		return "WARNING"
+	case severity <= 6: // notice, info
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// parseSyslog parses one RFC 5424 or RFC 3164 message into a LogEvent
+func parseSyslog(msg []byte, now time.Time) (LogEvent, error) {
+	msg = bytes.TrimRight(msg, "\r\n\x00")
+	if len(msg) < 3 || msg[0] != '<' {
+		return LogEvent{}, errors.New("missing PRI")
+	}
+	end := bytes.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return LogEvent{}, errors.New("invalid PRI")
+	}
+	// Digits only: Atoi alone would also take a sign
+	digits := string(msg[1:end])
+	pri, err := strconv.Atoi(digits)
+	if err != nil || strings.Trim(digits, "0123456789") != "" || pri < 0 || pri > 191 {
+		return LogEvent{}, errors.New("invalid PRI")
+	}
+	rest := string(msg[end+1:])
+
+	evt := LogEvent{
+		Level: syslogSeverityLevel(pri % 8),
+		Metadata: map[string]interface{}{
+			"facility": pri / 8,
+			"severity": pri % 8,
+		},
+	}
+
+	// RFC 5424 messages carry a version number right after PRI
+	if strings.HasPrefix(rest, "1 ") {
+		err = parseRFC5424(rest[2:], &evt)
+	} else {
+		parseRFC3164(rest, now, &evt)
+	}
+	if err != nil {
+		return LogEvent{}, err
+	}
+
+	if evt.Service == "" {
+		if host, ok := evt.Metadata["hostname"].(string); ok && host != "" {
+			evt.Service = host
+		} else {
+			evt.Service = "syslog"
+		}
+	}
+	return evt, nil
+}
+
+// parseRFC5424 handles: TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(s string, evt *LogEvent) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		sp := strings.IndexByte(s, ' ')
+		if sp < 0 {
+			return errors.New("truncated RFC 5424 header")
+		}
+		fields[i], s = s[:sp], s[sp+1:]
+	}
+	timestamp, hostname, appName, procID, msgID := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	evt.Metadata["syslog_format"] = "rfc5424"
+	if timestamp != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+		evt.Timestamp = formatEventTime(ts)
+	}
+	if hostname != "-" {
+		evt.Metadata["hostname"] = hostname
+	}
+	if appName != "-" {
+		evt.Service = appName
+	}
+	if procID != "-" {
+		evt.Metadata["procid"] = procID
+	}
+	if msgID != "-" {
+		evt.Metadata["msgid"] = msgID
+	}
+
+	sd, rest, err := parseStructuredData(s)
+	if err != nil {
+		return err
+	}
+	if len(sd) > 0 {
+		evt.Metadata["structured_data"] = sd
+	}
+
+	rest = strings.TrimPrefix(rest, " ")
+	evt.Message = strings.TrimPrefix(rest, "\ufeff") // optional UTF-8 BOM
+	return nil
+}
+
+// parseStructuredData parses "-" or one or more [SD-ID name="value" ...] elements
+func parseStructuredData(s string) (map[string]interface{}, string, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, s[1:], nil
+	}
+
+	sd := map[string]interface{}{}
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd < 0 {
+			return nil, "", errors.New("unterminated structured data")
+		}
+		id := s[:idEnd]
+		s = s[idEnd:]
+		params := map[string]interface{}{}
+
+		for {
+			s = strings.TrimLeft(s, " ")
+			if s == "" {
+				return nil, "", errors.New("unterminated structured data")
+			}
+			if s[0] == ']' {
+				s = s[1:]
+				break
+			}
+			eq := strings.Index(s, `="`)
+			if eq < 0 {
+				return nil, "", fmt.Errorf("invalid SD-PARAM in %q", id)
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+
+			// PARAM-VALUE escapes ", \ and ] with a backslash
+			var val strings.Builder
+			i := 0
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i++
+				}
+				val.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, "", fmt.Errorf("unterminated SD-PARAM value in %q", id)
+			}
+			s = s[i+1:]
+			params[name] = val.String()
+		}
+		sd[id] = params
+	}
+	return sd, s, nil
+}
+
+// parseRFC3164 handles the BSD format: "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG".
+// Real-world senders deviate a lot, so anything unparseable ends up in the message.
+func parseRFC3164(s string, now time.Time, evt *LogEvent) {
+	evt.Metadata["syslog_format"] = "rfc3164"
+
+	if len(s) >= 16 && s[15] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, s[:15], time.UTC); err == nil {
+			// No year in the header: assume the current one, unless that puts us in the future
+			ts = ts.AddDate(now.Year(), 0, 0)
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			evt.Timestamp = formatEventTime(ts)
+			s = s[16:]
+
+			if sp := strings.IndexByte(s, ' '); sp > 0 {
+				evt.Metadata["hostname"] = s[:sp]
+				s = s[sp+1:]
+			}
+		}
+	}
+
+	// TAG is alphanumeric, optionally followed by [PID], and terminated by ':'
+	if colon := strings.Index(s, ": "); colon > 0 && !strings.ContainsAny(s[:colon], " ") {
+		tag := s[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			evt.Metadata["procid"] = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		evt.Service = tag
+		s = s[colon+2:]
+	}
+	evt.Message = s
+}
+
+// storeSyslog validates a parsed message and queues it on the regular ingest path
+func (s *server) storeSyslog(frame []byte, source string) {
+	defer recoverListener("syslog frame from " + source)
+	evt, err := parseSyslog(frame, time.Now().UTC())
+	if err != nil {
+		log.Printf("⚠️ Dropping syslog frame from %s: %v", source, err)
+		return
+	}
+	if err := validateEvent(&evt); err != nil {
+		log.Printf("⚠️ Dropping syslog frame from %s: %v", source, err)
+		return
+	}
+	s.offerLine(source, evt)
+}
+
+// startSyslog starts the optional UDP and TCP listeners configured by
+// SYSLOG_UDP_ADDR and SYSLOG_TCP_ADDR (e.g. ":5514"). SYSLOG_TCP_MAX_CONNS and
+// SYSLOG_TCP_IDLE_TIMEOUT bound the TCP connections.
+func (s *server) startSyslog() {
+	if addr := os.Getenv("SYSLOG_UDP_ADDR"); addr != "" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Fatalf("Failed to start syslog UDP listener: %v", err)
+		}
+		log.Printf("📡 Syslog UDP listening on %s", addr)
+		go s.serveSyslogUDP(conn)
+	}
+
+	if addr := os.Getenv("SYSLOG_TCP_ADDR"); addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Failed to start syslog TCP listener: %v", err)
+		}
+		maxConns := envPositiveInt("SYSLOG_TCP_MAX_CONNS", defaultTCPMaxConns)
+		idle := envDuration("SYSLOG_TCP_IDLE_TIMEOUT", defaultTCPIdleTimeout)
+		log.Printf("📡 Syslog TCP listening on %s", addr)
+		go serveTCP(ln, "Syslog", maxConns, idle, s.handleSyslogConn)
+	}
+}
+
+func (s *server) serveSyslogUDP(conn net.PacketConn) {
+	buf := make([]byte, maxSyslogFrame)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("❌ Syslog UDP read error: %v", err)
+			return
+		}
+		// One datagram is one message
+		frame := make([]byte, n)
+		copy(frame, buf[:n])
+		s.storeSyslog(frame, addr.String())
+	}
+}
+
+// serveTCP accepts stream connections for a listener named name. At most maxConns
+// are served at once, further ones are closed straight away, and a connection
+// that sends nothing for idle is dropped.
+func serveTCP(ln net.Listener, name string, maxConns int, idle time.Duration, handle func(net.Conn)) {
+	slots := make(chan struct{}, maxConns)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("❌ %s TCP accept error: %v", name, err)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			log.Printf("⚠️ Refusing %s TCP connection from %s: %d connections open", name, conn.RemoteAddr(), maxConns)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			handle(&idleConn{Conn: conn, timeout: idle})
+		}()
+	}
+}
+
+// idleConn pushes the read deadline back before every read
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (s *server) handleSyslogConn(conn net.Conn) {
+	defer conn.Close()
+	source := conn.RemoteAddr().String()
+	reader := bufio.NewReaderSize(conn, maxSyslogFrame)
+
+	for {
+		frame, err := readSyslogFrame(reader)
+		if len(frame) > 0 {
+			s.storeSyslog(frame, source)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("⚠️ Syslog TCP connection %s closed: %v", source, err)
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads one frame using octet counting ("LEN SP MSG", RFC 6587 3.4.1)
+// when the frame starts with a digit, and newline framing otherwise
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		// Read the count a byte at a time, so a peer sending endless digits is cut off
+		var lenStr []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == ' ' {
+				break
+			}
+			if len(lenStr) == maxOctetCountDigits {
+				return nil, fmt.Errorf("octet count longer than %d digits", maxOctetCountDigits)
+			}
+			lenStr = append(lenStr, c)
+		}
+		n, err := strconv.Atoi(string(lenStr))
+		if err != nil || n <= 0 || n > maxSyslogFrame {
+			return nil, fmt.Errorf("invalid octet count %q", lenStr)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("frame exceeds maximum size")
+	}
+	frame := bytes.TrimRight(line, "\r\n")
+	return append([]byte(nil), frame...), err
+}
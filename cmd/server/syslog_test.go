@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var syslogNow = time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+func TestParseRFC5424(t *testing.T) {
+	msg := `<165>1 2024-03-10T11:59:58.5Z web-1 checkout 4242 ID47 [exampleSDID@32473 iut="3" eventSource="Appl\"ic\]ation"][meta seq="1"] ` + "\ufeff" + `payment failed`
+	evt, err := parseSyslog([]byte(msg+"\r\n"), syslogNow)
+	if err != nil {
+		t.Fatalf("parseSyslog: %v", err)
+	}
+	if evt.Service != "checkout" || evt.Level != "INFO" || evt.Message != "payment failed" || evt.Timestamp != "2024-03-10T11:59:58.5Z" {
+		t.Errorf("event = %+v", evt)
+	}
+	md := evt.Metadata
+	if md["facility"] != 20 || md["severity"] != 5 || md["hostname"] != "web-1" || md["procid"] != "4242" || md["msgid"] != "ID47" || md["syslog_format"] != "rfc5424" {
+		t.Errorf("metadata = %v", md)
+	}
+	sd, _ := md["structured_data"].(map[string]interface{})
+	params, _ := sd["exampleSDID@32473"].(map[string]interface{})
+	if params["iut"] != "3" || params["eventSource"] != `Appl"ic]ation` || len(sd) != 2 {
+		t.Errorf("structured data = %v", sd)
+	}
+
+	evt, err = parseSyslog([]byte("<11>1 - - - - - -"), syslogNow)
+	if err != nil || evt.Service != "syslog" || evt.Level != "ERROR" || evt.Message != "" || evt.Timestamp != "" {
+		t.Errorf("nil values = %+v, %v", evt, err)
+	}
+}
+
+func TestParseRFC3164(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		timestamp string
+		host      string
+		service   string
+		message   string
+	}{
+		{"full header", "<34>Mar  9 22:14:15 mymachine su[123]: 'su root' failed", "2024-03-09T22:14:15Z", "mymachine", "su", "'su root' failed"},
+		{"december read in january", "<13>Dec 31 23:59:59 host app: late", "2023-12-31T23:59:59Z", "host", "app", "late"},
+		{"no timestamp", "<13>app: hello world", "", "", "app", "hello world"},
+		{"no tag", "<13>Mar 10 11:00:00 host just some text", "2024-03-10T11:00:00Z", "host", "host", "just some text"},
+		{"free text", "<13>something odd happened", "", "", "syslog", "something odd happened"},
+	}
+	for _, tt := range tests {
+		now := syslogNow
+		if strings.HasPrefix(tt.name, "december") {
+			now = time.Date(2024, time.January, 1, 0, 0, 5, 0, time.UTC)
+		}
+		evt, err := parseSyslog([]byte(tt.msg), now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		host, _ := evt.Metadata["hostname"].(string)
+		if evt.Timestamp != tt.timestamp || host != tt.host || evt.Service != tt.service || evt.Message != tt.message {
+			t.Errorf("%s: got ts %q host %q service %q message %q", tt.name, evt.Timestamp, host, evt.Service, evt.Message)
+		}
+		if evt.Metadata["syslog_format"] != "rfc3164" {
+			t.Errorf("%s: format %v", tt.name, evt.Metadata["syslog_format"])
+		}
+	}
+	if evt, _ := parseSyslog([]byte("<34>Mar  9 22:14:15 mymachine su[123]: x"), syslogNow); evt.Metadata["procid"] != "123" || evt.Level != "FATAL" {
+		t.Errorf("procid %v, level %q", evt.Metadata["procid"], evt.Level)
+	}
+}
+
+func TestParseSyslogErrors(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"no pri",
+		"<>1 - - - - - -",
+		"<-1>1 - - - - - -",
+		"<+13>app: x",
+		"<192>app: x",
+		"<1a>app: x",
+		"<12345>app: x",
+		"<13>1 2024-03-10 host app - - - x",
+		"<13>1 - host app",
+		`<13>1 - h a - - [id k="v"`,
+		`<13>1 - h a - - [id k=v] x`,
+		`<13>1 - h a - - [id k="v] x`,
+	} {
+		if evt, err := parseSyslog([]byte(msg), syslogNow); err == nil {
+			t.Errorf("%q parsed as %+v", msg, evt)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("12 <13>app: a b<13>app: second\r\n5 <13>x<13>app: last"))
+	for _, want := range []string{"<13>app: a b", "<13>app: second", "<13>x", "<13>app: last"} {
+		frame, err := readSyslogFrame(r)
+		if string(frame) != want || (err != nil && err != io.EOF) {
+			t.Fatalf("frame = %q, %v, want %q", frame, err, want)
+		}
+	}
+
+	for _, input := range []string{"12345678901 x", "12a x", "99999999 x", "5 abc"} {
+		if _, err := readSyslogFrame(bufio.NewReader(strings.NewReader(input))); err == nil || err == io.EOF {
+			t.Errorf("%q: got %v", input, err)
+		}
+	}
+	long := bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", 100)+"\n"), 16)
+	if _, err := readSyslogFrame(long); err == nil {
+		t.Error("oversized line accepted")
+	}
+}
+
+func TestServeTCPLimits(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	handled := make(chan error, 2)
+	go serveTCP(ln, "test", 1, 100*time.Millisecond, func(conn net.Conn) {
+		defer conn.Close()
+		_, err := io.ReadAll(conn)
+		handled <- err
+	})
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("x"))
+
+	// The only slot is taken, so the second connection is closed on accept
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("second connection read %v, want EOF", err)
+	}
+
+	// The silent first connection is dropped after the idle timeout
+	select {
+	case err := <-handled:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("first connection ended with %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection kept open")
+	}
+
+	// and its slot is free again
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	third.Write([]byte("y"))
+	third.(*net.TCPConn).CloseWrite()
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Errorf("third connection ended with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("third connection not served")
+	}
+}
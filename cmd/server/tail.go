@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live tail defaults, overridable via TAIL_* environment variables
+const (
+	defaultTailHistory = 10000 // recent events kept for Last-Event-ID resume
+	defaultTailBuffer  = 1000  // events queued per subscriber before it starts losing them
+
+	tailHeartbeat    = 15 * time.Second
+	tailWriteTimeout = 10 * time.Second
+	tailSSERetry     = 3 * time.Second
+)
+
+// tailEvent is one written event as the tail broker hands it out
+type tailEvent struct {
+	seq uint64
+	row memoryRow
+}
+
+// tailSubscriber is one open stream: its filter and a bounded buffer. When the
+// buffer is full, new events are dropped for this subscriber alone and counted,
+// so one slow client never holds up ingestion or the other streams.
+type tailSubscriber struct {
+	filter  LogFilter
+	ch      chan *tailEvent
+	dropped atomic.Int64
+}
+
+// tailBroker fans written events out to live tail subscribers. It keeps the
+// most recent events so a reconnecting client can resume from Last-Event-ID.
+type tailBroker struct {
+	mu      sync.Mutex
+	subs    map[*tailSubscriber]struct{}
+	history []*tailEvent // ring of the last len(history) events
+	seq     uint64       // sequence of the newest event
+	// Distinguishes this process's ids from a previous run's
+	epoch  string
+	buffer int
+	done   chan struct{}
+	closed bool
+
+	published atomic.Int64
+	dropped   atomic.Int64
+}
+
+var tailUpgrader = websocket.Upgrader{
+	// Like the CORS policy on every other endpoint, any origin may connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func newTailBroker(history, buffer int) *tailBroker {
+	return &tailBroker{
+		subs:    make(map[*tailSubscriber]struct{}),
+		history: make([]*tailEvent, max(history, 1)),
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		buffer:  max(buffer, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// publish hands events that were just written to every subscriber whose filter
+// matches. It never blocks: a full subscriber buffer drops the event.
+func (b *tailBroker) publish(events []LogEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, evt := range events {
+		ts, err := parseEventTime(evt.Timestamp)
+		if err != nil {
+			continue
+		}
+		b.seq++
+		te := &tailEvent{seq: b.seq, row: memoryRow{evt: evt, ts: ts}}
+		b.history[b.seq%uint64(len(b.history))] = te
+
+		for sub := range b.subs {
+			if !sub.filter.matches(&te.row) {
+				continue
+			}
+			select {
+			case sub.ch <- te:
+			default:
+				sub.dropped.Add(1)
+				b.dropped.Add(1)
+			}
+		}
+	}
+	b.published.Add(int64(len(events)))
+}
+
+// subscribe registers a stream. With the id of the last event a client saw, it
+// also returns the matching events written since; gap is set when those are no
+// longer all held (the id is from another run or too old).
+func (b *tailBroker) subscribe(filter LogFilter, lastID string) (sub *tailSubscriber, backlog []*tailEvent, gap bool) {
+	sub = &tailSubscriber{filter: filter, ch: make(chan *tailEvent, b.buffer)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID != "" {
+		epoch, rawSeq, _ := strings.Cut(lastID, "-")
+		last, err := strconv.ParseUint(rawSeq, 10, 64)
+		oldest := uint64(1)
+		if b.seq > uint64(len(b.history)) {
+			oldest = b.seq - uint64(len(b.history)) + 1
+		}
+		switch {
+		case err != nil || epoch != b.epoch || last > b.seq:
+			gap = true
+		default:
+			if last+1 < oldest {
+				gap, last = true, oldest-1
+			}
+			for seq := last + 1; seq <= b.seq; seq++ {
+				if te := b.history[seq%uint64(len(b.history))]; filter.matches(&te.row) {
+					backlog = append(backlog, te)
+				}
+			}
+		}
+	}
+	b.subs[sub] = struct{}{}
+	return sub, backlog, gap
+}
+
+func (b *tailBroker) unsubscribe(sub *tailSubscriber) {
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// Close ends every open stream, so server shutdown does not wait on them
+func (b *tailBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// Stats reports subscriber and delivery counts for /metrics/pipeline
+func (b *tailBroker) Stats() map[string]interface{} {
+	b.mu.Lock()
+	subscribers := len(b.subs)
+	b.mu.Unlock()
+	return map[string]interface{}{
+		"subscribers":     subscribers,
+		"published_total": b.published.Load(),
+		"dropped_total":   b.dropped.Load(),
+	}
+}
+
+func (b *tailBroker) eventID(te *tailEvent) string {
+	return b.epoch + "-" + strconv.FormatUint(te.seq, 10)
+}
+
+// tailStream is the transport of one subscriber: SSE or WebSocket
+type tailStream interface {
+	// event sends one log event with its resume id
+	event(id string, evt LogEvent) error
+	// notice sends a control message (dropped, reset) that carries no id
+	notice(kind string, data map[string]interface{}) error
+	ping() error
+}
+
+// GET /logs/tail - Stream newly written logs matching the /logs filters over SSE, or WebSocket on upgrade
+func (s *server) logsTailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Only events written from now on; time bounds and paging do not apply
+	filter.From, filter.To, filter.Limit = time.Time{}, time.Time{}, 0
+
+	// Browsers send Last-Event-ID when an EventSource reconnects; WebSocket
+	// clients and first connections pass last_event_id instead
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := tailUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // Upgrade has already answered
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		// Read to handle close and pong frames; the client sends nothing else
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		s.runTail(ctx, &wsTailStream{conn: conn}, filter, lastID)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(tailWriteTimeout))
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// Streams outlive any server write timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", tailSSERetry.Milliseconds())
+	if err := rc.Flush(); err != nil {
+		log.Printf("⚠️ Live tail needs a flushable response: %v", err)
+		return
+	}
+	s.runTail(r.Context(), &sseTailStream{w: w, rc: rc}, filter, lastID)
+}
+
+// runTail sends the resume backlog, then live events, until the client leaves
+// or the server shuts down
+func (s *server) runTail(ctx context.Context, stream tailStream, filter LogFilter, lastID string) {
+	sub, backlog, gap := s.tail.subscribe(filter, lastID)
+	defer s.tail.unsubscribe(sub)
+
+	if gap {
+		err := stream.notice("reset", map[string]interface{}{
+			"message": "Resume point is no longer held; some events were missed. Backfill from /logs.",
+		})
+		if err != nil {
+			return
+		}
+	}
+	send := func(te *tailEvent) error {
+		evt := te.row.evt
+		// Same treatment as /logs: PII scrubbed, highlights from the scrubbed text
+		evt.Message = scrubPII(evt.Message)
+		if filter.Search != nil {
+			evt.Highlights = filter.Search.highlight(evt.Message)
+		}
+		return stream.event(s.tail.eventID(te), evt)
+	}
+	reportDropped := func() error {
+		if n := sub.dropped.Swap(0); n > 0 {
+			return stream.notice("dropped", map[string]interface{}{
+				"dropped": n,
+				"message": fmt.Sprintf("%d events were dropped because this client fell behind", n),
+			})
+		}
+		return nil
+	}
+	for _, te := range backlog {
+		if err := send(te); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.tail.done:
+			return
+		case te := <-sub.ch:
+			if err = send(te); err == nil {
+				err = reportDropped()
+			}
+		case <-heartbeat.C:
+			if err = reportDropped(); err == nil {
+				err = stream.ping()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sseTailStream writes Server-Sent Events
+type sseTailStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s *sseTailStream) event(id string, evt LogEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.w, "id: %s\nevent: log\ndata: %s\n\n", id, data)
+	return s.rc.Flush()
+}
+
+func (s *sseTailStream) notice(kind string, data map[string]interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", kind, body)
+	return s.rc.Flush()
+}
+
+func (s *sseTailStream) ping() error {
+	fmt.Fprint(s.w, ": ping\n\n")
+	return s.rc.Flush()
+}
+
+// wsTailStream writes JSON text messages: {"type":"log","id":...,"log":{...}}
+// for events and {"type":"dropped"|"reset",...} for notices
+type wsTailStream struct {
+	conn *websocket.Conn
+}
+
+func (s *wsTailStream) event(id string, evt LogEvent) error {
+	return s.write(map[string]interface{}{"type": "log", "id": id, "log": evt})
+}
+
+func (s *wsTailStream) notice(kind string, data map[string]interface{}) error {
+	msg := map[string]interface{}{"type": kind}
+	for k, v := range data {
+		msg[k] = v
+	}
+	return s.write(msg)
+}
+
+func (s *wsTailStream) ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailWriteTimeout))
+}
+
+func (s *wsTailStream) write(msg map[string]interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+	return s.conn.WriteJSON(msg)
+}
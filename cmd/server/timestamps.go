@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock-skew defaults, overridable via CLOCK_SKEW_* environment variables
+const (
+	defaultMaxFutureSkew = 5 * time.Minute
+	defaultMaxPastSkew   = 7 * 24 * time.Hour
+)
+
+// Clock-skew policies for events whose timestamp lies outside the allowed window
+const (
+	skewFlag   = "flag"   // keep the timestamp and note the skew in metadata
+	skewClamp  = "clamp"  // replace it with the receive time, keeping the original in metadata
+	skewReject = "reject" // refuse the event
+	skewOff    = "off"
+)
+
+var clockSkew = struct {
+	policy    string
+	maxFuture time.Duration
+	maxPast   time.Duration
+}{skewFlag, defaultMaxFutureSkew, defaultMaxPastSkew}
+
+// initClockSkew reads CLOCK_SKEW_POLICY, CLOCK_SKEW_MAX_FUTURE and CLOCK_SKEW_MAX_PAST
+func initClockSkew() {
+	switch policy := strings.ToLower(os.Getenv("CLOCK_SKEW_POLICY")); policy {
+	case "":
+	case skewFlag, skewClamp, skewReject, skewOff:
+		clockSkew.policy = policy
+	default:
+		log.Printf("⚠️ Invalid CLOCK_SKEW_POLICY=%q, using %q", policy, skewFlag)
+	}
+	clockSkew.maxFuture = envDuration("CLOCK_SKEW_MAX_FUTURE", defaultMaxFutureSkew)
+	clockSkew.maxPast = envDuration("CLOCK_SKEW_MAX_PAST", defaultMaxPastSkew)
+	if clockSkew.policy != skewOff {
+		log.Printf("🕒 Clock skew policy: %s (max %s ahead, %s behind)", clockSkew.policy, clockSkew.maxFuture, clockSkew.maxPast)
+	}
+}
+
+// formatEventTime is the one wire format for event times: UTC with as many
+// fractional digits as the value carries
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// storedEventTime rebuilds an event time from its TIMESTAMPTZ column, which keeps
+// microseconds, and the sub-microsecond remainder stored in timestamp_nanos
+func storedEventTime(ts time.Time, nanos sql.NullInt64) string {
+	return formatEventTime(ts.Add(time.Duration(nanos.Int64)))
+}
+
+// parseEventTime accepts RFC 3339 with any fractional precision, or an epoch value
+// in seconds (optionally fractional), milliseconds, microseconds or nanoseconds
+func parseEventTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	if t, ok := parseEpoch(s); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid timestamp format")
+}
+
+// parseEpoch reads an epoch number without going through float64, which would
+// lose everything below the microsecond. Integers are scaled by their digit count.
+func parseEpoch(s string) (time.Time, bool) {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || strings.TrimLeft(whole, "0123456789") != "" || strings.TrimLeft(frac, "0123456789") != "" {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if hasFrac {
+		// Fractional values are always seconds
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nanos, _ := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		return time.Unix(n, nanos).UTC(), true
+	}
+
+	switch digits := len(strings.TrimLeft(whole, "0")); {
+	case digits <= 10:
+		return time.Unix(n, 0).UTC(), true
+	case digits <= 13:
+		return time.UnixMilli(n).UTC(), true
+	case digits <= 16:
+		return time.UnixMicro(n).UTC(), true
+	default:
+		return time.Unix(0, n).UTC(), true
+	}
+}
+
+// parseEpochSeconds reads the fractional epoch seconds GELF and HEC send, exactly
+// where it can and through float64 for forms like 1.7e9
+func parseEpochSeconds(s string) (time.Time, error) {
+	if t, ok := parseEpoch(s); ok {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))).UTC(), nil
+}
+
+// applyClockSkew enforces the skew policy against the receive time
+func applyClockSkew(evt *LogEvent, ts, received time.Time) (time.Time, error) {
+	if clockSkew.policy == skewOff {
+		return ts, nil
+	}
+
+	var direction string
+	var skew time.Duration
+	switch {
+	case ts.After(received.Add(clockSkew.maxFuture)):
+		direction, skew = "future", ts.Sub(received)
+	case ts.Before(received.Add(-clockSkew.maxPast)):
+		direction, skew = "past", received.Sub(ts)
+	default:
+		return ts, nil
+	}
+
+	if clockSkew.policy == skewReject {
+		return ts, fmt.Errorf("timestamp is %s in the %s (allowed: %s ahead, %s behind)",
+			skew.Round(time.Second), direction, clockSkew.maxFuture, clockSkew.maxPast)
+	}
+
+	if evt.Metadata == nil {
+		evt.Metadata = map[string]interface{}{}
+	}
+	evt.Metadata["clock_skew"] = direction
+	evt.Metadata["clock_skew_seconds"] = skew.Seconds()
+	if clockSkew.policy == skewClamp {
+		evt.Metadata["original_timestamp"] = formatEventTime(ts)
+		return received, nil
+	}
+	return ts, nil
+}
+
+// UnmarshalJSON lets producers send the timestamp as an epoch number as well as a string
+func (e *LogEvent) UnmarshalJSON(b []byte) error {
+	type plain LogEvent
+	aux := struct {
+		*plain
+		Timestamp json.RawMessage `json:"timestamp"`
+	}{plain: (*plain)(e)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	raw := strings.TrimSpace(string(aux.Timestamp))
+	switch {
+	case raw == "" || raw == "null":
+		e.Timestamp = ""
+	case raw[0] == '"':
+		return json.Unmarshal(aux.Timestamp, &e.Timestamp)
+	default:
+		e.Timestamp = raw
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxTraceIDLen   = 64
+	maxSpanIDLen    = 32
+	maxRequestIDLen = 256
+
+	defaultTraceLogLimit = 1000
+	maxTraceLogLimit     = 10000
+)
+
+// Metadata keys producers use for trace context, lifted into first-class fields.
+// Dotted keys also match nested objects (ECS trace.id, Datadog dd.trace_id).
+var (
+	traceIDKeys   = []string{"trace_id", "traceId", "traceID", "trace.id", "dd.trace_id", "otel.trace_id", "traceid"}
+	spanIDKeys    = []string{"span_id", "spanId", "spanID", "span.id", "dd.span_id", "otel.span_id", "spanid"}
+	requestIDKeys = []string{"request_id", "requestId", "requestID", "http.request.id", "x_request_id", "x-request-id", "req_id"}
+)
+
+// parseTraceparent extracts the trace and parent span ids from a W3C traceparent
+// header: version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false
+	}
+	traceID, spanID = strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	if len(traceID) != 32 || len(spanID) != 16 || !isHex(traceID) || !isHex(spanID) || !isHex(parts[3]) {
+		return "", "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(spanID, "0") == "" {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// normalizeTraceID lowercases hex ids so lookups don't depend on producer casing
+func normalizeTraceID(id string) string {
+	id = strings.TrimSpace(id)
+	if isHex(id) {
+		return strings.ToLower(id)
+	}
+	return id
+}
+
+// liftTraceContext fills TraceID, SpanID and RequestID from metadata when they were
+// not set directly, including a traceparent value carried in metadata
+func liftTraceContext(evt *LogEvent) {
+	if len(evt.Metadata) > 0 {
+		if tp := popString(evt.Metadata, "traceparent"); tp != "" && evt.TraceID == "" {
+			if traceID, spanID, ok := parseTraceparent(tp); ok {
+				evt.TraceID = traceID
+				if evt.SpanID == "" {
+					evt.SpanID = spanID
+				}
+			}
+		}
+		if evt.TraceID == "" {
+			evt.TraceID = popString(evt.Metadata, traceIDKeys...)
+		}
+		if evt.SpanID == "" {
+			evt.SpanID = popString(evt.Metadata, spanIDKeys...)
+		}
+		if evt.RequestID == "" {
+			evt.RequestID = popString(evt.Metadata, requestIDKeys...)
+		}
+	}
+	evt.TraceID = normalizeTraceID(evt.TraceID)
+	evt.SpanID = normalizeTraceID(evt.SpanID)
+	evt.RequestID = strings.TrimSpace(evt.RequestID)
+}
+
+// applyTraceHeaders gives events without their own trace context the one from the
+// request's traceparent and X-Request-ID headers
+func applyTraceHeaders(r *http.Request, evt *LogEvent) {
+	if evt.TraceID == "" {
+		if traceID, spanID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			evt.TraceID = traceID
+			if evt.SpanID == "" {
+				evt.SpanID = spanID
+			}
+		}
+	}
+	if evt.RequestID == "" {
+		evt.RequestID = r.Header.Get("X-Request-ID")
+	}
+}
+
+// GET /traces/{id}/logs - Every log of one trace across services, oldest first
+func (s *server) traceLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	traceID := normalizeTraceID(r.PathValue("id"))
+	if traceID == "" || len(traceID) > maxTraceIDLen {
+		http.Error(w, "Invalid trace id", http.StatusBadRequest)
+		return
+	}
+	limit := defaultTraceLogLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxTraceLogLimit)
+	}
+
+	logs, err := s.store.Query(r.Context(), LogFilter{TraceID: traceID, Limit: limit, Ascending: true})
+	if err != nil {
+		log.Printf("❌ Error querying trace %s: %v", traceID, err)
+		http.Error(w, "Error querying trace", http.StatusInternalServerError)
+		return
+	}
+
+	services := map[string]int{}
+	var serviceOrder []string
+	errorCount := 0
+	for i := range logs {
+		evt := &logs[i]
+		evt.Message = scrubPII(evt.Message)
+
+		if _, seen := services[evt.Service]; !seen {
+			serviceOrder = append(serviceOrder, evt.Service)
+		}
+		services[evt.Service]++
+		if evt.Severity >= sevError {
+			errorCount++
+		}
+	}
+
+	if len(logs) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No logs found for trace %s", traceID))
+		return
+	}
+
+	// Services in the order the trace reached them
+	timeline := make([]map[string]interface{}, len(serviceOrder))
+	for i, name := range serviceOrder {
+		timeline[i] = map[string]interface{}{"service": name, "count": services[name]}
+	}
+
+	start, _ := parseEventTime(logs[0].Timestamp)
+	end, _ := parseEventTime(logs[len(logs)-1].Timestamp)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"trace_id":    traceID,
+		"count":       len(logs),
+		"error_count": errorCount,
+		"services":    timeline,
+		"start":       logs[0].Timestamp,
+		"end":         logs[len(logs)-1].Timestamp,
+		"duration_ms": float64(end.Sub(start).Microseconds()) / 1000,
+		"truncated":   len(logs) == limit,
+		"logs":        logs,
+	})
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAL defaults, overridable via WAL_* environment variables
+const (
+	defaultWALDir            = "data/wal"
+	defaultWALSegmentBytes   = 64 << 20
+	defaultWALReplayInterval = 30 * time.Second
+
+	walSegmentExt = ".wal"
+	// length (4) + checksum (4) + record type (1)
+	walHeaderSize = 9
+	// Sanity cap on a single record so a corrupt length can't trigger a huge allocation
+	maxWALRecordBytes = 256 << 20
+)
+
+// Record types
+const (
+	walRecordEvents byte = 1 // JSON array of LogEvents from one accepted ingest batch
+	walRecordCommit byte = 2 // marks an events record as written to the database
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRef locates an events record: segment id and byte offset within it
+type walRef struct {
+	Segment uint64
+	Offset  int64
+}
+
+// walRecord is an events record that still needs to reach the database
+type walRecord struct {
+	Ref    walRef
+	Events []LogEvent
+}
+
+type walSegment struct {
+	id      uint64
+	path    string
+	size    int64
+	pending int // events records appended but not yet committed
+	sealed  bool
+}
+
+// writeAheadLog is a segment-based log on local disk. Every accepted ingest batch
+// is appended (and fsynced) before it is acknowledged; once the pipeline commits a
+// batch a commit marker is appended, and segments are deleted oldest-first as soon
+// as none of their batches are outstanding.
+type writeAheadLog struct {
+	mu              sync.Mutex
+	dir             string
+	maxSegmentBytes int64
+	fsync           bool
+
+	segments []*walSegment // ascending by id; the last one is active
+	active   walFile
+	// The active segment ends in a partial record that could not be cut off,
+	// so nothing more may be appended to it
+	torn   bool
+	failed []walRef // batches whose flush gave up, waiting for the replayer
+
+	// Replays of each failed batch so far; past maxReplays it is dead-lettered
+	// so one batch can never hold back truncation for good
+	replays    map[walRef]int
+	maxReplays int
+}
+
+// walFile is the active segment file; tests substitute one that fails mid-write
+type walFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+func walSegmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, walSegmentExt))
+}
+
+// openWAL scans existing segments and returns the log plus every events record
+// that has no commit marker, so the caller can replay them
+func openWAL(dir string, maxSegmentBytes int64, fsync bool, maxReplays int) (*writeAheadLog, []walRecord, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("error creating WAL directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading WAL directory: %w", err)
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	w := &writeAheadLog{
+		dir:             dir,
+		maxSegmentBytes: maxSegmentBytes,
+		fsync:           fsync,
+		replays:         map[walRef]int{},
+		maxReplays:      max(maxReplays, 1),
+	}
+
+	records := map[walRef][]LogEvent{}
+	committed := map[walRef]bool{}
+	for _, id := range ids {
+		seg := &walSegment{id: id, path: walSegmentPath(dir, id), sealed: true}
+		size, err := scanWALSegment(seg, func(rtype byte, offset int64, payload []byte) {
+			switch rtype {
+			case walRecordEvents:
+				var events []LogEvent
+				if err := json.Unmarshal(payload, &events); err != nil {
+					log.Printf("⚠️ Skipping unreadable WAL record %s@%d: %v", seg.path, offset, err)
+					return
+				}
+				records[walRef{Segment: id, Offset: offset}] = events
+			case walRecordCommit:
+				if len(payload) == 16 {
+					committed[walRef{
+						Segment: binary.BigEndian.Uint64(payload[0:8]),
+						Offset:  int64(binary.BigEndian.Uint64(payload[8:16])),
+					}] = true
+				}
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		seg.size = size
+		w.segments = append(w.segments, seg)
+	}
+
+	var pending []walRecord
+	for ref, events := range records {
+		if committed[ref] {
+			continue
+		}
+		pending = append(pending, walRecord{Ref: ref, Events: events})
+		w.segment(ref.Segment).pending++
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Ref.Segment != pending[j].Ref.Segment {
+			return pending[i].Ref.Segment < pending[j].Ref.Segment
+		}
+		return pending[i].Ref.Offset < pending[j].Ref.Offset
+	})
+
+	nextID := uint64(1)
+	if len(ids) > 0 {
+		nextID = ids[len(ids)-1] + 1
+	}
+	if err := w.openSegment(nextID); err != nil {
+		return nil, nil, err
+	}
+	w.truncate()
+
+	return w, pending, nil
+}
+
+// scanWALSegment calls fn for every intact record and returns the size of the valid
+// prefix. A torn or corrupt tail (e.g. from a crash mid-write) is cut off.
+func scanWALSegment(seg *walSegment, fn func(rtype byte, offset int64, payload []byte)) (int64, error) {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error opening WAL segment: %w", err)
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		rtype, payload, err := readWALRecord(f, offset, header)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			log.Printf("⚠️ WAL segment %s is corrupt at offset %d (%v), truncating", seg.path, offset, err)
+			if err := f.Truncate(offset); err != nil {
+				return 0, fmt.Errorf("error truncating WAL segment: %w", err)
+			}
+			return offset, nil
+		}
+		fn(rtype, offset, payload)
+		offset += walHeaderSize + int64(len(payload))
+	}
+}
+
+// readWALRecord reads and verifies the record at offset
+func readWALRecord(f *os.File, offset int64, header []byte) (byte, []byte, error) {
+	n, err := f.ReadAt(header, offset)
+	if err == io.EOF && n == 0 {
+		return 0, nil, io.EOF
+	}
+	if n < walHeaderSize {
+		return 0, nil, errors.New("truncated record header")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	rtype := header[8]
+	if length > maxWALRecordBytes {
+		return 0, nil, fmt.Errorf("record length %d out of range", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+walHeaderSize); err != nil {
+		return 0, nil, errors.New("truncated record payload")
+	}
+	crc := crc32.Update(crc32.Checksum([]byte{rtype}, walCRCTable), walCRCTable, payload)
+	if crc != sum {
+		return 0, nil, errors.New("checksum mismatch")
+	}
+	return rtype, payload, nil
+}
+
+func encodeWALRecord(rtype byte, payload []byte) []byte {
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	crc := crc32.Update(crc32.Checksum([]byte{rtype}, walCRCTable), walCRCTable, payload)
+	binary.BigEndian.PutUint32(buf[4:8], crc)
+	buf[8] = rtype
+	copy(buf[walHeaderSize:], payload)
+	return buf
+}
+
+func (w *writeAheadLog) segment(id uint64) *walSegment {
+	for _, seg := range w.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// openSegment starts a new active segment; callers hold mu (or own w exclusively)
+func (w *writeAheadLog) openSegment(id uint64) error {
+	path := walSegmentPath(w.dir, id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error creating WAL segment: %w", err)
+	}
+	w.active = f
+	w.segments = append(w.segments, &walSegment{id: id, path: path})
+	return nil
+}
+
+// write appends a record to the active segment and rotates it when full
+func (w *writeAheadLog) write(rtype byte, payload []byte, sync bool) (walRef, error) {
+	if w.torn {
+		if err := w.rotate(); err != nil {
+			return walRef{}, fmt.Errorf("error replacing torn WAL segment: %w", err)
+		}
+		w.torn = false
+	}
+	seg := w.segments[len(w.segments)-1]
+	ref := walRef{Segment: seg.id, Offset: seg.size}
+
+	record := encodeWALRecord(rtype, payload)
+	if _, err := w.active.Write(record); err != nil {
+		w.discardTail(seg)
+		return walRef{}, fmt.Errorf("error appending to WAL: %w", err)
+	}
+	if sync {
+		if err := w.active.Sync(); err != nil {
+			w.discardTail(seg)
+			return walRef{}, fmt.Errorf("error syncing WAL: %w", err)
+		}
+	}
+	seg.size += int64(len(record))
+	if rtype == walRecordEvents {
+		// Counted before rotating, so truncate can't remove the segment under it
+		seg.pending++
+	}
+
+	if seg.size >= w.maxSegmentBytes {
+		// The record is already durable; a failed rotation only means the segment
+		// keeps growing until the next write manages to rotate it
+		if err := w.rotate(); err != nil {
+			log.Printf("⚠️ Error rotating WAL segment %d, still appending to it: %v", seg.id, err)
+		}
+	}
+	return ref, nil
+}
+
+// discardTail cuts a failed write off the end of seg so later records follow the
+// last good one. If that fails too, the segment is marked torn and the next write
+// moves on to a fresh one; replay stops at the partial record either way.
+func (w *writeAheadLog) discardTail(seg *walSegment) {
+	if err := w.active.Truncate(seg.size); err != nil {
+		log.Printf("⚠️ Error cutting a failed write off WAL segment %d: %v", seg.id, err)
+		w.torn = true
+		if err := w.rotate(); err == nil {
+			w.torn = false
+		}
+	}
+}
+
+// rotate seals the active segment and starts the next one. The new file is opened
+// before the old one is closed, so on failure the current segment stays usable.
+func (w *writeAheadLog) rotate() error {
+	seg := w.segments[len(w.segments)-1]
+	old := w.active
+	if err := w.openSegment(seg.id + 1); err != nil {
+		return err
+	}
+	old.Close()
+	seg.sealed = true
+	w.truncate()
+	return nil
+}
+
+// Append durably records an accepted batch before it is acknowledged
+func (w *writeAheadLog) Append(events []LogEvent) (walRef, error) {
+	payload, err := json.Marshal(events)
+	if err != nil {
+		return walRef{}, fmt.Errorf("error encoding WAL record: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.write(walRecordEvents, payload, w.fsync)
+}
+
+// Commit marks a batch as written to the database and deletes segments that no longer hold pending batches
+func (w *writeAheadLog) Commit(ref walRef) {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[0:8], ref.Segment)
+	binary.BigEndian.PutUint64(payload[8:16], uint64(ref.Offset))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// A lost commit marker only means the batch is replayed once more, and Insert
+	// skips events already stored, so skip the fsync
+	if _, err := w.write(walRecordCommit, payload, false); err != nil {
+		log.Printf("⚠️ Error writing WAL commit marker: %v", err)
+	}
+	if seg := w.segment(ref.Segment); seg != nil && seg.pending > 0 {
+		seg.pending--
+	}
+	delete(w.replays, ref)
+	w.truncate()
+}
+
+// Failed queues a batch the pipeline gave up on, for the replayer to retry
+func (w *writeAheadLog) Failed(ref walRef) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failed = append(w.failed, ref)
+}
+
+// truncate deletes fully committed segments oldest-first. Stopping at the first
+// segment with pending batches keeps every commit marker that an older segment relies on.
+func (w *writeAheadLog) truncate() {
+	for len(w.segments) > 1 {
+		seg := w.segments[0]
+		if !seg.sealed || seg.pending > 0 {
+			return
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️ Error removing WAL segment %s: %v", seg.path, err)
+			return
+		}
+		w.segments = w.segments[1:]
+	}
+}
+
+func (w *writeAheadLog) hasFailed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.failed) > 0
+}
+
+// takeFailed reads back the batches whose flush failed so they can be re-queued.
+// Batches already replayed maxReplays times come back as exhausted instead.
+func (w *writeAheadLog) takeFailed() (records, exhausted []walRecord) {
+	w.mu.Lock()
+	refs := w.failed
+	w.failed = nil
+	giveUp := make(map[walRef]bool)
+	for _, ref := range refs {
+		if w.replays[ref] >= w.maxReplays {
+			giveUp[ref] = true
+		} else {
+			w.replays[ref]++
+		}
+	}
+	w.mu.Unlock()
+
+	header := make([]byte, walHeaderSize)
+	for _, ref := range refs {
+		f, err := os.Open(walSegmentPath(w.dir, ref.Segment))
+		if err != nil {
+			log.Printf("❌ Error opening WAL segment for replay: %v", err)
+			w.Failed(ref)
+			continue
+		}
+		_, payload, err := readWALRecord(f, ref.Offset, header)
+		f.Close()
+
+		var events []LogEvent
+		if err == nil {
+			err = json.Unmarshal(payload, &events)
+		}
+		if err != nil {
+			// Nothing left to replay; settle it so the segment can still be truncated
+			log.Printf("❌ Error reading WAL record %d@%d for replay, abandoning it: %v", ref.Segment, ref.Offset, err)
+			w.Commit(ref)
+			continue
+		}
+		if giveUp[ref] {
+			exhausted = append(exhausted, walRecord{Ref: ref, Events: events})
+		} else {
+			records = append(records, walRecord{Ref: ref, Events: events})
+		}
+	}
+	return records, exhausted
+}
+
+// Stats reports segment and batch counts for /metrics/pipeline
+func (w *writeAheadLog) Stats() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var bytes int64
+	pending := 0
+	for _, seg := range w.segments {
+		bytes += seg.size
+		pending += seg.pending
+	}
+	return map[string]interface{}{
+		"segments":        len(w.segments),
+		"bytes":           bytes,
+		"pending_batches": pending,
+		"failed_batches":  len(w.failed),
+	}
+}
+
+// Close closes the active segment
+func (w *writeAheadLog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.active.Close()
+}
+
+// replayWAL feeds batches from the log back into the pipeline: first everything left
+// over from the previous run, then, whenever the database is reachable again, any
+// batch whose flush failed during an outage
+func replayWAL(w *writeAheadLog, p *writePipeline, leftover []walRecord, interval time.Duration) {
+	if len(leftover) > 0 {
+		// Replayed events keep their ids, so retries of them are still recognised as duplicates
+		now := time.Now()
+		for _, rec := range leftover {
+			ids := make([]string, len(rec.Events))
+			for i, evt := range rec.Events {
+				ids[i] = evt.EventID
+			}
+			p.dedup.remember(ids, now)
+		}
+
+		events := 0
+		for _, rec := range leftover {
+			if !p.Replay(rec.Events, rec.Ref) {
+				return
+			}
+			events += len(rec.Events)
+		}
+		log.Printf("♻️ Replayed %d batches (%d events) from the WAL", len(leftover), events)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !w.hasFailed() {
+			continue
+		}
+		if p.ping() != nil {
+			continue
+		}
+
+		records, exhausted := w.takeFailed()
+		for _, rec := range exhausted {
+			p.deadLetter(rec.Events, fmt.Sprintf("WAL batch still failing after %d replays", w.maxReplays))
+			w.Commit(rec.Ref)
+		}
+		for _, rec := range records {
+			if !p.Replay(rec.Events, rec.Ref) {
+				return
+			}
+		}
+		if len(records) > 0 {
+			log.Printf("♻️ Re-queued %d WAL batches after a write outage", len(records))
+		}
+	}
+}
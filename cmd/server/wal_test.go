@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func walBatch(messages ...string) []LogEvent {
+	events := make([]LogEvent, len(messages))
+	for i, msg := range messages {
+		events[i] = LogEvent{EventID: msg, Service: "api", Level: "INFO", Message: msg}
+	}
+	return events
+}
+
+func openTestWAL(t *testing.T, dir string, segmentBytes int64) (*writeAheadLog, []walRecord) {
+	t.Helper()
+	w, pending, err := openWAL(dir, segmentBytes, false, 3)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, pending
+}
+
+func appendBatches(t *testing.T, w *writeAheadLog, batches ...[]LogEvent) []walRef {
+	t.Helper()
+	refs := make([]walRef, len(batches))
+	for i, events := range batches {
+		ref, err := w.Append(events)
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		refs[i] = ref
+	}
+	return refs
+}
+
+func pendingMessages(records []walRecord) []string {
+	var out []string
+	for _, rec := range records {
+		for _, evt := range rec.Events {
+			out = append(out, evt.Message)
+		}
+	}
+	return out
+}
+
+func TestWALReplaysUncommittedBatches(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir, 1<<20)
+	refs := appendBatches(t, w, walBatch("a"), walBatch("b", "c"), walBatch("d"))
+	w.Commit(refs[1])
+	w.Close()
+
+	_, pending := openTestWAL(t, dir, 1<<20)
+	if got := pendingMessages(pending); len(got) != 2 || got[0] != "a" || got[1] != "d" {
+		t.Errorf("replayed %v, want [a d]", got)
+	}
+}
+
+func TestWALReplayCutsTornAndCorruptTails(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(data []byte, second int64) []byte
+		replays []string
+	}{
+		{"torn header", func(data []byte, second int64) []byte { return data[:second+4] }, []string{"a"}},
+		{"torn payload", func(data []byte, second int64) []byte { return data[:len(data)-3] }, []string{"a"}},
+		{"flipped payload byte", func(data []byte, second int64) []byte {
+			data[second+walHeaderSize+2] ^= 0xff
+			return data
+		}, []string{"a"}},
+		{"absurd length", func(data []byte, second int64) []byte {
+			copy(data[second:], []byte{0xff, 0xff, 0xff, 0xff})
+			return data
+		}, []string{"a"}},
+		{"flipped first checksum", func(data []byte, second int64) []byte {
+			data[5] ^= 0xff
+			return data
+		}, nil},
+		{"garbage appended", func(data []byte, second int64) []byte { return append(data, 0, 0, 0, 1, 9) }, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, _ := openTestWAL(t, dir, 1<<20)
+			refs := appendBatches(t, w, walBatch("a"), walBatch("b"))
+			w.Close()
+
+			path := walSegmentPath(dir, refs[0].Segment)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := tt.damage(data, refs[1].Offset)
+			if err := os.WriteFile(path, damaged, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			w2, pending := openTestWAL(t, dir, 1<<20)
+			got := pendingMessages(pending)
+			if len(got) != len(tt.replays) || (len(got) > 0 && got[len(got)-1] != tt.replays[len(tt.replays)-1]) {
+				t.Fatalf("replayed %v, want %v", got, tt.replays)
+			}
+			// The bad tail is cut off, so the valid prefix is all that is left,
+			// and a segment left with nothing pending is removed
+			info, err := os.Stat(path)
+			if len(tt.replays) == 0 {
+				if !os.IsNotExist(err) {
+					t.Errorf("emptied segment kept: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if seg := w2.segment(refs[0].Segment); seg == nil || seg.size != info.Size() || info.Size() > int64(len(damaged)) {
+				t.Errorf("segment holds %d bytes on disk, %+v in memory", info.Size(), seg)
+			}
+			// and the log takes appends again
+			appendBatches(t, w2, walBatch("e"))
+		})
+	}
+}
+
+func TestWALTruncatesCommittedSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Every record fills a segment, so each batch gets its own
+	w, _ := openTestWAL(t, dir, 1)
+	refs := appendBatches(t, w, walBatch("a"), walBatch("b"))
+	if refs[0].Segment == refs[1].Segment {
+		t.Fatal("segment did not rotate")
+	}
+	w.Commit(refs[1])
+	if w.segment(refs[0].Segment) == nil {
+		t.Error("segment with a pending batch was removed")
+	}
+	w.Commit(refs[0])
+	if w.segment(refs[0].Segment) != nil || w.segment(refs[1].Segment) != nil {
+		t.Errorf("committed segments kept: %d left", len(w.segments))
+	}
+	if _, err := os.Stat(walSegmentPath(dir, refs[0].Segment)); !os.IsNotExist(err) {
+		t.Errorf("segment file still on disk: %v", err)
+	}
+}
+
+// shortWriteFile writes half of the next record and then fails
+type shortWriteFile struct {
+	*os.File
+	failWrites   int
+	failTruncate bool
+}
+
+func (f *shortWriteFile) Write(p []byte) (int, error) {
+	if f.failWrites == 0 {
+		return f.File.Write(p)
+	}
+	f.failWrites--
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *shortWriteFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("read-only file system")
+	}
+	return f.File.Truncate(size)
+}
+
+func TestWALPartialWriteIsCutOff(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir, 1<<20)
+	appendBatches(t, w, walBatch("a"))
+	w.active = &shortWriteFile{File: w.active.(*os.File), failWrites: 1}
+
+	if _, err := w.Append(walBatch("lost")); err == nil {
+		t.Fatal("failed write reported success")
+	}
+	ref := appendBatches(t, w, walBatch("b"))[0]
+	if seg := w.segments[len(w.segments)-1]; ref.Segment != seg.id || seg.pending != 2 {
+		t.Errorf("append after the failure went to %+v, segment %+v", ref, seg)
+	}
+	w.Close()
+
+	_, pending := openTestWAL(t, dir, 1<<20)
+	if got := pendingMessages(pending); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("replayed %v, want [a b]", got)
+	}
+}
+
+func TestWALPartialWriteRotatesWhenTruncateFails(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir, 1<<20)
+	first := appendBatches(t, w, walBatch("a"))[0]
+	w.active = &shortWriteFile{File: w.active.(*os.File), failWrites: 1, failTruncate: true}
+
+	if _, err := w.Append(walBatch("lost")); err == nil {
+		t.Fatal("failed write reported success")
+	}
+	ref := appendBatches(t, w, walBatch("b"))[0]
+	if ref.Segment == first.Segment {
+		t.Error("appended after a torn record in the same segment")
+	}
+	w.Close()
+
+	_, pending := openTestWAL(t, dir, 1<<20)
+	if got := pendingMessages(pending); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("replayed %v, want [a b]", got)
+	}
+}
+
+func TestWALKeepsSegmentWhenRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir, 1)
+	active := w.segments[len(w.segments)-1].id
+	// A directory where the next segment belongs makes creating it fail
+	blocker := walSegmentPath(dir, active+1)
+	if err := os.Mkdir(blocker, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := appendBatches(t, w, walBatch("a"), walBatch("b"))
+	if refs[0].Segment != active || refs[1].Segment != active {
+		t.Fatalf("appends went to %+v, want segment %d", refs, active)
+	}
+
+	os.Remove(blocker)
+	appendBatches(t, w, walBatch("c"))
+	if w.segments[len(w.segments)-1].id != active+1 {
+		t.Error("did not rotate once the segment could be created")
+	}
+	w.Close()
+
+	_, pending := openTestWAL(t, dir, 1)
+	if got := pendingMessages(pending); len(got) != 3 {
+		t.Errorf("replayed %v, want [a b c]", got)
+	}
+}
@@ -0,0 +1,283 @@
+// Package multiline groups consecutive log lines into single events, so a stack
+// trace or panic that arrives one line at a time is stored as one log.
+package multiline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultMaxLines caps how many lines are joined before an event is cut
+const DefaultMaxLines = 500
+
+// Rule describes one kind of multiline event.
+//
+// Rules without Start (Java, Node.js) extend whatever line came before them: any
+// line matching Continue is appended to the current event. Rules with Start
+// (Python, Go) only apply once a line matching Start has opened the event, which
+// lets them accept lines (blank, unindented) that would be too broad otherwise.
+type Rule struct {
+	Name     string
+	Start    *regexp.Regexp
+	Continue *regexp.Regexp
+	// Describe extracts the exception class and top frame from an assembled event
+	Describe func(lines []string) (class, frame string)
+}
+
+// Built-in presets
+var (
+	Java = &Rule{
+		Name: "java",
+		// Frames, chained causes, and the "pkg.SomeException: msg" line logback prints after the message
+		Continue: regexp.MustCompile(`^\s+at \S|^\s+\.\.\. \d+ (more|common frames omitted)|^(Caused by|\s+Suppressed): |^[a-z][\w$]*(\.[\w$]+)+(Exception|Error|Throwable)(: |$)`),
+		Describe: describeJava,
+	}
+	Python = &Rule{
+		Name:  "python",
+		Start: regexp.MustCompile(`^Traceback \(most recent call last\):`),
+		// Indented frames, the exception line, and the separators of chained tracebacks
+		Continue: regexp.MustCompile(`^\s|^$|^Traceback \(most recent call last\):|^During handling of the above exception|^The above exception was the direct cause|^[A-Za-z_][\w.]*(Error|Exception|Warning|Interrupt|Exit|StopIteration)\b`),
+		Describe: describePython,
+	}
+	Go = &Rule{
+		Name:     "go",
+		Start:    regexp.MustCompile(`^(panic: |fatal error: )`),
+		Continue: regexp.MustCompile(`^\s|^$|^goroutine \d+ \[|^\S+\(.*\)$|^created by |^\[signal |^exit status \d+|^panic: `),
+		Describe: describeGo,
+	}
+	Node = &Rule{
+		Name:     "node",
+		Continue: regexp.MustCompile(`^\s+at \S|^\s+\.\.\. \d+ more lines`),
+		Describe: describeNode,
+	}
+)
+
+var presets = map[string]*Rule{"java": Java, "python": Python, "go": Go, "node": Node, "nodejs": Node}
+
+// Presets parses a comma-separated list of preset names such as "java,go"
+func Presets(names string) ([]*Rule, error) {
+	var rules []*Rule
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		rule, ok := presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown multiline preset %q", name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Custom builds a rule from user-supplied patterns; start may be empty
+func Custom(start, cont string) (*Rule, error) {
+	rule := &Rule{Name: "custom"}
+	var err error
+	if start != "" {
+		if rule.Start, err = regexp.Compile(start); err != nil {
+			return nil, fmt.Errorf("invalid start pattern: %w", err)
+		}
+	}
+	if rule.Continue, err = regexp.Compile(cont); err != nil {
+		return nil, fmt.Errorf("invalid continuation pattern: %w", err)
+	}
+	return rule, nil
+}
+
+// Event is one assembled event. Rule is nil for a plain single line.
+type Event struct {
+	Lines []string
+	Rule  *Rule
+}
+
+// Text joins the lines back together
+func (e Event) Text() string {
+	return strings.Join(trimTrailingBlank(e.Lines), "\n")
+}
+
+// Details returns the exception class and top frame, if the rule knows how to find them
+func (e Event) Details() (class, frame string) {
+	if e.Rule == nil || e.Rule.Describe == nil {
+		return "", ""
+	}
+	return e.Rule.Describe(trimTrailingBlank(e.Lines))
+}
+
+// Assembler joins lines from one stream. It is not safe for concurrent use.
+type Assembler struct {
+	rules    []*Rule
+	maxLines int
+
+	lines  []string
+	active *Rule
+}
+
+// New returns an assembler for rules; maxLines <= 0 uses DefaultMaxLines
+func New(rules []*Rule, maxLines int) *Assembler {
+	if maxLines <= 0 {
+		maxLines = DefaultMaxLines
+	}
+	return &Assembler{rules: rules, maxLines: maxLines}
+}
+
+// Add feeds one line. When the line starts a new event, the previous one is
+// returned as complete.
+func (a *Assembler) Add(line string) (Event, bool) {
+	line = strings.TrimRight(line, "\r")
+
+	if len(a.lines) > 0 && len(a.lines) < a.maxLines {
+		if rule := a.continues(line); rule != nil {
+			a.lines = append(a.lines, line)
+			a.active = rule
+			return Event{}, false
+		}
+	}
+
+	done, ok := a.Flush()
+	a.lines = append(a.lines, line)
+	for _, rule := range a.rules {
+		if rule.Start != nil && rule.Start.MatchString(line) {
+			a.active = rule
+			break
+		}
+	}
+	return done, ok
+}
+
+// continues finds the rule that makes line part of the current event
+func (a *Assembler) continues(line string) *Rule {
+	if a.active != nil && a.active.Start != nil {
+		if a.active.Continue.MatchString(line) {
+			return a.active
+		}
+		return nil
+	}
+	for _, rule := range a.rules {
+		if rule.Start == nil && rule.Continue.MatchString(line) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Flush returns the event being assembled, if any
+func (a *Assembler) Flush() (Event, bool) {
+	if len(a.lines) == 0 {
+		return Event{}, false
+	}
+	evt := Event{Lines: a.lines, Rule: a.active}
+	if len(a.lines) == 1 && (a.active == nil || a.active.Start == nil) {
+		evt.Rule = nil
+	}
+	a.lines = nil
+	a.active = nil
+	return evt, true
+}
+
+// Pending reports whether lines are buffered
+func (a *Assembler) Pending() bool {
+	return len(a.lines) > 0
+}
+
+func trimTrailingBlank(lines []string) []string {
+	for len(lines) > 1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+var (
+	javaClassRe   = regexp.MustCompile(`([A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*(?:Exception|Error|Throwable))\b`)
+	javaFrameRe   = regexp.MustCompile(`^\s+at (\S.*)$`)
+	pythonFileRe  = regexp.MustCompile(`^\s+File "[^"]*", line \d+, in .+$`)
+	pythonClassRe = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::|$)`)
+	goFuncRe      = regexp.MustCompile(`^\S+\(.*\)$`)
+	nodeClassRe   = regexp.MustCompile(`\b([A-Z]\w*(?:Error|Exception))\b`)
+)
+
+// describeJava takes the first Throwable named and the first "at" frame
+func describeJava(lines []string) (string, string) {
+	var class, frame string
+	for _, line := range lines {
+		if class == "" {
+			if m := javaClassRe.FindStringSubmatch(line); m != nil {
+				class = m[1]
+			}
+		}
+		if m := javaFrameRe.FindStringSubmatch(line); m != nil {
+			frame = m[1]
+			break
+		}
+	}
+	return class, frame
+}
+
+// describePython takes the final exception line and the innermost (last) frame
+// of the last traceback, since Python prints the raising call last
+func describePython(lines []string) (string, string) {
+	var class, frame string
+	for _, line := range lines {
+		if pythonFileRe.MatchString(line) {
+			frame = strings.TrimSpace(line)
+			continue
+		}
+		if strings.HasPrefix(line, "Traceback ") || strings.HasPrefix(line, "During handling") || strings.HasPrefix(line, "The above exception") {
+			continue
+		}
+		if m := pythonClassRe.FindStringSubmatch(line); m != nil {
+			class = m[1]
+		}
+	}
+	return class, frame
+}
+
+// describeGo reports "panic" or "fatal error" and the first function of the
+// panicking goroutine together with its file:line
+func describeGo(lines []string) (string, string) {
+	var class, frame string
+	if len(lines) > 0 {
+		if strings.HasPrefix(lines[0], "fatal error: ") {
+			class = "fatal error"
+		} else {
+			class = "panic"
+		}
+		// Runtime errors name themselves, e.g. "panic: runtime error: index out of range"
+		if msg := strings.TrimPrefix(lines[0], "panic: "); strings.HasPrefix(msg, "runtime error: ") {
+			class = "runtime.Error"
+		}
+	}
+	for i, line := range lines {
+		// Skip the runtime's own frames so the frame points at user code
+		if goFuncRe.MatchString(line) && !strings.HasPrefix(line, "panic(") && !strings.HasPrefix(line, "runtime.") {
+			frame = line
+			// The next line holds "\tfile.go:12 +0x1d"; it may be blank in a mangled trace
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\t") {
+				if f := strings.Fields(lines[i+1]); len(f) > 0 {
+					frame += " " + f[0]
+				}
+			}
+			break
+		}
+	}
+	return class, frame
+}
+
+// describeNode takes the error name from the first line and the first "at" frame
+func describeNode(lines []string) (string, string) {
+	var class, frame string
+	if len(lines) > 0 {
+		if m := nodeClassRe.FindStringSubmatch(lines[0]); m != nil {
+			class = m[1]
+		}
+	}
+	for _, line := range lines {
+		if m := javaFrameRe.FindStringSubmatch(line); m != nil {
+			frame = m[1]
+			break
+		}
+	}
+	return class, frame
+}
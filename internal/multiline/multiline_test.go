@@ -0,0 +1,201 @@
+package multiline
+
+import (
+	"strings"
+	"testing"
+)
+
+// assemble feeds lines through an assembler and returns every event, the last one flushed
+func assemble(rules []*Rule, lines ...string) []Event {
+	a := New(rules, 0)
+	var events []Event
+	for _, line := range lines {
+		if evt, ok := a.Add(line); ok {
+			events = append(events, evt)
+		}
+	}
+	if evt, ok := a.Flush(); ok {
+		events = append(events, evt)
+	}
+	return events
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []*Rule
+		lines []string
+		want  []int // lines per event
+		rule  []string
+	}{
+		{
+			name:  "java trace with cause",
+			rules: []*Rule{Java},
+			lines: []string{
+				"Request failed",
+				"java.lang.IllegalStateException: bad state",
+				"\tat com.acme.Service.run(Service.java:42)",
+				"Caused by: java.io.IOException: closed",
+				"\t... 3 more",
+				"next request",
+			},
+			want: []int{5, 1},
+			rule: []string{"java", ""},
+		},
+		{
+			name:  "python traceback",
+			rules: []*Rule{Python},
+			lines: []string{
+				"Traceback (most recent call last):",
+				`  File "app.py", line 3, in <module>`,
+				"    main()",
+				"",
+				"ValueError: nope",
+				"next",
+			},
+			want: []int{5, 1},
+			rule: []string{"python", ""},
+		},
+		{
+			name:  "go panic",
+			rules: []*Rule{Go},
+			lines: []string{
+				"panic: boom",
+				"",
+				"goroutine 1 [running]:",
+				"main.foo()",
+				"\t/src/main.go:12 +0x1d",
+				"exit status 2",
+				"listening on :8080",
+			},
+			want: []int{6, 1},
+			rule: []string{"go", ""},
+		},
+		{
+			name:  "node error",
+			rules: []*Rule{Node},
+			lines: []string{
+				"TypeError: x is undefined",
+				"    at run (/app/index.js:3:9)",
+				"    ... 4 more lines",
+			},
+			want: []int{3},
+			rule: []string{"node"},
+		},
+		{
+			name:  "plain lines stay apart",
+			rules: []*Rule{Java, Python, Go, Node},
+			lines: []string{"one", "two", "three"},
+			want:  []int{1, 1, 1},
+			rule:  []string{"", "", ""},
+		},
+		{
+			name:  "continuation without a start line",
+			rules: []*Rule{Go},
+			lines: []string{"\tmain.go:12", "main.foo()"},
+			want:  []int{1, 1},
+			rule:  []string{"", ""},
+		},
+	}
+	for _, tt := range tests {
+		events := assemble(tt.rules, tt.lines...)
+		if len(events) != len(tt.want) {
+			t.Errorf("%s: got %d events, want %d", tt.name, len(events), len(tt.want))
+			continue
+		}
+		for i, evt := range events {
+			name := ""
+			if evt.Rule != nil {
+				name = evt.Rule.Name
+			}
+			if len(evt.Lines) != tt.want[i] || name != tt.rule[i] {
+				t.Errorf("%s: event %d has %d lines (rule %q), want %d (rule %q)", tt.name, i, len(evt.Lines), name, tt.want[i], tt.rule[i])
+			}
+		}
+	}
+}
+
+func TestAssembleMaxLines(t *testing.T) {
+	a := New([]*Rule{Java}, 3)
+	var events []Event
+	for _, line := range []string{"boom", "\tat a.B.c(B.java:1)", "\tat a.B.d(B.java:2)", "\tat a.B.e(B.java:3)"} {
+		if evt, ok := a.Add(line); ok {
+			events = append(events, evt)
+		}
+	}
+	if len(events) != 1 || len(events[0].Lines) != 3 || !a.Pending() {
+		t.Fatalf("got %d events, want one of 3 lines and the fourth pending", len(events))
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  *Rule
+		lines []string
+		class string
+		frame string
+	}{
+		{"java", Java, []string{"oops", "java.lang.NullPointerException: x", "\tat com.acme.A.b(A.java:1)", "\tat com.acme.A.c(A.java:2)"},
+			"java.lang.NullPointerException", "com.acme.A.b(A.java:1)"},
+		{"java without frames", Java, []string{"java.lang.OutOfMemoryError", "\t... 12 more"}, "java.lang.OutOfMemoryError", ""},
+		{"java frame without class", Java, []string{"failed", "\tat x"}, "", "x"},
+		{"java empty", Java, nil, "", ""},
+		{"java blank frame", Java, []string{"java.lang.StackOverflowError", "\tat ", "\tat   "}, "java.lang.StackOverflowError", ""},
+
+		{"go panic", Go, []string{"panic: boom", "", "goroutine 1 [running]:", "main.foo()", "\t/src/main.go:12 +0x1d"}, "panic", "main.foo() /src/main.go:12"},
+		{"go runtime error", Go, []string{"panic: runtime error: index out of range [3] with length 1", "goroutine 1 [running]:", "panic({0x1, 0x2})", "\t/go/src/runtime/panic.go:9", "main.bar(...)", "\t/src/bar.go:7 +0x1"},
+			"runtime.Error", "main.bar(...) /src/bar.go:7"},
+		{"go fatal error", Go, []string{"fatal error: all goroutines are asleep - deadlock!", "runtime.gopark()", "main.main()"}, "fatal error", "main.main()"},
+		{"go blank file line", Go, []string{"panic: boom", "main.foo()", "\t", "exit status 2"}, "panic", "main.foo()"},
+		{"go whitespace file line", Go, []string{"panic: boom", "main.foo()", "\t \t "}, "panic", "main.foo()"},
+		{"go frame last", Go, []string{"panic: boom", "main.foo()"}, "panic", "main.foo()"},
+		{"go no frames", Go, []string{"panic: boom", "goroutine 1 [running]:"}, "panic", ""},
+		{"go empty", Go, nil, "", ""},
+
+		{"python", Python, []string{"Traceback (most recent call last):", `  File "a.py", line 1, in <module>`, `  File "b.py", line 9, in run`, "KeyError: 'x'"}, "KeyError", `File "b.py", line 9, in run`},
+		{"node", Node, []string{"RangeError: too far", "    at walk (/app/a.js:1:2)"}, "RangeError", "walk (/app/a.js:1:2)"},
+	}
+	for _, tt := range tests {
+		class, frame := Event{Lines: tt.lines, Rule: tt.rule}.Details()
+		if class != tt.class || frame != tt.frame {
+			t.Errorf("%s: got (%q, %q), want (%q, %q)", tt.name, class, frame, tt.class, tt.frame)
+		}
+	}
+}
+
+func TestDetailsPlainLine(t *testing.T) {
+	if class, frame := (Event{Lines: []string{"hello"}}).Details(); class != "" || frame != "" {
+		t.Errorf("plain line described as (%q, %q)", class, frame)
+	}
+}
+
+func TestText(t *testing.T) {
+	evt := Event{Lines: []string{"panic: boom", "main.foo()", "", " "}}
+	if got := evt.Text(); got != "panic: boom\nmain.foo()" {
+		t.Errorf("Text() = %q", got)
+	}
+}
+
+func TestPresetsAndCustom(t *testing.T) {
+	rules, err := Presets(" Java, nodejs ,,go")
+	if err != nil || len(rules) != 3 || rules[0] != Java || rules[1] != Node || rules[2] != Go {
+		t.Fatalf("Presets = %v, %v", rules, err)
+	}
+	if _, err := Presets("java,cobol"); err == nil || !strings.Contains(err.Error(), "cobol") {
+		t.Errorf("unknown preset accepted: %v", err)
+	}
+	if _, err := Custom("(", `^\s`); err == nil {
+		t.Error("invalid start pattern accepted")
+	}
+	if _, err := Custom("", "["); err == nil {
+		t.Error("invalid continuation pattern accepted")
+	}
+	rule, err := Custom(`^BEGIN`, `^\s`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := assemble([]*Rule{rule}, "BEGIN job", "  step", "done"); len(events) != 2 || len(events[0].Lines) != 2 {
+		t.Errorf("custom rule assembled %d events", len(events))
+	}
+}